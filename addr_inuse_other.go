@@ -0,0 +1,8 @@
+//go:build !windows
+// +build !windows
+
+package socks_go
+
+import "syscall"
+
+const errAddrInUse = syscall.EADDRINUSE
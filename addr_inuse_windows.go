@@ -0,0 +1,6 @@
+package socks_go
+
+import "syscall"
+
+// WSAEADDRINUSE, syscall.EADDRINUSE is not returned by winsock
+const errAddrInUse = syscall.Errno(10048)
@@ -0,0 +1,196 @@
+package socks_go
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// version of the username/password sub-negotiation, RFC 1929
+const userPassVersion byte = 1
+
+// security level of auth methods, starts at 1 so that zero means unset
+const (
+	SecurityNone     = iota + 1 // no authentication
+	SecurityPassword            // credentials, maybe in clear text
+	SecurityStrong              // GSS-API
+)
+
+// MethodSecurity returns the default security level of a method.
+func MethodSecurity(method byte) int {
+	switch method {
+	case MethodNone:
+		return SecurityNone
+	case MethodGSSApi:
+		return SecurityStrong
+	default:
+		return SecurityPassword
+	}
+}
+
+type ClientAuthMethod struct {
+	Method byte
+	// methods with higher priority are offered first
+	Priority int
+	// zero means MethodSecurity(Method)
+	Security int
+	Handler  ClientAuthHandlerFunc
+}
+
+func (am ClientAuthMethod) security() int {
+	if am.Security == 0 {
+		return MethodSecurity(am.Method)
+	}
+	return am.Security
+}
+
+// SortClientAuthMethods returns a copy of methods sorted by priority,
+// methods with the same priority keep their order.
+func SortClientAuthMethods(methods []ClientAuthMethod) []ClientAuthMethod {
+	sorted := make([]ClientAuthMethod, len(methods))
+	copy(sorted, methods)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+	return sorted
+}
+
+// AuthMethodError is returned when client and server can not agree on an auth method.
+type AuthMethodError struct {
+	Reason  string
+	Offered []byte
+	Chosen  byte
+}
+
+func (e *AuthMethodError) Error() string {
+	return fmt.Sprintf("%s. offered: %v, chosen: %#x", e.Reason, e.Offered, e.Chosen)
+}
+
+// ServerAuthMethodFunc runs the sub-negotiation of an auth method after the
+// method is accepted. It may take several round trips on proto.Transport and
+// may call proto.SetTransport to encapsulate the rest of the session.
+type ServerAuthMethodFunc func(proto *ServerProtocol) error
+
+// ServerAuthRegistry selects an auth method from those offered by client
+// and runs its sub-negotiation. Methods registered first are preferred.
+type ServerAuthRegistry struct {
+	order    []byte
+	handlers map[byte]ServerAuthMethodFunc
+}
+
+func NewServerAuthRegistry() *ServerAuthRegistry {
+	return &ServerAuthRegistry{handlers: make(map[byte]ServerAuthMethodFunc)}
+}
+
+func (r *ServerAuthRegistry) Register(method byte, handler ServerAuthMethodFunc) error {
+	if method == MethodReject {
+		return errors.Errorf("can not register method %#x", method)
+	}
+	if handler == nil {
+		return errors.Errorf("nil handler for method %#x", method)
+	}
+
+	if _, ok := r.handlers[method]; !ok {
+		r.order = append(r.order, method)
+	}
+	r.handlers[method] = handler
+	return nil
+}
+
+// Select returns the most preferred registered method offered by client.
+func (r *ServerAuthRegistry) Select(methods []byte) (method byte, ok bool) {
+	for _, method = range r.order {
+		for _, offered := range methods {
+			if offered == method {
+				return method, true
+			}
+		}
+	}
+	return MethodReject, false
+}
+
+// AuthHandler implements AuthHandlerFunc.
+func (r *ServerAuthRegistry) AuthHandler(methods []byte, proto *ServerProtocol) (err error) {
+	method, ok := r.Select(methods)
+	if !ok {
+		err = proto.RejectAuthMethod()
+		if err == nil {
+			err = errors.Errorf("no acceptable auth method. offered: %v, supported: %v", methods, r.order)
+		}
+		return
+	}
+
+	err = proto.AcceptAuthMethod(method)
+	if err != nil {
+		return
+	}
+
+	err = r.handlers[method](proto)
+	if err != nil {
+		err = errors.Wrapf(err, "auth method %#x failed", method)
+	}
+	return
+}
+
+func ServerNoAuthMethod(proto *ServerProtocol) error {
+	return nil
+}
+
+// ServerPeerCredMethod accepts clients on unix socket by peer credentials,
+// usually registered for MethodNone.
+func ServerPeerCredMethod(check func(cred PeerCred) bool) ServerAuthMethodFunc {
+	return func(proto *ServerProtocol) error {
+		cred := proto.Identity.Cred
+		if cred == nil {
+			return errors.New("peer credentials not available")
+		}
+		if !check(*cred) {
+			return errors.Errorf("peer credentials rejected. pid: %d, uid: %d, gid: %d", cred.PID, cred.UID, cred.GID)
+		}
+		return nil
+	}
+}
+
+type UserPassCheckerFunc func(user string, password string) bool
+
+// ServerUserPassMethod implements username/password authentication of RFC 1929.
+func ServerUserPassMethod(check UserPassCheckerFunc) ServerAuthMethodFunc {
+	return func(proto *ServerProtocol) (err error) {
+		user, password, err := proto.GetUserPass()
+		if err != nil {
+			return
+		}
+
+		success := check(user, password)
+		err = proto.ReplyUserPass(success)
+		if err != nil {
+			return
+		}
+		if !success {
+			return errors.Errorf("bad username or password. user: %q", user)
+		}
+
+		proto.Identity.User = user
+		return
+	}
+}
+
+// ClientUserPassAuth implements username/password authentication of RFC 1929.
+func ClientUserPassAuth(user string, password string) ClientAuthHandlerFunc {
+	return func(proto *ClientProtocol) (err error) {
+		err = proto.SendUserPass(user, password)
+		if err != nil {
+			return
+		}
+
+		success, err := proto.ReceiveUserPassStatus()
+		if err != nil {
+			return
+		}
+		if !success {
+			err = errors.Errorf("username/password rejected by server. user: %q", user)
+		}
+		return
+	}
+}
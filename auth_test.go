@@ -0,0 +1,152 @@
+package socks_go
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerAuthRegistry_Select(t *testing.T) {
+	reg := NewServerAuthRegistry()
+	require.NoError(t, reg.Register(MethodUserName, ServerNoAuthMethod))
+	require.NoError(t, reg.Register(MethodNone, ServerNoAuthMethod))
+	require.Error(t, reg.Register(MethodReject, ServerNoAuthMethod))
+
+	method, ok := reg.Select([]byte{MethodNone, MethodUserName})
+	assert.True(t, ok)
+	assert.Equal(t, MethodUserName, method)
+
+	method, ok = reg.Select([]byte{MethodNone})
+	assert.True(t, ok)
+	assert.Equal(t, MethodNone, method)
+
+	_, ok = reg.Select([]byte{MethodGSSApi})
+	assert.False(t, ok)
+}
+
+func TestServerAuthRegistry_Reject(t *testing.T) {
+	tr := newFakeTransport()
+	proto := NewServerProtocol(&tr)
+	reg := NewServerAuthRegistry()
+	require.NoError(t, reg.Register(MethodUserName, ServerNoAuthMethod))
+
+	tr.Send([]byte{0x05, 0x01, MethodNone})
+	methods, err := proto.GetAuthMethods()
+	require.NoError(t, err)
+
+	err = reg.AuthHandler(methods, &proto)
+	assert.Error(t, err)
+	assert.Equal(t, []byte{0x05, MethodReject}, tr.output)
+	assert.Equal(t, PSClose, proto.State)
+}
+
+func TestServerUserPassMethod(t *testing.T) {
+	tr := newFakeTransport()
+	proto := NewServerProtocol(&tr)
+	reg := NewServerAuthRegistry()
+	check := func(user string, password string) bool {
+		return user == "user" && password == "pass"
+	}
+	require.NoError(t, reg.Register(MethodUserName, ServerUserPassMethod(check)))
+
+	tr.Send([]byte{0x05, 0x01, MethodUserName})
+	methods, err := proto.GetAuthMethods()
+	require.NoError(t, err)
+
+	tr.Send([]byte{0x01, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'})
+	err = reg.AuthHandler(methods, &proto)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x05, MethodUserName, 0x01, 0x00}, tr.output)
+	assert.Equal(t, Identity{Method: MethodUserName, User: "user"}, proto.Identity)
+
+	require.NoError(t, proto.AuthDone())
+}
+
+func TestServerUserPassMethod_BadPassword(t *testing.T) {
+	tr := newFakeTransport()
+	proto := NewServerProtocol(&tr)
+	reg := NewServerAuthRegistry()
+	check := func(user string, password string) bool {
+		return false
+	}
+	require.NoError(t, reg.Register(MethodUserName, ServerUserPassMethod(check)))
+
+	tr.Send([]byte{0x05, 0x01, MethodUserName})
+	methods, err := proto.GetAuthMethods()
+	require.NoError(t, err)
+
+	tr.Send([]byte{0x01, 1, 'u', 1, 'p'})
+	err = reg.AuthHandler(methods, &proto)
+	assert.Error(t, err)
+	assert.Equal(t, []byte{0x05, MethodUserName, 0x01, 0x01}, tr.output)
+	assert.Equal(t, PSClose, proto.State)
+}
+
+func TestClientUserPassAuth(t *testing.T) {
+	tr := newFakeTransport()
+	proto := NewClientProtocol(&tr)
+
+	require.NoError(t, proto.SendAuthMethods([]byte{MethodUserName}))
+	tr.Send([]byte{0x05, MethodUserName})
+	_, err := proto.ReceiveAuthMethod()
+	require.NoError(t, err)
+	tr.output = []byte{}
+
+	tr.Send([]byte{0x01, 0x00})
+	err = ClientUserPassAuth("u", "p")(&proto)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x01, 1, 'u', 1, 'p'}, tr.output)
+}
+
+// xors every byte, for testing transport encapsulation
+type xorTransport struct {
+	io.ReadWriter
+	key byte
+}
+
+func (x *xorTransport) Read(p []byte) (n int, err error) {
+	n, err = x.ReadWriter.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= x.key
+	}
+	return
+}
+
+func (x *xorTransport) Write(p []byte) (n int, err error) {
+	buf := make([]byte, len(p))
+	for i := range p {
+		buf[i] = p[i] ^ x.key
+	}
+	return x.ReadWriter.Write(buf)
+}
+
+func TestServerAuthRegistry_Encapsulation(t *testing.T) {
+	tr := newFakeTransport()
+	proto := NewServerProtocol(&tr)
+	reg := NewServerAuthRegistry()
+	require.NoError(t, reg.Register(MethodPrivateBegin, func(proto *ServerProtocol) error {
+		proto.SetTransport(&xorTransport{proto.Transport, 0xff})
+		return nil
+	}))
+
+	tr.Send([]byte{0x05, 0x01, MethodPrivateBegin})
+	methods, err := proto.GetAuthMethods()
+	require.NoError(t, err)
+	require.NoError(t, reg.AuthHandler(methods, &proto))
+	require.NoError(t, proto.AuthDone())
+	tr.output = []byte{}
+
+	// request is read through the encapsulating transport
+	req := []byte{0x05, 0x01, 0x00, 0x01, 0x01, 0x02, 0x03, 0x04, 0x12, 0x34}
+	for i := range req {
+		req[i] ^= 0xff
+	}
+	tr.Send(req)
+	cmd, addr, port, err := proto.GetRequest()
+	require.NoError(t, err)
+	assert.Equal(t, CmdConnect, cmd)
+	assert.Equal(t, "1.2.3.4", addr.String())
+	assert.Equal(t, uint16(0x1234), port)
+}
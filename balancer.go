@@ -0,0 +1,282 @@
+package socks_go
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/account-login/socks_go/util"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// BalancePolicy chooses the proxy of Balancer for a new tunnel.
+type BalancePolicy int
+
+const (
+	// weighted round-robin
+	BalanceRoundRobin BalancePolicy = iota
+	// fewest tunnels per weight
+	BalanceLeastConns
+	// lowest average time of establishing tunnels
+	BalanceLatency
+)
+
+func (p BalancePolicy) String() string {
+	switch p {
+	case BalanceRoundRobin:
+		return "round-robin"
+	case BalanceLeastConns:
+		return "least-conns"
+	case BalanceLatency:
+		return "latency"
+	default:
+		return "BalancePolicy(" + strconv.Itoa(int(p)) + ")"
+	}
+}
+
+type BalancerProxy struct {
+	Dialer *Dialer
+	// share of tunnels, zero means 1
+	Weight int
+}
+
+// Balancer dials through one of Proxies, failing over to others when a proxy can not
+// be connected, the TLS handshake or auth fails. Failed proxies are skipped until retried
+// with backoff. Other errors, e.g. rejections by proxy or unresolvable targets, are returned
+// without failover.
+type Balancer struct {
+	Proxies []BalancerProxy
+	Policy  BalancePolicy
+	// first delay before retrying a failed proxy, doubled on consecutive failures
+	// up to MaxBackoff. 1s and 1m if zero.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	initOnce sync.Once
+	mu       sync.Mutex
+	states   []proxyState
+	// rotates the order of proxies on ties
+	next int
+}
+
+type proxyState struct {
+	// tunnels being established or open
+	active int
+	// moving average, zero if not measured yet
+	latency time.Duration
+	// consecutive failures
+	fails   int
+	retryAt time.Time
+	// for smooth weighted round-robin
+	current int
+}
+
+func (b *Balancer) init() {
+	b.initOnce.Do(func() {
+		if b.Backoff == 0 {
+			b.Backoff = time.Second
+		}
+		if b.MaxBackoff == 0 {
+			b.MaxBackoff = time.Minute
+		}
+		b.states = make([]proxyState, len(b.Proxies))
+	})
+}
+
+func (b *Balancer) weight(i int) int {
+	if w := b.Proxies[i].Weight; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// candidates returns indexes of proxies to try in order.
+func (b *Balancer) candidates() (order []int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	n := len(b.Proxies)
+	b.next++
+	earliest := -1
+	for k := 0; k < n; k++ {
+		i := (b.next + k) % n
+		st := &b.states[i]
+		if st.fails > 0 && now.Before(st.retryAt) {
+			if earliest < 0 || st.retryAt.Before(b.states[earliest].retryAt) {
+				earliest = i
+			}
+			continue
+		}
+		order = append(order, i)
+	}
+	if len(order) == 0 {
+		// all failed recently, try the one to be retried first
+		if earliest >= 0 {
+			order = append(order, earliest)
+		}
+		return
+	}
+
+	switch b.Policy {
+	case BalanceLeastConns:
+		sort.SliceStable(order, func(x, y int) bool {
+			i, j := order[x], order[y]
+			return b.states[i].active*b.weight(j) < b.states[j].active*b.weight(i)
+		})
+	case BalanceLatency:
+		sort.SliceStable(order, func(x, y int) bool {
+			return b.states[order[x]].latency < b.states[order[y]].latency
+		})
+	default:
+		// smooth weighted round-robin, the others follow for failover
+		total, best := 0, 0
+		for x, i := range order {
+			b.states[i].current += b.weight(i)
+			total += b.weight(i)
+			if b.states[i].current > b.states[order[best]].current {
+				best = x
+			}
+		}
+		b.states[order[best]].current -= total
+		order[0], order[best] = order[best], order[0]
+	}
+	return
+}
+
+// done records the result of a tunnel through proxy i.
+func (b *Balancer) done(i int, elapsed time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := &b.states[i]
+	if err != nil {
+		st.active--
+		st.fails++
+		st.retryAt = time.Now().Add(b.backoff(st.fails))
+		return
+	}
+
+	st.fails = 0
+	if st.latency == 0 {
+		st.latency = elapsed
+	} else {
+		st.latency = (3*st.latency + elapsed) / 4
+	}
+}
+
+// backoff doubles Backoff for each consecutive failure, up to MaxBackoff without overflow.
+func (b *Balancer) backoff(fails int) time.Duration {
+	backoff := b.Backoff
+	for k := 1; k < fails && backoff < b.MaxBackoff; k++ {
+		if backoff > b.MaxBackoff/2 {
+			return b.MaxBackoff
+		}
+		backoff *= 2
+	}
+	if backoff <= 0 || backoff > b.MaxBackoff {
+		return b.MaxBackoff
+	}
+	return backoff
+}
+
+func (b *Balancer) release(i int) {
+	b.mu.Lock()
+	b.states[i].active--
+	b.mu.Unlock()
+}
+
+// balancedConn releases the proxy when closed.
+type balancedConn struct {
+	net.Conn
+	b    *Balancer
+	idx  int
+	once sync.Once
+}
+
+func (c *balancedConn) Close() error {
+	c.once.Do(func() {
+		c.b.release(c.idx)
+	})
+	return c.Conn.Close()
+}
+
+// DialFunc establishes a tunnel with fn through proxies chosen by Policy,
+// for handshakes not covered by Dialer. Only ProxyError or AuthMethodError returned by fn fails over to the next proxy.
+// The proxy is released when the returned conn is closed.
+func (b *Balancer) DialFunc(fn func(d *Dialer) (net.Conn, error)) (conn net.Conn, err error) {
+	b.init()
+	if len(b.Proxies) == 0 {
+		return nil, errors.New("no proxy")
+	}
+
+	merr := util.NewMultipleErrors()
+	for _, i := range b.candidates() {
+		d := b.Proxies[i].Dialer
+		b.mu.Lock()
+		b.states[i].active++
+		b.mu.Unlock()
+
+		start := time.Now()
+		conn, err = fn(d)
+		if err == nil {
+			b.done(i, time.Since(start), nil)
+			return &balancedConn{Conn: conn, b: b, idx: i}, nil
+		}
+		if !isProxyError(err) {
+			if _, rejected := errors.Cause(err).(*ReplyError); rejected {
+				// the proxy works
+				b.done(i, time.Since(start), nil)
+			}
+			b.release(i)
+			return
+		}
+
+		b.done(i, time.Since(start), err)
+		log.Warnf("proxy %v failed: %v", d.ProxyAddr, err)
+		merr.Add(d.ProxyAddr, err)
+	}
+	return nil, errors.Wrap(merr.ToError(), "all proxies failed")
+}
+
+// DialSocksAddr connects to addr:port through proxies chosen by Policy. The target is resolved
+// once by the first dialer with ResolveLocal, other dialers with ResolveLocal reuse the result.
+func (b *Balancer) DialSocksAddr(addr SocksAddr, port uint16) (net.Conn, error) {
+	var resolved *SocksAddr
+	return b.DialFunc(func(d *Dialer) (net.Conn, error) {
+		target := addr
+		if d.Param.Resolve == ResolveLocal && addr.Type == ATypeDomain {
+			if resolved == nil {
+				ip, err := d.resolveTarget(addr)
+				if err != nil {
+					return nil, err
+				}
+				resolved = &ip
+			}
+			target = *resolved
+		}
+		return d.DialSocksAddr(target, port)
+	})
+}
+
+// Dial implements the Dial method of golang.org/x/net/proxy.Dialer, only tcp is supported.
+func (b *Balancer) Dial(network, address string) (net.Conn, error) {
+	addr, port, err := parseDialAddress(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return b.DialSocksAddr(addr, port)
+}
+
+// Close closes connections kept by dialers of Proxies.
+func (b *Balancer) Close() (err error) {
+	for _, p := range b.Proxies {
+		if closeErr := p.Dialer.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return
+}
@@ -0,0 +1,208 @@
+package socks_go
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBalancer(policy BalancePolicy, weights ...int) *Balancer {
+	b := &Balancer{Policy: policy}
+	for _, w := range weights {
+		b.Proxies = append(b.Proxies, BalancerProxy{Dialer: &Dialer{}, Weight: w})
+	}
+	b.init()
+	return b
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	b := newTestBalancer(BalanceRoundRobin, 3, 0, 1)
+
+	// shares of weights in every cycle
+	for cycle := 0; cycle < 3; cycle++ {
+		counts := make([]int, 3)
+		for i := 0; i < 5; i++ {
+			order := b.candidates()
+			assert.Len(t, order, 3)
+			counts[order[0]]++
+		}
+		assert.Equal(t, []int{3, 1, 1}, counts)
+	}
+}
+
+func TestBalancer_LeastConns(t *testing.T) {
+	b := newTestBalancer(BalanceLeastConns, 1, 2, 1)
+	b.states[0].active = 2
+	b.states[1].active = 3
+	b.states[2].active = 1
+	assert.Equal(t, 2, b.candidates()[0])
+
+	// per weight
+	b.states[2].active = 2
+	assert.Equal(t, 1, b.candidates()[0])
+}
+
+func TestBalancer_Latency(t *testing.T) {
+	b := newTestBalancer(BalanceLatency, 1, 1, 1)
+	b.done(0, 30*time.Millisecond, nil)
+	b.done(1, 10*time.Millisecond, nil)
+	// not measured yet
+	assert.Equal(t, []int{2, 1, 0}, b.candidates())
+
+	b.done(2, 50*time.Millisecond, nil)
+	b.done(1, 90*time.Millisecond, nil)
+	assert.Equal(t, 30*time.Millisecond, b.states[1].latency)
+	assert.Equal(t, []int{0, 1, 2}, b.candidates())
+}
+
+func TestBalancer_Backoff(t *testing.T) {
+	b := newTestBalancer(BalanceRoundRobin, 1, 1)
+	b.Backoff, b.MaxBackoff = time.Second, 3*time.Second
+
+	b.states[0].active = 1
+	b.done(0, 0, assert.AnError)
+	assert.Equal(t, 0, b.states[0].active)
+	assert.Equal(t, []int{1}, b.candidates())
+
+	for i, expected := range []time.Duration{2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		b.done(0, 0, assert.AnError)
+		assert.WithinDuration(t, time.Now().Add(expected), b.states[0].retryAt, time.Second/2, "%d", i)
+	}
+
+	// all failed, the one to be retried first
+	b.done(1, 0, assert.AnError)
+	assert.Equal(t, []int{1}, b.candidates())
+
+	// retried after backoff
+	b.states[0].retryAt = time.Now()
+	assert.Contains(t, b.candidates(), 0)
+	b.done(0, time.Millisecond, nil)
+	assert.Zero(t, b.states[0].fails)
+
+	// no overflow
+	b.Backoff, b.MaxBackoff = time.Hour, 1<<62
+	assert.Equal(t, time.Hour, b.backoff(1))
+	assert.Equal(t, 4*time.Hour, b.backoff(3))
+	for _, fails := range []int{40, 64, 100} {
+		assert.Equal(t, time.Duration(1<<62), b.backoff(fails), "%d", fails)
+	}
+}
+
+type countingResolver struct {
+	staticResolver
+	calls int
+}
+
+func (r *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.calls++
+	return r.staticResolver.LookupIPAddr(ctx, host)
+}
+
+func TestBalancer_NotProxyFailure(t *testing.T) {
+	server := &Server{}
+	defer server.Close()
+	alive := startServer(t, server)
+
+	resolver := &countingResolver{}
+	param := ClientParam{Resolve: ResolveLocal, Resolver: resolver}
+	b := &Balancer{Proxies: []BalancerProxy{
+		{Dialer: &Dialer{ProxyAddr: alive.ProxyAddr, Param: param}},
+		{Dialer: &Dialer{ProxyAddr: alive.ProxyAddr, Param: param}},
+	}}
+	defer b.Close()
+
+	// unresolvable target, resolved once without failover
+	_, err := b.Dial("tcp", "nx.test:80")
+	assert.Error(t, err)
+	assert.Equal(t, 1, resolver.calls)
+
+	// wrapped rejection
+	_, err = b.DialFunc(func(d *Dialer) (net.Conn, error) {
+		return nil, errors.Wrap(&ReplyError{Reply: ReplyHostUnreachable}, "dial")
+	})
+	assert.Equal(t, &ReplyError{Reply: ReplyHostUnreachable}, errors.Cause(err))
+
+	for i := range b.states {
+		assert.Zero(t, b.states[i].fails)
+		assert.Zero(t, b.states[i].active)
+	}
+}
+
+func TestBalancer_Failover(t *testing.T) {
+	target := startEchoTarget(t)
+	defer target.Close()
+
+	server := &Server{Rules: RuleSet{{Action: RuleDeny, Domains: []string{"denied.example.com"}}}}
+	defer server.Close()
+	alive := startServer(t, server)
+
+	// refuses connections, closed after other listeners so the port is not taken by them
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead.Close()
+
+	b := &Balancer{Proxies: []BalancerProxy{
+		{Dialer: &Dialer{ProxyAddr: dead.Addr().String(), Timeout: time.Second}},
+		{Dialer: alive},
+	}}
+	defer b.Close()
+
+	for i := 0; i < 4; i++ {
+		conn, err := b.Dial("tcp", target.Addr().String())
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+		conn.Close()
+	}
+	assert.Equal(t, 1, b.states[0].fails)
+	assert.Zero(t, b.states[0].active)
+	assert.Zero(t, b.states[1].active)
+
+	// rejected by the proxy, not failed over
+	_, err = b.Dial("tcp", "denied.example.com:80")
+	assert.Equal(t, &ReplyError{Reply: ReplyNotAllowed}, err)
+	assert.Zero(t, b.states[1].fails)
+
+	b.Proxies[1].Dialer = &Dialer{ProxyAddr: dead.Addr().String()}
+	_, err = b.Dial("tcp", target.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestBalancer_AuthFailover(t *testing.T) {
+	target := startEchoTarget(t)
+	defer target.Close()
+
+	registry := NewServerAuthRegistry()
+	require.NoError(t, registry.Register(MethodUserName, ServerUserPassMethod(func(user, password string) bool {
+		return user == "foo" && password == "bar"
+	})))
+	server := &Server{AuthHandler: registry.AuthHandler}
+	defer server.Close()
+	noAuth := startServer(t, server)
+	other := &Server{}
+	defer other.Close()
+	alive := startServer(t, other)
+
+	b := &Balancer{Proxies: []BalancerProxy{{Dialer: noAuth}, {Dialer: alive}}}
+	defer b.Close()
+	for i := 0; i < 2; i++ {
+		conn, err := b.Dial("tcp", target.Addr().String())
+		require.NoError(t, err)
+		conn.Close()
+	}
+	assert.Equal(t, 1, b.states[0].fails)
+
+	// the wrapped failure is reachable
+	_, err := noAuth.Dial("tcp", target.Addr().String())
+	assert.IsType(t, &AuthMethodError{}, err)
+	err = &ProxyError{errors.Wrap(err, "auth")}
+	var authErr *AuthMethodError
+	assert.True(t, errors.As(err, &authErr))
+}
@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package socks_go
+
+import (
+	"syscall"
+)
+
+// bindDeviceControl binds sockets to a network interface with SO_BINDTODEVICE.
+func bindDeviceControl(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var bindErr error
+		err := c.Control(func(fd uintptr) {
+			bindErr = syscall.BindToDevice(int(fd), device)
+		})
+		if err != nil {
+			return err
+		}
+		return bindErr
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package socks_go
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func bindDeviceControl(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.Errorf("binding to device %q is not supported on this platform", device)
+	}
+}
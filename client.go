@@ -1,11 +1,14 @@
 package socks_go
 
 import (
+	"context"
+	"fmt"
 	"io"
 
 	log "github.com/cihub/seelog"
 
 	"net"
+	"sort"
 	"time"
 
 	"github.com/pkg/errors"
@@ -14,16 +17,37 @@ import (
 // TODO: timeout
 type ClientParam struct {
 	FixUDPAddr bool
+	// UDPAssociation carries datagrams on the tcp connection with CmdUDPOverTCP
+	UDPOverTCP bool
+	// where domain targets of CONNECT are resolved, ResolveRemote by default
+	Resolve ResolveMode
+	// address family preference of ResolveLocal
+	ResolveFamily DialMode
+	// for ResolveLocal, net.DefaultResolver if nil
+	Resolver Resolver
+	// methods with lower security level are not offered,
+	// e.g. SecurityPassword refuses MethodNone
+	MinSecurity int
 }
 
 type Client struct {
-	protocol     ClientProtocol
-	authHandlers map[byte]ClientAuthHandlerFunc
-	param        ClientParam
+	conn        io.ReadWriter // transport before auth encapsulation
+	protocol    ClientProtocol
+	authMethods []ClientAuthMethod
+	param       ClientParam
 }
 
 type ClientAuthHandlerFunc func(proto *ClientProtocol) error
 
+// ReplyError is returned when the request is rejected by server.
+type ReplyError struct {
+	Reply byte
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("bad reply from server: %#x", e.Reply)
+}
+
 // TODO: implement net.Conn
 type ClientTunnel struct {
 	io.ReadWriter
@@ -31,19 +55,36 @@ type ClientTunnel struct {
 	BindPort uint16
 }
 
-func NewClientWithParam(transport io.ReadWriter, authHandlers map[byte]ClientAuthHandlerFunc, param ClientParam) Client {
-	if len(authHandlers) == 0 {
-		authHandlers = map[byte]ClientAuthHandlerFunc{
-			MethodNone: ClientNoAuthHandler,
-		}
+// NewClientWithAuthMethods creates a client which offers methods in order of priority.
+func NewClientWithAuthMethods(transport io.ReadWriter, authMethods []ClientAuthMethod, param ClientParam) Client {
+	if len(authMethods) == 0 {
+		authMethods = []ClientAuthMethod{{Method: MethodNone, Handler: ClientNoAuthHandler}}
 	}
 	return Client{
-		protocol:     NewClientProtocol(transport),
-		authHandlers: authHandlers,
-		param:        param,
+		conn:        transport,
+		protocol:    NewClientProtocol(transport),
+		authMethods: SortClientAuthMethods(authMethods),
+		param:       param,
 	}
 }
 
+// NewClientWithParam creates a client which prefers methods with higher security level.
+func NewClientWithParam(transport io.ReadWriter, authHandlers map[byte]ClientAuthHandlerFunc, param ClientParam) Client {
+	authMethods := make([]ClientAuthMethod, 0, len(authHandlers))
+	for method, handler := range authHandlers {
+		authMethods = append(authMethods, ClientAuthMethod{
+			Method:   method,
+			Priority: MethodSecurity(method),
+			Handler:  handler,
+		})
+	}
+	// map iteration order is random
+	sort.Slice(authMethods, func(i, j int) bool {
+		return authMethods[i].Method < authMethods[j].Method
+	})
+	return NewClientWithAuthMethods(transport, authMethods, param)
+}
+
 func NewClient(transport io.ReadWriter, authHandlers map[byte]ClientAuthHandlerFunc) Client {
 	return NewClientWithParam(transport, authHandlers, ClientParam{})
 }
@@ -53,11 +94,28 @@ func ClientNoAuthHandler(proto *ClientProtocol) error {
 }
 
 func (c *Client) doAuth() (err error) {
+	if c.protocol.State == PSCAuthDone {
+		// parked by pool
+		return nil
+	}
+
 	// send auth methods
-	methods := make([]byte, 0, len(c.authHandlers))
-	var method byte
-	for method = range c.authHandlers {
-		methods = append(methods, method)
+	methods := make([]byte, 0, len(c.authMethods))
+	handlers := make(map[byte]ClientAuthHandlerFunc, len(c.authMethods))
+	for _, am := range c.authMethods {
+		if am.security() < c.param.MinSecurity {
+			continue
+		}
+		methods = append(methods, am.Method)
+		handlers[am.Method] = am.Handler
+	}
+
+	if len(methods) == 0 {
+		err = &AuthMethodError{
+			Reason: fmt.Sprintf("no method meets minimum security level %d", c.param.MinSecurity),
+			Chosen: MethodReject,
+		}
+		return
 	}
 
 	err = c.protocol.SendAuthMethods(methods)
@@ -66,25 +124,26 @@ func (c *Client) doAuth() (err error) {
 	}
 
 	// auth methods selected by server
-	method, err = c.protocol.ReceiveAuthMethod()
+	method, err := c.protocol.ReceiveAuthMethod()
 	if err != nil {
 		return
 	}
 
 	if method == MethodReject {
-		err = errors.Errorf("methods rejected by server: %v", methods)
+		err = &AuthMethodError{Reason: "methods rejected by server", Offered: methods, Chosen: method}
 		return
 	}
 
 	// handle auth
-	handler, ok := c.authHandlers[method]
+	handler, ok := handlers[method]
 	if !ok {
-		err = errors.Errorf("method not implemented by client: %#x", method)
+		err = &AuthMethodError{Reason: "server chose a method not offered", Offered: methods, Chosen: method}
 		return
 	}
 
 	err = handler(&c.protocol)
 	if err != nil {
+		err = errors.Wrapf(err, "auth method %#x failed", method)
 		return
 	}
 
@@ -93,6 +152,11 @@ func (c *Client) doAuth() (err error) {
 }
 
 func (c *Client) ConnectSockAddr(sockAddr SocksAddr, port uint16) (tunnel ClientTunnel, err error) {
+	sockAddr, err = c.param.resolveTarget(context.Background(), sockAddr)
+	if err != nil {
+		return
+	}
+
 	err = c.doAuth()
 	if err != nil {
 		return
@@ -110,26 +174,94 @@ func (c *Client) ConnectSockAddr(sockAddr SocksAddr, port uint16) (tunnel Client
 	}
 
 	if reply != ReplyOK {
-		err = errors.Errorf("bad reply from server: %#x", reply)
+		err = &ReplyError{reply}
 		return
 	}
 
-	tunnel.ReadWriter = c.protocol.GetConnection()
+	tunnel.ReadWriter, err = c.protocol.GetConnection()
+	return
+}
+
+// Bind issues BIND command, returns the address on which server listens for the peer.
+// The peer is expected to connect from addr:port.
+func (c *Client) Bind(addr SocksAddr, port uint16) (bindAddr SocksAddr, bindPort uint16, err error) {
+	err = c.doAuth()
+	if err != nil {
+		return
+	}
+
+	err = c.protocol.SendCommand(CmdBind, addr, port)
+	if err != nil {
+		return
+	}
+
+	var reply byte
+	reply, bindAddr, bindPort, err = c.protocol.ReceiveReply()
+	if err != nil {
+		return
+	}
+
+	if reply != ReplyOK {
+		err = &ReplyError{reply}
+	}
+	return
+}
+
+// AcceptBind waits for the peer of BIND command,
+// tunnel.BindAddr and tunnel.BindPort is the address of the peer.
+func (c *Client) AcceptBind() (tunnel ClientTunnel, err error) {
+	var reply byte
+	reply, tunnel.BindAddr, tunnel.BindPort, err = c.protocol.ReceiveBindReply()
+	if err != nil {
+		return
+	}
+
+	if reply != ReplyOK {
+		err = &ReplyError{reply}
+		return
+	}
+
+	tunnel.ReadWriter, err = c.protocol.GetConnection()
 	return
 }
 
 func (c *Client) Connect(host string, port uint16) (tunnel ClientTunnel, err error) {
-	// TODO: allow resolve host on local machine
 	return c.ConnectSockAddr(NewSocksAddrFromString(host), port)
 }
 
 func (c *Client) UDPAssociation() (tunnel ClientUDPTunnel, err error) {
+	if c.param.UDPOverTCP {
+		return c.UDPOverTCP()
+	}
+
 	err = c.doAuth()
 	if err != nil {
 		return
 	}
 
-	err = c.protocol.SendCommand(CmdUDP, NewSocksAddr(), 0)
+	// the port of udp socket tells server the source of datagrams,
+	// so associations sharing a server port can be told apart.
+	// over unix socket the server is on the same host, and the exact address is sent.
+	var localAddr *net.UDPAddr
+	if _, ok := c.conn.(*net.UnixConn); ok {
+		localAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	}
+	tunnel.conn, err = net.ListenUDP("udp", localAddr)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tunnel.conn.Close()
+			tunnel.conn = nil
+		}
+	}()
+
+	reqAddr := NewSocksAddr()
+	if localAddr != nil {
+		reqAddr = NewSocksAddrFromIPV4(localAddr.IP.To4())
+	}
+	err = c.protocol.SendCommand(CmdUDP, reqAddr, uint16(tunnel.conn.LocalAddr().(*net.UDPAddr).Port))
 	if err != nil {
 		return
 	}
@@ -141,7 +273,7 @@ func (c *Client) UDPAssociation() (tunnel ClientUDPTunnel, err error) {
 	}
 
 	if reply != ReplyOK {
-		err = errors.Errorf("bad reply from server: %#x", reply)
+		err = &ReplyError{reply}
 		return
 	}
 
@@ -152,21 +284,21 @@ func (c *Client) UDPAssociation() (tunnel ClientUDPTunnel, err error) {
 			RemoteAddr() net.Addr
 		}
 
-		if remoteTrans, ok := c.protocol.Transport.(HasRemoteAddr); ok {
+		if remoteTrans, ok := c.conn.(HasRemoteAddr); ok {
 			serverAddr := remoteTrans.RemoteAddr()
-			if tcpAddr, ok := serverAddr.(*net.TCPAddr); ok {
-				tunnel.server.IP = tcpAddr.IP
+			switch addr := serverAddr.(type) {
+			case *net.TCPAddr:
+				tunnel.server.IP = addr.IP
+			case *net.UnixAddr:
+				// server is on the same host
+				if tunnel.server.IP.IsUnspecified() {
+					tunnel.server.IP = net.IPv4(127, 0, 0, 1)
+				}
 			}
 		}
 	}
 	//log.Debugf("server udp addr: %v", tunnel.server)
 
-	// create udp sockets
-	tunnel.conn, err = net.ListenUDP("udp", nil)
-	if err != nil {
-		return
-	}
-
 	// monitor tcp connection
 	tunnel.ctrlChannel = make(chan error, 1)
 	go func() {
@@ -178,7 +310,7 @@ func (c *Client) UDPAssociation() (tunnel ClientUDPTunnel, err error) {
 		}
 
 		var remoteTCPAddr net.Addr
-		if remoteConn, ok := trans.(HasRemoteAddr); ok {
+		if remoteConn, ok := c.conn.(HasRemoteAddr); ok {
 			remoteTCPAddr = remoteConn.RemoteAddr()
 		}
 
@@ -206,6 +338,11 @@ type ClientUDPTunnel struct {
 	server      *net.UDPAddr
 	conn        *net.UDPConn
 	ctrlChannel chan error
+	ctrl        io.Closer // closed along with tunnel if not nil
+	// udp over tcp if not nil, conn is not used
+	stream *udpStream
+	// waits for datagrams on conn, created by waitRead
+	waiter udpBatchConn
 }
 
 func (ut *ClientUDPTunnel) checkCtrlChannel() (done bool, err error) {
@@ -219,6 +356,10 @@ func (ut *ClientUDPTunnel) checkCtrlChannel() (done bool, err error) {
 }
 
 func (ut *ClientUDPTunnel) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	if ut.stream != nil {
+		return ut.stream.readFrom(b)
+	}
+
 	var done bool
 	done, err = ut.checkCtrlChannel()
 	if done {
@@ -240,12 +381,27 @@ func (ut *ClientUDPTunnel) ReadFrom(b []byte) (n int, addr net.Addr, err error)
 		return
 	}
 
-	addr = &net.UDPAddr{IP: sockAddr.IP, Port: int(port)}
+	// copy ip before data overwrites it
+	addr = &net.UDPAddr{IP: append(net.IP(nil), sockAddr.IP...), Port: int(port)}
 	n = len(data)
 	copy(b, data)
 	return
 }
 
+// waitRead blocks until a datagram arrived, so the server relaying through the tunnel
+// holds no buffer while idle. Returns at once if not supported.
+func (ut *ClientUDPTunnel) waitRead() error {
+	if ut.stream != nil || ut.conn == nil {
+		return nil
+	}
+	if ut.waiter == nil {
+		if ut.waiter = newUDPBatchConn(ut.conn); ut.waiter == nil {
+			return nil
+		}
+	}
+	return ut.waiter.waitRead()
+}
+
 func (ut *ClientUDPTunnel) WriteTo(b []byte, addr net.Addr) (n int, err error) {
 	udpAddr, ok := addr.(*net.UDPAddr)
 	if !ok {
@@ -256,6 +412,10 @@ func (ut *ClientUDPTunnel) WriteTo(b []byte, addr net.Addr) (n int, err error) {
 }
 
 func (ut *ClientUDPTunnel) WriteToSocksAddr(b []byte, addr SocksAddr, port uint16) (n int, err error) {
+	if ut.stream != nil {
+		return ut.stream.writeTo(b, addr, port)
+	}
+
 	var done bool
 	done, err = ut.checkCtrlChannel()
 	if done {
@@ -263,29 +423,56 @@ func (ut *ClientUDPTunnel) WriteToSocksAddr(b []byte, addr SocksAddr, port uint1
 		return
 	}
 
-	msg := MakeUDPMsg(addr, port, b)
+	buf := getUDPBuf()
+	defer putUDPBuf(buf)
+	msg, err := AppendUDPMsg((*buf)[:0], addr, port, b)
+	if err != nil {
+		return
+	}
 	n, err = ut.conn.WriteTo(msg, ut.server)
 	headerLen := len(msg) - len(b)
 	n -= headerLen
 	return
 }
 
-func (ut *ClientUDPTunnel) Close() error {
-	return ut.conn.Close()
+func (ut *ClientUDPTunnel) Close() (err error) {
+	if ut.conn != nil {
+		err = ut.conn.Close()
+	}
+	if ut.ctrl != nil {
+		if ctrlErr := ut.ctrl.Close(); err == nil {
+			err = ctrlErr
+		}
+	}
+	return err
 }
 
+// LocalAddr returns the address of tcp connection for udp over tcp.
 func (ut *ClientUDPTunnel) LocalAddr() net.Addr {
+	if ut.stream != nil {
+		return ut.stream.localAddr()
+	}
 	return ut.conn.LocalAddr()
 }
 
+// deadlines of udp over tcp are set on the tcp connection
 func (ut *ClientUDPTunnel) SetDeadline(t time.Time) error {
+	if ut.stream != nil {
+		return ut.stream.setDeadline(t, net.Conn.SetDeadline)
+	}
 	return ut.conn.SetDeadline(t)
 }
 
 func (ut *ClientUDPTunnel) SetReadDeadline(t time.Time) error {
+	if ut.stream != nil {
+		return ut.stream.setDeadline(t, net.Conn.SetReadDeadline)
+	}
 	return ut.conn.SetReadDeadline(t)
 }
 
 func (ut *ClientUDPTunnel) SetWriteDeadline(t time.Time) error {
+	if ut.stream != nil {
+		return ut.stream.setDeadline(t, net.Conn.SetWriteDeadline)
+	}
 	return ut.conn.SetWriteDeadline(t)
 }
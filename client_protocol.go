@@ -1,15 +1,19 @@
 package socks_go
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/account-login/socks_go/util"
 	"github.com/pkg/errors"
 )
 
+// ClientState is the state of ClientProtocol.
+type ClientState int
+
 // client protocol state
 const (
-	PSCInit = iota
+	PSCInit ClientState = iota
 	PSCBad
 	PSCClose
 	PSCMethodsSent
@@ -18,25 +22,54 @@ const (
 	PSCReqConnectSent
 	PSCReplyConectGot
 	PSCCmdConnected
+	PSCBindWaiting
 )
 
+var clientStateNames = [...]string{
+	"PSCInit",
+	"PSCBad",
+	"PSCClose",
+	"PSCMethodsSent",
+	"PSCAuth",
+	"PSCAuthDone",
+	"PSCReqConnectSent",
+	"PSCReplyConectGot",
+	"PSCCmdConnected",
+	"PSCBindWaiting",
+}
+
+func (s ClientState) String() string {
+	if s >= 0 && int(s) < len(clientStateNames) {
+		return clientStateNames[s]
+	}
+	return fmt.Sprintf("ClientState(%d)", int(s))
+}
+
 type ClientProtocol struct {
 	Transport io.ReadWriter
-	State     int
+	State     ClientState
+	cmd       byte
+	// scratch space for encoding and decoding
+	buf [maxRequestLen]byte
 }
 
 func NewClientProtocol(transport io.ReadWriter) ClientProtocol {
-	return ClientProtocol{transport, PSCInit}
+	return ClientProtocol{Transport: transport, State: PSCInit}
 }
 
-func (proto *ClientProtocol) checkState(expect int) {
+// checkState returns StateError if the current state is not expect,
+// the state is not changed in that case.
+func (proto *ClientProtocol) checkState(op string, expect ClientState) error {
 	if proto.State != expect {
-		panic("bad state")
+		return &StateError{Op: op, State: proto.State, Expects: []fmt.Stringer{expect}}
 	}
+	return nil
 }
 
 func (proto *ClientProtocol) SendAuthMethods(methods []byte) (err error) {
-	proto.checkState(PSCInit)
+	if err = proto.checkState("SendAuthMethods", PSCInit); err != nil {
+		return
+	}
 	defer func() {
 		if err == nil {
 			proto.State = PSCMethodsSent
@@ -45,7 +78,7 @@ func (proto *ClientProtocol) SendAuthMethods(methods []byte) (err error) {
 		}
 	}()
 
-	data := make([]byte, 0, 2+len(methods))
+	data := proto.buf[:0]
 	data = append(data, 0x05)
 	data = append(data, byte(len(methods)))
 	data = append(data, methods...)
@@ -54,7 +87,9 @@ func (proto *ClientProtocol) SendAuthMethods(methods []byte) (err error) {
 }
 
 func (proto *ClientProtocol) ReceiveAuthMethod() (method byte, err error) {
-	proto.checkState(PSCMethodsSent)
+	if err = proto.checkState("ReceiveAuthMethod", PSCMethodsSent); err != nil {
+		return
+	}
 	defer func() {
 		if err == nil {
 			if method == MethodReject {
@@ -68,7 +103,7 @@ func (proto *ClientProtocol) ReceiveAuthMethod() (method byte, err error) {
 	}()
 
 	var buf []byte
-	buf, err = util.ReadRequired(proto.Transport, 2)
+	buf, err = util.ReadRequiredBuf(proto.Transport, proto.buf[:], 2)
 	if err != nil {
 		err = errors.Wrap(err, "ReceiveAuthMethod: can not read data")
 		return
@@ -84,27 +119,122 @@ func (proto *ClientProtocol) ReceiveAuthMethod() (method byte, err error) {
 	return
 }
 
-func (proto *ClientProtocol) AuthDone() error {
-	proto.checkState(PSCAuth)
+// SetTransport replaces the transport during auth sub-negotiation,
+// see ServerProtocol.SetTransport.
+func (proto *ClientProtocol) SetTransport(transport io.ReadWriter) (err error) {
+	if err = proto.checkState("SetTransport", PSCAuth); err != nil {
+		return
+	}
+	proto.Transport = transport
+	return
+}
+
+// SendUserPass sends the username/password request of RFC 1929.
+func (proto *ClientProtocol) SendUserPass(user string, password string) (err error) {
+	if err = proto.checkState("SendUserPass", PSCAuth); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			proto.State = PSCBad
+		}
+	}()
+
+	if len(user) > 255 || len(password) > 255 {
+		err = errors.Errorf("SendUserPass: username or password too long")
+		return
+	}
+
+	data := proto.buf[:0]
+	data = append(data, userPassVersion, byte(len(user)))
+	data = append(data, user...)
+	data = append(data, byte(len(password)))
+	data = append(data, password...)
+	_, err = proto.Transport.Write(data)
+	return
+}
+
+// ReceiveUserPassStatus reads the status of RFC 1929 sub-negotiation.
+func (proto *ClientProtocol) ReceiveUserPassStatus() (success bool, err error) {
+	if err = proto.checkState("ReceiveUserPassStatus", PSCAuth); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			proto.State = PSCBad
+		} else if !success {
+			proto.State = PSCClose
+		}
+	}()
+
+	var buf []byte
+	buf, err = util.ReadRequiredBuf(proto.Transport, proto.buf[:], 2)
+	if err != nil {
+		err = errors.Wrap(err, "ReceiveUserPassStatus: can not read data")
+		return
+	}
+
+	ver := buf[0]
+	if ver != userPassVersion {
+		err = errors.Errorf("ReceiveUserPassStatus: bad version: %#x", ver)
+		return
+	}
+
+	success = buf[1] == 0
+	return
+}
+
+func (proto *ClientProtocol) AuthDone() (err error) {
+	if err = proto.checkState("AuthDone", PSCAuth); err != nil {
+		return
+	}
 	proto.State = PSCAuthDone
-	return nil
+	return
 }
 
 func (proto *ClientProtocol) SendCommand(cmd byte, addr SocksAddr, port uint16) (err error) {
-	proto.checkState(PSCAuthDone)
+	if err = proto.checkState("SendCommand", PSCAuthDone); err != nil {
+		return
+	}
 	defer func() {
 		if err == nil {
 			proto.State = PSCReqConnectSent
+			proto.cmd = cmd
 		} else {
 			proto.State = PSCBad
 		}
 	}()
 
-	return writeResponseOrRequest(proto.Transport, cmd, addr, port)
+	return writeResponseOrRequest(proto.Transport, proto.buf[:], cmd, addr, port)
 }
 
 func (proto *ClientProtocol) ReceiveReply() (reply byte, addr SocksAddr, port uint16, err error) {
-	proto.checkState(PSCReqConnectSent)
+	if err = proto.checkState("ReceiveReply", PSCReqConnectSent); err != nil {
+		return
+	}
+	defer func() {
+		if err == nil {
+			if reply != ReplyOK || proto.cmd == CmdResolve || proto.cmd == CmdResolvePTR {
+				proto.State = PSCClose
+			} else if proto.cmd == CmdBind {
+				proto.State = PSCBindWaiting
+			} else {
+				proto.State = PSCReplyConectGot
+			}
+		} else {
+			proto.State = PSCBad
+		}
+	}()
+
+	return readRequestOrReply(proto.Transport, proto.buf[:])
+}
+
+// ReceiveBindReply reads the second reply of BIND command,
+// which carries the address of the connecting host.
+func (proto *ClientProtocol) ReceiveBindReply() (reply byte, addr SocksAddr, port uint16, err error) {
+	if err = proto.checkState("ReceiveBindReply", PSCBindWaiting); err != nil {
+		return
+	}
 	defer func() {
 		if err == nil {
 			if reply == ReplyOK {
@@ -117,11 +247,13 @@ func (proto *ClientProtocol) ReceiveReply() (reply byte, addr SocksAddr, port ui
 		}
 	}()
 
-	return readRequestOrReply(proto.Transport)
+	return readRequestOrReply(proto.Transport, proto.buf[:])
 }
 
-func (proto *ClientProtocol) GetConnection() (trans io.ReadWriter) {
-	proto.checkState(PSCReplyConectGot)
+func (proto *ClientProtocol) GetConnection() (trans io.ReadWriter, err error) {
+	if err = proto.checkState("GetConnection", PSCReplyConectGot); err != nil {
+		return
+	}
 	proto.State = PSCCmdConnected
-	return proto.Transport
+	return proto.Transport, nil
 }
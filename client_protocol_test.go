@@ -35,7 +35,9 @@ func TestClientProtocol_Conversation(t *testing.T) {
 	tr.output = []byte{}
 
 	tr.Send([]byte{0x05, ReplyOK, 0})
-	tr.Send(sendaddr.ToBytes())
+	addrBytes, err := sendaddr.ToBytes()
+	require.NoError(t, err)
+	tr.Send(addrBytes)
 	tr.Send([]byte{0x23, 0x45})
 	reply, addr, port, err := proto.ReceiveReply()
 	require.NoError(t, err)
@@ -44,11 +46,84 @@ func TestClientProtocol_Conversation(t *testing.T) {
 	assert.Equal(t, uint16(0x2345), port)
 
 	// tunnel
-	tunnel := proto.GetConnection()
+	tunnel, err := proto.GetConnection()
+	require.NoError(t, err)
 	tr.Send([]byte{1, 2, 3})
 	buf, err = util.ReadRequired(tunnel, 3)
 	require.NoError(t, err)
 	assert.Equal(t, []byte{1, 2, 3}, buf)
 }
 
+func TestClientProtocol_Bind(t *testing.T) {
+	tr := newFakeTransport()
+	proto := NewClientProtocol(&tr)
+
+	require.NoError(t, proto.SendAuthMethods([]byte{MethodNone}))
+	tr.Send([]byte{0x05, MethodNone})
+	_, err := proto.ReceiveAuthMethod()
+	require.NoError(t, err)
+	require.NoError(t, proto.AuthDone())
+
+	err = proto.SendCommand(CmdBind, NewSocksAddrFromIPV4(net.IP{1, 2, 3, 4}), uint16(0x1234))
+	require.NoError(t, err)
+
+	// first reply
+	tr.Send([]byte{0x05, ReplyOK, 0, 0x01, 2, 3, 4, 5, 0x23, 0x45})
+	reply, addr, port, err := proto.ReceiveReply()
+	require.NoError(t, err)
+	assert.Equal(t, ReplyOK, reply)
+	assert.Equal(t, "2.3.4.5", addr.String())
+	assert.Equal(t, uint16(0x2345), port)
+	assert.Equal(t, PSCBindWaiting, proto.State)
+
+	// second reply
+	tr.Send([]byte{0x05, ReplyOK, 0, 0x01, 1, 2, 3, 4, 0x56, 0x78})
+	reply, addr, port, err = proto.ReceiveBindReply()
+	require.NoError(t, err)
+	assert.Equal(t, ReplyOK, reply)
+	assert.Equal(t, "1.2.3.4", addr.String())
+	assert.Equal(t, uint16(0x5678), port)
+
+	_, err = proto.GetConnection()
+	require.NoError(t, err)
+	assert.Equal(t, PSCCmdConnected, proto.State)
+}
+
+func TestClientProtocol_Resolve(t *testing.T) {
+	tr := newFakeTransport()
+	proto := NewClientProtocol(&tr)
+
+	require.NoError(t, proto.SendAuthMethods([]byte{MethodNone}))
+	tr.Send([]byte{0x05, MethodNone})
+	_, err := proto.ReceiveAuthMethod()
+	require.NoError(t, err)
+	require.NoError(t, proto.AuthDone())
+
+	err = proto.SendCommand(CmdResolve, NewSocksAddrFromString("a.com"), 0)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x05, CmdResolve, 0, 0x03, 5, 'a', '.', 'c', 'o', 'm', 0, 0}, tr.output[len(tr.output)-12:])
+
+	tr.Send([]byte{0x05, ReplyOK, 0, 0x01, 2, 3, 4, 5, 0, 0})
+	reply, addr, _, err := proto.ReceiveReply()
+	require.NoError(t, err)
+	assert.Equal(t, ReplyOK, reply)
+	assert.Equal(t, "2.3.4.5", addr.String())
+	// nothing follows the reply
+	assert.Equal(t, PSCClose, proto.State)
+}
+
 // TODO: test excaptional case
+
+func TestClientProtocol_BadState(t *testing.T) {
+	tr := newFakeTransport()
+	proto := NewClientProtocol(&tr)
+
+	err := proto.SendCommand(CmdConnect, NewSocksAddrFromIPV4(net.IP{1, 2, 3, 4}), 80)
+	assert.IsType(t, &StateError{}, err)
+	assert.Equal(t, PSCInit, proto.State)
+	assert.Empty(t, tr.output)
+
+	_, err = proto.GetConnection()
+	assert.Equal(t, "GetConnection: bad state PSCInit, expect PSCReplyConectGot", err.Error())
+	assert.Equal(t, "ClientState(100)", ClientState(100).String())
+}
@@ -0,0 +1,98 @@
+package socks_go
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_doAuth_Order(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		tr := newFakeTransport()
+		client := NewClient(&tr, map[byte]ClientAuthHandlerFunc{
+			MethodNone:         ClientNoAuthHandler,
+			MethodUserName:     ClientUserPassAuth("u", "p"),
+			MethodPrivateBegin: ClientNoAuthHandler,
+			MethodGSSApi:       ClientNoAuthHandler,
+		})
+
+		tr.Send([]byte{0x05, MethodNone})
+		require.NoError(t, client.doAuth())
+		assert.Equal(t,
+			[]byte{0x05, 4, MethodGSSApi, MethodUserName, MethodPrivateBegin, MethodNone},
+			tr.output)
+	}
+}
+
+func TestClient_doAuth_Priority(t *testing.T) {
+	tr := newFakeTransport()
+	client := NewClientWithAuthMethods(&tr, []ClientAuthMethod{
+		{Method: MethodNone, Handler: ClientNoAuthHandler},
+		{Method: MethodUserName, Priority: 1, Handler: ClientUserPassAuth("u", "p")},
+		{Method: MethodPrivateBegin, Handler: ClientNoAuthHandler},
+	}, ClientParam{})
+
+	tr.Send([]byte{0x05, MethodNone})
+	require.NoError(t, client.doAuth())
+	assert.Equal(t, []byte{0x05, 3, MethodUserName, MethodNone, MethodPrivateBegin}, tr.output)
+}
+
+func TestClient_doAuth_MinSecurity(t *testing.T) {
+	tr := newFakeTransport()
+	client := NewClientWithAuthMethods(&tr, []ClientAuthMethod{
+		{Method: MethodNone, Handler: ClientNoAuthHandler},
+		{Method: MethodUserName, Handler: ClientUserPassAuth("u", "p")},
+	}, ClientParam{MinSecurity: SecurityPassword})
+
+	// server chooses a method not offered
+	tr.Send([]byte{0x05, MethodNone})
+	err := client.doAuth()
+	require.Error(t, err)
+	assert.Equal(t, []byte{0x05, 1, MethodUserName}, tr.output)
+
+	authErr, ok := err.(*AuthMethodError)
+	require.True(t, ok)
+	assert.Equal(t, []byte{MethodUserName}, authErr.Offered)
+	assert.Equal(t, MethodNone, authErr.Chosen)
+
+	// nothing to offer
+	tr = newFakeTransport()
+	client = NewClientWithAuthMethods(&tr, nil, ClientParam{MinSecurity: SecurityPassword})
+	err = client.doAuth()
+	require.Error(t, err)
+	assert.Empty(t, tr.output)
+
+	// explicitly no security, not the default of the method
+	tr = newFakeTransport()
+	client = NewClientWithAuthMethods(&tr, []ClientAuthMethod{
+		{Method: MethodUserName, Security: SecurityNone, Handler: ClientUserPassAuth("u", "p")},
+	}, ClientParam{MinSecurity: SecurityPassword})
+	err = client.doAuth()
+	require.Error(t, err)
+	assert.Empty(t, tr.output)
+}
+
+func TestClient_doAuth_Rejected(t *testing.T) {
+	tr := newFakeTransport()
+	client := NewClient(&tr, nil)
+
+	tr.Send([]byte{0x05, MethodReject})
+	err := client.doAuth()
+	require.Error(t, err)
+	assert.Equal(t, "methods rejected by server. offered: [0], chosen: 0xff", err.Error())
+}
+
+func TestDialer_TLSServerName(t *testing.T) {
+	config := &tls.Config{}
+	dialer := &Dialer{ProxyAddr: "proxy.example.com:1080", TLSConfig: config}
+	assert.Equal(t, "proxy.example.com", dialer.tlsConfig().ServerName)
+	assert.Equal(t, "", config.ServerName)
+
+	dialer.ProxyAddr = "[::1]:1080"
+	assert.Equal(t, "::1", dialer.tlsConfig().ServerName)
+
+	config.ServerName = "other.example.com"
+	assert.Equal(t, config, dialer.tlsConfig())
+}
@@ -1,31 +1,77 @@
 package cmd
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"strings"
 
+	"github.com/account-login/socks_go"
 	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
 )
 
 func ConfigLogging() {
-	logger, err := log.LoggerFromConfigAsString(`
-<seelog>
+	err := ConfigLoggingWith("", "")
+	if err != nil {
+		log.Errorf("%v", err)
+	}
+}
+
+// ConfigLoggingStderr logs to stderr, for tools carrying data on stdout.
+func ConfigLoggingStderr() {
+	logger, err := log.LoggerFromWriterWithMinLevelAndFormat(
+		os.Stderr, log.TraceLvl, "%Date(2006-01-02 15:04:05.000) [%LEVEL]%t%Msg%n")
+	if err == nil {
+		err = log.ReplaceLogger(logger)
+	}
+	if err != nil {
+		log.Errorf("%v", err)
+	}
+}
+
+// ConfigLoggingWith logs to console, or to file if not empty.
+// Messages below level are dropped, empty level means all.
+func ConfigLoggingWith(level string, file string) error {
+	minLevel := ""
+	if level != "" {
+		if _, ok := log.LogLevelFromString(level); !ok {
+			return errors.Errorf("bad log level: %q", level)
+		}
+		minLevel = fmt.Sprintf(` minlevel="%s"`, level)
+	}
+
+	output := "<console />"
+	if file != "" {
+		escaped := bytes.Buffer{}
+		_ = xml.EscapeText(&escaped, []byte(file))
+		output = fmt.Sprintf(`<file path="%s" />`, escaped.String())
+	}
+
+	logger, err := log.LoggerFromConfigAsString(fmt.Sprintf(`
+<seelog%s>
 	<outputs formatid="common">
-		<console />
+		%s
 	</outputs>
     <formats>
-        <format id="common" format="%Date(2006-01-02 15:04:05.000) [%LEVEL]%t%Msg%n"/>
+        <format id="common" format="%%Date(2006-01-02 15:04:05.000) [%%LEVEL]%%t%%Msg%%n"/>
     </formats>
-</seelog>`)
+</seelog>`, minLevel, output))
 	if err != nil {
-		log.Errorf("log.LoggerFromConfigAsString() failed: %v", err)
-		return
+		return errors.Wrap(err, "log.LoggerFromConfigAsString() failed")
 	}
 
 	err = log.ReplaceLogger(logger)
 	if err != nil {
-		log.Errorf("log.ReplaceLogger() failed: %v", err)
+		return errors.Wrap(err, "log.ReplaceLogger() failed")
 	}
+	return nil
 }
 
 func StartDebugServer(addr string) {
@@ -38,3 +84,71 @@ func StartDebugServer(addr string) {
 		}
 	}()
 }
+
+// SplitNetworkAddr splits "unix:/path/to/sock" or "unix:@abstract" into network and address,
+// others are tcp addresses.
+func SplitNetworkAddr(addr string) (network string, address string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", addr[len("unix:"):]
+	}
+	return "tcp", addr
+}
+
+// ClientAuthMethods offers username/password auth if user is not empty.
+func ClientAuthMethods(user string, password string) []socks_go.ClientAuthMethod {
+	if user == "" {
+		return nil
+	}
+	return []socks_go.ClientAuthMethod{{
+		Method:  socks_go.MethodUserName,
+		Handler: socks_go.ClientUserPassAuth(user, password),
+	}}
+}
+
+// ParseDialMode parses "dual", "prefer-ipv4", "ipv4" or "ipv6", empty means "dual".
+func ParseDialMode(s string) (socks_go.DialMode, error) {
+	switch s {
+	case "", "dual":
+		return socks_go.DialDualStack, nil
+	case "prefer-ipv4":
+		return socks_go.DialPreferIPv4, nil
+	case "ipv4":
+		return socks_go.DialIPv4Only, nil
+	case "ipv6":
+		return socks_go.DialIPv6Only, nil
+	default:
+		return 0, errors.Errorf("bad dial mode %q", s)
+	}
+}
+
+// ParseResolveMode parses "remote" or "local", empty means "remote".
+func ParseResolveMode(s string) (socks_go.ResolveMode, error) {
+	switch s {
+	case "", "remote":
+		return socks_go.ResolveRemote, nil
+	case "local":
+		return socks_go.ResolveLocal, nil
+	default:
+		return 0, errors.Errorf("bad resolve mode %q", s)
+	}
+}
+
+// MakeTLSConfig makes client TLS config for connecting to proxy server.
+func MakeTLSConfig(caFile string, serverName string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecure,
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can not read CA file %q", caFile)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate found in %q", caFile)
+		}
+	}
+	return config, nil
+}
@@ -14,6 +14,7 @@ import (
 
 	"math"
 
+	"strconv"
 	"strings"
 
 	"github.com/account-login/socks_go"
@@ -31,6 +32,8 @@ type taskSession struct {
 	iofunc    func(io.ReadWriter) error
 	udp       bool
 	localAddr *net.TCPAddr
+	// udp packets sent and received by script
+	packets int
 	// timestamp in nano seconds
 	reqTime     time.Time
 	connectTime time.Time
@@ -40,8 +43,8 @@ type taskSession struct {
 }
 
 type proxyParam struct {
-	addr    string
-	timeout time.Duration
+	balancer *socks_go.Balancer
+	timeout  time.Duration
 }
 
 // implement io.ReadWriter
@@ -116,27 +119,37 @@ func doWork(proxy proxyParam, task *taskSession, wg *sync.WaitGroup) {
 
 	task.reqTime = time.Now()
 
-	// connnect to proxy
-	// TODO: move timeout control to Client
-	deadline := time.Now().Add(proxy.timeout)
-	conn, task.err = (&net.Dialer{
-		Timeout:   proxy.timeout,
-		LocalAddr: task.localAddr,
-	}).Dial("tcp", proxy.addr)
-	if task.err != nil {
-		return
-	}
+	// proxies failing to connect or auth are failed over
+	conn, task.err = proxy.balancer.DialFunc(func(d *socks_go.Dialer) (proxyConn net.Conn, err error) {
+		// connnect to proxy
+		// TODO: move timeout control to Client
+		deadline := time.Now().Add(proxy.timeout)
+		proxyConn, err = (&net.Dialer{
+			Timeout:   proxy.timeout,
+			LocalAddr: task.localAddr,
+		}).Dial("tcp", d.ProxyAddr)
+		if err != nil {
+			err = &socks_go.ProxyError{Err: err}
+			return
+		}
 
-	addr, _ = conn.LocalAddr().(*net.TCPAddr) // for logging
+		addr, _ = proxyConn.LocalAddr().(*net.TCPAddr) // for logging
 
-	// create tunnel
-	timeout := deadline.Sub(time.Now())
-	select {
-	case tunnel = <-createTunnel(conn, task):
-	case <-time.After(timeout):
-		task.err = errors.Errorf("createTunnel() timeout")
-	}
+		// create tunnel
+		timeout := deadline.Sub(time.Now())
+		select {
+		case tunnel = <-createTunnel(proxyConn, task):
+			err = task.err
+		case <-time.After(timeout):
+			err = errors.Errorf("createTunnel() timeout")
+		}
 
+		if err != nil {
+			proxyConn.Close()
+			proxyConn = nil
+		}
+		return
+	})
 	if task.err != nil {
 		return
 	}
@@ -174,12 +187,14 @@ func printStats(results []*taskSession) {
 	var startTime = time.Unix(math.MaxInt32, 0) // maximum time
 	var stopTime = time.Unix(0, 0)
 	success := 0
+	packets := 0
 	connectTimes := make([]float64, 0, len(results))
 	processTimes := make([]float64, 0, len(results))
 
 	for _, r := range results {
 		if r.err == nil {
 			success++
+			packets += r.packets
 		} else {
 			continue
 		}
@@ -199,6 +214,10 @@ func printStats(results []*taskSession) {
 
 	rps := float64(len(results)) / stopTime.Sub(startTime).Seconds()
 	log.Infof("[duration:%f][reqs:%d][rps:%.1f]", stopTime.Sub(startTime).Seconds(), len(results), rps)
+	if packets > 0 {
+		pps := float64(packets) / stopTime.Sub(startTime).Seconds()
+		log.Infof("[packets:%d][pps:%.1f]", packets, pps)
+	}
 
 	distPos := []float64{0, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 0.95, 0.99, 1}
 	connectDist := nthValue(connectTimes, distPos)
@@ -262,6 +281,13 @@ func makeSessions(
 	udp bool,
 	size int) (works []*taskSession) {
 
+	packets := 0
+	if udp {
+		for _, act := range script {
+			packets += act.Read + act.Write
+		}
+	}
+
 	for i := 0; i < n; i++ {
 		iofunc := func(transport io.ReadWriter) (err error) {
 			//log.Debugf("iofunc begin: %d", i)
@@ -281,19 +307,51 @@ func makeSessions(
 		}
 		works = append(works, &taskSession{
 			host: pair.host, port: pair.port, localAddr: addr,
-			iofunc: iofunc, udp: udp,
+			iofunc: iofunc, udp: udp, packets: packets,
 		})
 	}
 	return
 }
 
+// makeBalancer parses proxies like "10.0.0.1:1080*2,10.0.0.2:1080".
+func makeBalancer(proxies string, policy string) (*socks_go.Balancer, error) {
+	balancer := &socks_go.Balancer{}
+	switch policy {
+	case "round-robin":
+		balancer.Policy = socks_go.BalanceRoundRobin
+	case "least-conns":
+		balancer.Policy = socks_go.BalanceLeastConns
+	case "latency":
+		balancer.Policy = socks_go.BalanceLatency
+	default:
+		return nil, errors.Errorf("bad balance policy %q", policy)
+	}
+
+	for _, piece := range strings.Split(proxies, ",") {
+		addr, weight := piece, 1
+		if idx := strings.LastIndexByte(piece, '*'); idx >= 0 {
+			var err error
+			if weight, err = strconv.Atoi(piece[idx+1:]); err != nil || weight <= 0 {
+				return nil, errors.Errorf("bad weight of proxy %q", piece)
+			}
+			addr = piece[:idx]
+		}
+		balancer.Proxies = append(balancer.Proxies, socks_go.BalancerProxy{
+			Dialer: &socks_go.Dialer{ProxyAddr: addr},
+			Weight: weight,
+		})
+	}
+	return balancer, nil
+}
+
 func realMain() int {
 	// logging
 	defer log.Flush()
 	cmd.ConfigLogging()
 
 	// cli args
-	proxyArg := flag.String("proxy", "127.0.0.1:1080", "socks5 proxy server")
+	proxyArg := flag.String("proxy", "127.0.0.1:1080", "socks5 proxy servers seperated by comma, host:port or host:port*weight")
+	balanceArg := flag.String("balance", "round-robin", `policy of choosing proxy server, "round-robin", "least-conns" or "latency"`)
 	timeoutArg := flag.Int("timeout", 5000, "timeout in ms for tunnel creation")
 	junkArg := flag.String("junk", "127.0.0.1:2080", "junk servers seperated by comma")
 	localArg := flag.String("local", "", "local source addresses seperated by comma")
@@ -305,8 +363,20 @@ func realMain() int {
 	scriptArg := flag.String("script", "", `scripts to run
 		In TCP mode, the unit is bytes. In UDP mode, the unit is the number of packets`)
 	debugArg := flag.String("debug", "127.0.0.1:6060", "http debug server")
+	scenarioArg := flag.String("scenario", "",
+		"preset of -udp, -script, -size, -reqs and -worker, flags given explicitly take precedence. one of: "+
+			scenarioNames())
 	flag.Parse()
 
+	if *scenarioArg != "" {
+		sc, ok := scenarios[*scenarioArg]
+		if !ok {
+			log.Errorf("unknown scenario %q", *scenarioArg)
+			return 2
+		}
+		applyScenario(sc)
+	}
+
 	junkServers := make([]hostPortPair, 0)
 	for _, junkSv := range strings.Split(*junkArg, ",") {
 		host, port, err := util.SplitHostPort(junkSv)
@@ -333,6 +403,12 @@ func realMain() int {
 		}
 	}
 
+	balancer, err := makeBalancer(*proxyArg, *balanceArg)
+	if err != nil {
+		log.Errorf("%v", err)
+		return 2
+	}
+
 	script, err := junkchat.ParseScript(*scriptArg)
 	if err != nil {
 		log.Errorf("parse script error: %v", err)
@@ -345,7 +421,7 @@ func realMain() int {
 	// run benchmark
 	works := makeSessions(*reqsArg, script, junkServers, localAddrs, *udpArg, *sizeArg)
 	run(
-		proxyParam{*proxyArg, time.Duration(*timeoutArg) * time.Millisecond},
+		proxyParam{balancer, time.Duration(*timeoutArg) * time.Millisecond},
 		*connectRateArg,
 		*workerArg, works,
 	)
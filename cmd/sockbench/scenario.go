@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// scenario is a preset of flags for udp benchmark
+type scenario struct {
+	script string
+	// bytes per packet
+	size int
+	reqs int
+	// concurrent associations
+	worker int
+}
+
+var scenarios = map[string]scenario{
+	// many associations exchanging small packets at 30 pps
+	"udp-game": {script: "w60,r60,t2s,d10s", size: 64, reqs: 4096, worker: 2048},
+	// voice frames every 20ms
+	"udp-voip": {script: "w250,r250,t5s,d15s", size: 172, reqs: 2048, worker: 1024},
+	// few associations with high packet rate
+	"udp-bulk": {script: "w2000,r2000,t2s,d15s", size: 1200, reqs: 64, worker: 64},
+}
+
+func scenarioNames() string {
+	names := make([]string, 0, len(scenarios))
+	for name := range scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// applyScenario sets the flags not given on command line.
+func applyScenario(sc scenario) {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	values := map[string]string{
+		"udp":    "true",
+		"script": sc.script,
+		"size":   strconv.Itoa(sc.size),
+		"reqs":   strconv.Itoa(sc.reqs),
+		"worker": strconv.Itoa(sc.worker),
+	}
+	for name, value := range values {
+		if !explicit[name] {
+			flag.Set(name, value)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/account-login/socks_go"
+	"github.com/account-login/socks_go/util"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// forwardSpec is a local port forwarding like ssh -L
+type forwardSpec struct {
+	bind string
+	host string
+	port uint16
+}
+
+func (spec forwardSpec) String() string {
+	return spec.bind + "->" + net.JoinHostPort(spec.host, strconv.Itoa(int(spec.port)))
+}
+
+// implements flag.Value
+type forwardList []forwardSpec
+
+func (l *forwardList) String() string {
+	pieces := make([]string, 0, len(*l))
+	for _, spec := range *l {
+		pieces = append(pieces, spec.String())
+	}
+	return strings.Join(pieces, ",")
+}
+
+func (l *forwardList) Set(value string) error {
+	spec, err := parseForward(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, spec)
+	return nil
+}
+
+// splitForward splits on colons outside of brackets
+func splitForward(input string) (fields []string, err error) {
+	depth := 0
+	start := 0
+	for i, c := range input {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				fields = append(fields, input[start:i])
+				start = i + 1
+			}
+		}
+		if depth < 0 || depth > 1 {
+			return nil, errors.Errorf("unbalanced brackets in %q", input)
+		}
+	}
+	if depth != 0 {
+		return nil, errors.Errorf("unbalanced brackets in %q", input)
+	}
+	fields = append(fields, input[start:])
+	return
+}
+
+// parseForward parses [bind_address:]port:host:hostport,
+// binds on loopback if bind_address is omitted, "*" for all interfaces.
+func parseForward(input string) (spec forwardSpec, err error) {
+	fields, err := splitForward(input)
+	if err != nil {
+		return
+	}
+
+	bindHost := "127.0.0.1"
+	switch len(fields) {
+	case 3:
+	case 4:
+		bindHost = strings.Trim(fields[0], "[]")
+		if bindHost == "*" {
+			bindHost = ""
+		}
+		fields = fields[1:]
+	default:
+		err = errors.Errorf("bad forwarding %q, expect [bind_address:]port:host:hostport", input)
+		return
+	}
+
+	if _, err = strconv.ParseUint(fields[0], 10, 16); err != nil {
+		err = errors.Wrapf(err, "bad listen port in %q", input)
+		return
+	}
+	spec.bind = net.JoinHostPort(bindHost, fields[0])
+
+	spec.host = strings.Trim(fields[1], "[]")
+	if spec.host == "" {
+		err = errors.Errorf("empty host in %q", input)
+		return
+	}
+
+	port, err := strconv.ParseUint(fields[2], 10, 16)
+	if err != nil {
+		err = errors.Wrapf(err, "bad host port in %q", input)
+		return
+	}
+	spec.port = uint16(port)
+	return
+}
+
+func runForward(dialer *socks_go.Dialer, spec forwardSpec) error {
+	listener, err := net.Listen("tcp", spec.bind)
+	if err != nil {
+		return errors.Wrapf(err, "runForward: listen(%q) error", spec.bind)
+	}
+	defer listener.Close()
+	log.Infof("forwarding %v", spec)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Errorf("Accept failed: %v", err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return errors.Wrapf(err, "runForward: accept error on %v", spec.bind)
+		}
+
+		go handleForward(dialer, spec, conn)
+	}
+}
+
+// handleForward connects to proxy server for every connection
+func handleForward(dialer *socks_go.Dialer, spec forwardSpec, conn net.Conn) {
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("client: %v, forward: %v, err: %v", conn.RemoteAddr(), spec, err)
+		}
+		conn.Close()
+		log.Debugf("client: %v, gone", conn.RemoteAddr())
+	}()
+
+	tunnel, err := dialer.DialSocksAddr(socks_go.NewSocksAddrFromString(spec.host), spec.port)
+	if err != nil {
+		return
+	}
+	defer tunnel.Close()
+	log.Debugf("client: %v, connected to %v", conn.RemoteAddr(), spec)
+
+	l2r := util.BridgeReaderWriter(conn, tunnel)
+	r2l := util.BridgeReaderWriter(tunnel, conn)
+
+	merr := util.NewMultipleErrors()
+	select {
+	case rerr := <-l2r:
+		merr.Add("ReadLocal", rerr)
+		merr.Add("WriteRemote", <-l2r)
+	case rerr := <-r2l:
+		merr.Add("ReadRemote", rerr)
+		merr.Add("WriteLocal", <-r2l)
+	}
+	err = merr.ToError()
+}
+
+// runForwards runs until one of the forwardings failed
+func runForwards(dialer *socks_go.Dialer, specs []forwardSpec, udpSpecs []forwardSpec, udpIdle time.Duration) error {
+	errChan := make(chan error, len(specs)+len(udpSpecs))
+	for _, spec := range specs {
+		go func(spec forwardSpec) {
+			errChan <- runForward(dialer, spec)
+		}(spec)
+	}
+	for _, spec := range udpSpecs {
+		go func(spec forwardSpec) {
+			errChan <- runUDPForward(dialer, spec, udpIdle)
+		}(spec)
+	}
+	return <-errChan
+}
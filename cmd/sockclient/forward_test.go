@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForward(t *testing.T) {
+	spec, err := parseForward("5432:db.internal:5432")
+	require.NoError(t, err)
+	assert.Equal(t, forwardSpec{"127.0.0.1:5432", "db.internal", 5432}, spec)
+
+	spec, err = parseForward("*:8080:10.0.0.1:80")
+	require.NoError(t, err)
+	assert.Equal(t, forwardSpec{":8080", "10.0.0.1", 80}, spec)
+
+	spec, err = parseForward("[::1]:8080:[2001:db8::1]:80")
+	require.NoError(t, err)
+	assert.Equal(t, forwardSpec{"[::1]:8080", "2001:db8::1", 80}, spec)
+
+	for _, bad := range []string{"8080", "8080:host", "x:host:80", "80:host:99999", "80::80", "[::1:80:h:80"} {
+		_, err = parseForward(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"net"
 	"os"
 
+	"io"
 	"io/ioutil"
+	"time"
 
 	"github.com/account-login/socks_go"
 	"github.com/account-login/socks_go/cmd"
@@ -14,24 +16,85 @@ import (
 )
 
 func realMain() int {
-	// logging
+	// logging, stdout carries data or results
 	defer log.Flush()
-	cmd.ConfigLogging()
+	cmd.ConfigLoggingStderr()
 
 	// parse args
-	proxyArg := flag.String("proxy", "127.0.0.1:1080", "socks5 proxy server")
+	proxyArg := flag.String("proxy", "127.0.0.1:1080", "socks5 proxy server, host:port or unix:/path/to/sock")
+	userArg := flag.String("user", "", "username for proxy server")
+	passwordArg := flag.String("password", "", "password for proxy server")
+	timeoutArg := flag.Int("timeout", 5000, "timeout in ms for connecting to proxy server")
 	udpArg := flag.Bool("udp", false, "UDP mode")
+	udpDelimArg := flag.String("udp-delim", "", `packet delimiter on stdin in UDP mode, "line" or "length" (2 bytes big endian prefix).
+		Receive continuously and print every packet as source address, tab and payload if specified,
+		payloads are length prefixed with "length", "\", CR and LF of raw payloads are escaped with "line".
+		Otherwise send stdin as one packet and wait for one reply`)
+	udpEncodingArg := flag.String("udp-encoding", "raw", `payload encoding on stdin and stdout with -udp-delim, "raw", "hex" or "base64"`)
+	udpOverTCPArg := flag.Bool("udp-over-tcp", false, "carry UDP datagrams on the TCP connection to proxy server, which must support it")
+	muxArg := flag.Bool("mux", false, "with -L, carry forwarded connections as streams of one connection to proxy server, which must support it")
+	poolArg := flag.Int("pool", 0, "with -L, keep connections to proxy server authenticated in advance, 0 means none")
+	poolMaxAgeArg := flag.Int("pool-max-age", 5, "replace connections kept by -pool after seconds, must be below the handshake timeout of proxy server (10s for sockserver)")
+	resolveArg := flag.String("resolve", "remote", `where target domains are resolved, "remote" (by proxy server) or "local"`)
+	resolveFamilyArg := flag.String("resolve-family", "dual", `address family preference with -resolve local, "dual", "prefer-ipv4", "ipv4" or "ipv6"`)
+	udpTimeoutArg := flag.Int("udp-timeout", 0, "read timeout in ms with -udp-delim, exit on timeout after stdin finished. 0 means no timeout")
+	scanArg := flag.Bool("z", false, "zero-I/O mode, report reply of proxy server for targets, host:port or host:lo-hi")
+	execArg := flag.String("e", "", "run command with sh -c and connect its stdin/stdout to the tunnel")
+	listenArg := flag.Bool("l", false, "listen mode using BIND command, target is the expected peer, 0.0.0.0:0 for any peer")
+	var forwards forwardList
+	flag.Var(&forwards, "L", "forward local port to remote, [bind_address:]port:host:hostport, can be repeated")
+	var udpForwards forwardList
+	flag.Var(&udpForwards, "U", "forward local udp port to remote, [bind_address:]port:host:hostport, can be repeated")
+	udpIdleArg := flag.Int("udp-idle", 60, "close udp association of a local peer after seconds of inactivity, 0 means never")
 	debugArg := flag.String("debug", "127.0.0.1:6062", "http debug server")
 
 	flag.Parse()
+	proxyNetwork, proxyAddr := cmd.SplitNetworkAddr(*proxyArg)
+
+	cmd.StartDebugServer(*debugArg)
+
+	dialer := &socks_go.Dialer{
+		ProxyNetwork: proxyNetwork,
+		ProxyAddr:    proxyAddr,
+		Timeout:      time.Duration(*timeoutArg) * time.Millisecond,
+		AuthMethods:  cmd.ClientAuthMethods(*userArg, *passwordArg),
+		Param:        socks_go.ClientParam{UDPOverTCP: *udpOverTCPArg},
+		Mux:          *muxArg,
+		PoolSize:     *poolArg,
+		PoolMaxAge:   time.Duration(*poolMaxAgeArg) * time.Second,
+	}
+
+	var err error
+	if dialer.Param.Resolve, err = cmd.ParseResolveMode(*resolveArg); err != nil {
+		log.Errorf("%v", err)
+		return 1
+	}
+	if dialer.Param.ResolveFamily, err = cmd.ParseDialMode(*resolveFamilyArg); err != nil {
+		log.Errorf("%v", err)
+		return 1
+	}
+
+	if len(forwards) > 0 || len(udpForwards) > 0 {
+		if *udpIdleArg < 0 {
+			log.Errorf("bad -udp-idle: %d", *udpIdleArg)
+			return 1
+		}
+		dialer.FillPool()
+		err := runForwards(dialer, forwards, udpForwards, time.Duration(*udpIdleArg)*time.Second)
+		log.Errorf("forwarding error: %v", err)
+		return 2
+	}
+
+	if *scanArg {
+		return doScan(dialer, flag.Args())
+	}
+
 	target := flag.Arg(0)
 	if len(target) == 0 {
 		log.Errorf("must specify target address")
 		return 1
 	}
 
-	cmd.StartDebugServer(*debugArg)
-
 	host, port, err := util.SplitHostPort(target)
 	if err != nil {
 		log.Errorf("can not parse host:port: %s", target)
@@ -53,23 +116,32 @@ func realMain() int {
 	defer doClose()
 
 	// connect to proxy server
-	conn, err = net.Dial("tcp", *proxyArg) // TODO: timeout
+	conn, err = net.DialTimeout(dialer.ProxyNetwork, dialer.ProxyAddr, dialer.Timeout)
 	if err != nil {
 		log.Errorf("Dial to proxy failed: %v", err)
 		return 2
 	}
 
 	// make socks5 client
-	client := socks_go.NewClient(conn, nil)
+	client := socks_go.NewClientWithAuthMethods(conn, dialer.AuthMethods, dialer.Param)
 
-	if *udpArg {
+	if *udpArg && *udpDelimArg != "" {
+		codec, err := newPacketCodec(*udpDelimArg, *udpEncodingArg)
+		if err != nil {
+			log.Errorf("%v", err)
+			return 1
+		}
+		return doUDPStream(&client, host, port, codec, time.Duration(*udpTimeoutArg)*time.Millisecond)
+	} else if *udpArg {
 		return doUDP(&client, host, port, doClose)
+	} else if *listenArg {
+		return doListen(&client, host, port, *execArg, doClose)
 	} else {
-		return doTCP(&client, host, port, doClose)
+		return doTCP(&client, host, port, *execArg, doClose)
 	}
 }
 
-func doTCP(client *socks_go.Client, host string, port uint16, doClose func()) int {
+func doTCP(client *socks_go.Client, host string, port uint16, execArg string, doClose func()) int {
 	// issue command to server
 	tunnel, err := client.Connect(host, port)
 	if err != nil {
@@ -77,6 +149,33 @@ func doTCP(client *socks_go.Client, host string, port uint16, doClose func()) in
 		return 3
 	}
 
+	return runTunnel(tunnel, execArg, doClose)
+}
+
+func doListen(client *socks_go.Client, host string, port uint16, execArg string, doClose func()) int {
+	bindAddr, bindPort, err := client.Bind(socks_go.NewSocksAddrFromString(host), port)
+	if err != nil {
+		log.Errorf("client.Bind(%s:%d) failed: %v", host, port, err)
+		return 3
+	}
+	log.Infof("listening on %v:%d", bindAddr, bindPort)
+
+	tunnel, err := client.AcceptBind()
+	if err != nil {
+		log.Errorf("client.AcceptBind() failed: %v", err)
+		return 3
+	}
+	log.Infof("peer connected from %v:%d", tunnel.BindAddr, tunnel.BindPort)
+
+	return runTunnel(tunnel, execArg, doClose)
+}
+
+// runTunnel tunnels stdin/stdout or the child process
+func runTunnel(tunnel io.ReadWriter, execArg string, doClose func()) int {
+	if execArg != "" {
+		return runExec(tunnel, execArg, doClose)
+	}
+
 	// tunnel stdin and stdout through proxy
 	l2r := util.BridgeReaderWriter(os.Stdin, tunnel)
 	r2l := util.BridgeReaderWriter(tunnel, os.Stdout)
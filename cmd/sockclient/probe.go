@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/account-login/socks_go"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+var replyText = map[byte]string{
+	socks_go.ReplyOK:                "open",
+	socks_go.ReplyFail:              "general failure",
+	socks_go.ReplyNotAllowed:        "not allowed by ruleset",
+	socks_go.ReplyNetUnreachable:    "network unreachable",
+	socks_go.ReplyHostUnreachable:   "host unreachable",
+	socks_go.ReplyConnRefused:       "connection refused",
+	socks_go.ReplyTTLExpired:        "TTL expired",
+	socks_go.ReplyCmdNotSupported:   "command not supported",
+	socks_go.ReplyATypeNotSupported: "address type not supported",
+}
+
+type scanTarget struct {
+	host string
+	port uint16
+}
+
+// parseScanTarget parses host:port or host:lo-hi
+func parseScanTarget(input string) (targets []scanTarget, err error) {
+	idx := strings.LastIndex(input, ":")
+	if idx < 0 {
+		err = errors.Errorf("bad target %q, expect host:port or host:lo-hi", input)
+		return
+	}
+	host := strings.Trim(input[:idx], "[]")
+	ports := strings.SplitN(input[idx+1:], "-", 2)
+
+	lo, err := strconv.ParseUint(ports[0], 10, 16)
+	if err != nil {
+		err = errors.Wrapf(err, "bad port in %q", input)
+		return
+	}
+	hi := lo
+	if len(ports) == 2 {
+		hi, err = strconv.ParseUint(ports[1], 10, 16)
+		if err != nil {
+			err = errors.Wrapf(err, "bad port in %q", input)
+			return
+		}
+	}
+	if hi < lo {
+		err = errors.Errorf("bad port range in %q", input)
+		return
+	}
+
+	for port := lo; port <= hi; port++ {
+		targets = append(targets, scanTarget{host, uint16(port)})
+	}
+	return
+}
+
+// doScan connects to every target without I/O and reports the reply
+func doScan(dialer *socks_go.Dialer, args []string) int {
+	if len(args) == 0 {
+		log.Errorf("must specify target address")
+		return 1
+	}
+
+	var targets []scanTarget
+	for _, arg := range args {
+		pieces, err := parseScanTarget(arg)
+		if err != nil {
+			log.Errorf("%v", err)
+			return 4
+		}
+		targets = append(targets, pieces...)
+	}
+
+	retCode := 0
+	for _, target := range targets {
+		hostPort := fmt.Sprintf("%s:%d", target.host, target.port)
+		conn, err := dialer.DialSocksAddr(socks_go.NewSocksAddrFromString(target.host), target.port)
+		if err == nil {
+			conn.Close()
+			fmt.Printf("%s\t%s\n", hostPort, replyText[socks_go.ReplyOK])
+			continue
+		}
+
+		retCode = 3
+		if replyErr, ok := errors.Cause(err).(*socks_go.ReplyError); ok {
+			text, ok := replyText[replyErr.Reply]
+			if !ok {
+				text = "unknown"
+			}
+			fmt.Printf("%s\treply %#x (%s)\n", hostPort, replyErr.Reply, text)
+		} else {
+			fmt.Printf("%s\terror (%v)\n", hostPort, err)
+		}
+	}
+	return retCode
+}
+
+// runExec connects the tunnel to stdin/stdout of the command
+func runExec(tunnel io.ReadWriter, command string, doClose func()) int {
+	child := exec.Command("/bin/sh", "-c", command)
+	child.Stdout = tunnel
+	child.Stderr = os.Stderr
+	stdin, err := child.StdinPipe()
+	if err != nil {
+		log.Errorf("can not create stdin pipe: %v", err)
+		return 3
+	}
+
+	err = child.Start()
+	if err != nil {
+		log.Errorf("can not start %q: %v", command, err)
+		return 3
+	}
+
+	go func() {
+		_, err := io.Copy(stdin, tunnel)
+		if err != nil {
+			// may be closed after child exited
+			log.Debugf("remote to child finished: %v", err)
+		}
+		stdin.Close()
+	}()
+
+	err = child.Wait()
+	// stop copying to child
+	doClose()
+	if err != nil {
+		log.Errorf("command %q failed: %v", command, err)
+		return 3
+	}
+	return 0
+}
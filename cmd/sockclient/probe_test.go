@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScanTarget(t *testing.T) {
+	targets, err := parseScanTarget("example.com:80")
+	require.NoError(t, err)
+	assert.Equal(t, []scanTarget{{"example.com", 80}}, targets)
+
+	targets, err = parseScanTarget("[::1]:22-24")
+	require.NoError(t, err)
+	assert.Equal(t, []scanTarget{{"::1", 22}, {"::1", 23}, {"::1", 24}}, targets)
+
+	for _, bad := range []string{"example.com", "host:x", "host:5-3", "host:1-x"} {
+		_, err = parseScanTarget(bad)
+		assert.Error(t, err, bad)
+	}
+}
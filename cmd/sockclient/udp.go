@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/account-login/socks_go"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// how packets are delimited on stdin
+const (
+	delimLine   = "line"
+	delimLength = "length" // 2 bytes big endian length prefix
+)
+
+// how payloads are encoded on stdin and stdout
+const (
+	encodingRaw    = "raw"
+	encodingHex    = "hex"
+	encodingBase64 = "base64"
+)
+
+type packetCodec struct {
+	delim    string
+	encoding string
+}
+
+func newPacketCodec(delim string, encoding string) (*packetCodec, error) {
+	switch delim {
+	case delimLine, delimLength:
+	default:
+		return nil, errors.Errorf("unknown delimiter %q", delim)
+	}
+	switch encoding {
+	case encodingRaw, encodingHex, encodingBase64:
+	default:
+		return nil, errors.Errorf("unknown encoding %q", encoding)
+	}
+	return &packetCodec{delim, encoding}, nil
+}
+
+func (c *packetCodec) decode(data []byte) ([]byte, error) {
+	switch c.encoding {
+	case encodingHex:
+		return hex.DecodeString(strings.TrimSpace(string(data)))
+	case encodingBase64:
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	default:
+		return data, nil
+	}
+}
+
+func (c *packetCodec) encode(data []byte) string {
+	switch c.encoding {
+	case encodingHex:
+		return hex.EncodeToString(data)
+	case encodingBase64:
+		return base64.StdEncoding.EncodeToString(data)
+	default:
+		return string(data)
+	}
+}
+
+// escapes newlines of raw payloads printed in line mode
+var lineEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+
+// writePacket prints a received packet with its source address, tab separated.
+// The payload is length prefixed like stdin in length mode, raw payloads in line mode
+// are escaped, so that a packet is always one line.
+func (c *packetCodec) writePacket(w io.Writer, from net.Addr, data []byte) (err error) {
+	payload := c.encode(data)
+	if c.delim == delimLength {
+		if len(payload) > 0xffff {
+			return errors.Errorf("packet of %d bytes too long for length prefix", len(payload))
+		}
+		var header [2]byte
+		binary.BigEndian.PutUint16(header[:], uint16(len(payload)))
+		_, err = fmt.Fprintf(w, "%v\t%s%s", from, header[:], payload)
+		return
+	}
+	if c.encoding == encodingRaw {
+		payload = lineEscaper.Replace(payload)
+	}
+	_, err = fmt.Fprintf(w, "%v\t%s\n", from, payload)
+	return
+}
+
+// readPacket returns io.EOF if no more packets
+func (c *packetCodec) readPacket(reader *bufio.Reader) (packet []byte, err error) {
+	var data []byte
+	if c.delim == delimLength {
+		var header [2]byte
+		_, err = io.ReadFull(reader, header[:])
+		if err != nil {
+			return
+		}
+		data = make([]byte, binary.BigEndian.Uint16(header[:]))
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			err = errors.Wrap(err, "truncated packet")
+			return
+		}
+	} else {
+		data, err = reader.ReadBytes('\n')
+		if err == io.EOF && len(data) > 0 {
+			err = nil // last line without newline
+		}
+		if err != nil {
+			return
+		}
+		data = []byte(strings.TrimRight(string(data), "\r\n"))
+	}
+
+	return c.decode(data)
+}
+
+// doUDPStream sends packets from stdin and prints every packet received with its source address
+func doUDPStream(client *socks_go.Client, host string, port uint16, codec *packetCodec, timeout time.Duration) int {
+	tunnel, err := client.UDPAssociation()
+	if err != nil {
+		log.Errorf("client.UDPAssociation() error: %v", err)
+		return 3
+	}
+	defer tunnel.Close()
+
+	target := socks_go.NewSocksAddrFromString(host)
+	stdinDone := make(chan error, 1)
+	go func() {
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			packet, err := codec.readPacket(reader)
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				stdinDone <- err
+				return
+			}
+
+			_, err = tunnel.WriteToSocksAddr(packet, target, port)
+			if err != nil {
+				stdinDone <- errors.Wrap(err, "tunnel.WriteToSocksAddr() error")
+				return
+			}
+		}
+	}()
+
+	received := make(chan error, 1)
+	startReceiving := func() {
+		go func() {
+			received <- receivePackets(&tunnel, codec, timeout)
+		}()
+	}
+	startReceiving()
+
+	for {
+		select {
+		case err = <-stdinDone:
+			stdinDone = nil
+			if err != nil {
+				log.Errorf("send error: %v", err)
+				return 3
+			}
+			log.Debugf("stdin finished")
+		case err = <-received:
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if stdinDone == nil {
+					return 0
+				}
+				// keep receiving until stdin finished
+				log.Debugf("no packet received in %v", timeout)
+				startReceiving()
+				continue
+			}
+			log.Errorf("receive error: %v", err)
+			return 3
+		}
+	}
+}
+
+// receivePackets returns on error or read timeout
+func receivePackets(tunnel *socks_go.ClientUDPTunnel, codec *packetCodec, timeout time.Duration) error {
+	buf := make([]byte, 64*1024)
+	for {
+		if timeout > 0 {
+			_ = tunnel.SetReadDeadline(time.Now().Add(timeout))
+		}
+		n, from, err := tunnel.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if err = codec.writePacket(os.Stdout, from, buf[:n]); err != nil {
+			return errors.Wrap(err, "write stdout error")
+		}
+	}
+}
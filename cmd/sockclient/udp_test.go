@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAllPackets(t *testing.T, codec *packetCodec, input []byte) (packets [][]byte) {
+	reader := bufio.NewReader(bytes.NewReader(input))
+	for {
+		packet, err := codec.readPacket(reader)
+		if err == io.EOF {
+			return
+		}
+		require.NoError(t, err)
+		packets = append(packets, packet)
+	}
+}
+
+func TestPacketCodec_Line(t *testing.T) {
+	codec, err := newPacketCodec(delimLine, encodingRaw)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("ab"), []byte(""), []byte("cd")},
+		readAllPackets(t, codec, []byte("ab\r\n\ncd")))
+
+	codec, err = newPacketCodec(delimLine, encodingHex)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{{0x01, 0xff}}, readAllPackets(t, codec, []byte("01ff\n")))
+	assert.Equal(t, "01ff", codec.encode([]byte{0x01, 0xff}))
+
+	codec, err = newPacketCodec(delimLine, encodingBase64)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("hi")}, readAllPackets(t, codec, []byte("aGk=\n")))
+}
+
+func TestPacketCodec_Length(t *testing.T) {
+	codec, err := newPacketCodec(delimLength, encodingRaw)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a\n"), {}},
+		readAllPackets(t, codec, []byte{0, 2, 'a', '\n', 0, 0}))
+
+	_, err = codec.readPacket(bufio.NewReader(bytes.NewReader([]byte{0, 2, 'a'})))
+	assert.Error(t, err)
+
+	_, err = newPacketCodec("bad", encodingRaw)
+	assert.Error(t, err)
+}
+
+func TestPacketCodec_Write(t *testing.T) {
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	var out bytes.Buffer
+
+	// one line per packet
+	codec, err := newPacketCodec(delimLine, encodingRaw)
+	require.NoError(t, err)
+	require.NoError(t, codec.writePacket(&out, from, []byte("a\nb\\c\r")))
+	assert.Equal(t, "127.0.0.1:53\ta\\nb\\\\c\\r\n", out.String())
+
+	codec, err = newPacketCodec(delimLine, encodingHex)
+	require.NoError(t, err)
+	out.Reset()
+	require.NoError(t, codec.writePacket(&out, from, []byte{0x0a}))
+	assert.Equal(t, "127.0.0.1:53\t0a\n", out.String())
+
+	codec, err = newPacketCodec(delimLength, encodingRaw)
+	require.NoError(t, err)
+	out.Reset()
+	require.NoError(t, codec.writePacket(&out, from, []byte("a\n")))
+	assert.Equal(t, "127.0.0.1:53\t\x00\x02a\n", out.String())
+}
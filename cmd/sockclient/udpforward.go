@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/account-login/socks_go"
+	"github.com/account-login/socks_go/cmd"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// runUDPForward relays datagrams from a local udp port to a fixed remote target,
+// one udp association per local peer.
+func runUDPForward(dialer *socks_go.Dialer, spec forwardSpec, idle time.Duration) error {
+	addr, err := net.ResolveUDPAddr("udp", spec.bind)
+	if err != nil {
+		return errors.Wrapf(err, "runUDPForward: can not resolve %q", spec.bind)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "runUDPForward: listen(%q) error", spec.bind)
+	}
+	defer conn.Close()
+	log.Infof("forwarding udp %v", spec)
+
+	sessions := &cmd.UDPSessions{
+		Dialer: dialer,
+		Idle:   idle,
+		Reply: func(sess *cmd.UDPSession, data []byte, from *net.UDPAddr) error {
+			_, err := conn.WriteToUDP(data, sess.Peer)
+			return err
+		},
+	}
+	defer sessions.Close()
+
+	target := socks_go.NewSocksAddrFromString(spec.host)
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return errors.Wrapf(err, "runUDPForward: read error on %v", spec.bind)
+		}
+
+		if !sessions.Send(from, buf[:n], target, spec.port) {
+			log.Warnf("peer: %v, forward: %v, udp association busy, drop datagram", from, spec)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/account-login/socks_go"
+	"github.com/account-login/socks_go/cmd"
+	log "github.com/cihub/seelog"
+)
+
+func realMain() int {
+	// logging
+	defer log.Flush()
+	cmd.ConfigLogging()
+
+	// args
+	bindArg := flag.String("bind", "127.0.0.1:1080", "bind on address, host:port or unix:/path/to/sock, accepts clients without auth")
+	proxyArg := flag.String("proxy", "", "upstream socks5 proxy server, host:port or unix:/path/to/sock")
+	userArg := flag.String("user", "", "username for upstream proxy server")
+	passwordArg := flag.String("password", "", "password for upstream proxy server")
+	timeoutArg := flag.Int("timeout", 5000, "timeout in ms for connecting to upstream proxy server")
+	tlsArg := flag.Bool("tls", false, "connect to upstream proxy server over TLS")
+	tlsCAArg := flag.String("tls-ca", "", "CA certificates for verifying upstream proxy server")
+	tlsServerNameArg := flag.String("tls-server-name", "", "server name for verifying upstream proxy server, host of -proxy by default")
+	tlsInsecureArg := flag.Bool("tls-insecure", false, "do not verify upstream proxy server")
+	debugArg := flag.String("debug", "127.0.0.1:6064", "http debug server")
+	flag.Parse()
+
+	if *proxyArg == "" {
+		log.Errorf("must specify upstream proxy server")
+		return 1
+	}
+	proxyNetwork, proxyAddr := cmd.SplitNetworkAddr(*proxyArg)
+
+	cmd.StartDebugServer(*debugArg)
+
+	upstream := &socks_go.Dialer{
+		ProxyNetwork: proxyNetwork,
+		ProxyAddr:    proxyAddr,
+		Timeout:      time.Duration(*timeoutArg) * time.Millisecond,
+		AuthMethods:  cmd.ClientAuthMethods(*userArg, *passwordArg),
+		Param:        socks_go.ClientParam{FixUDPAddr: true},
+	}
+	if *userArg != "" {
+		// never fall back to no auth
+		upstream.Param.MinSecurity = socks_go.SecurityPassword
+	}
+	if *tlsArg {
+		config, err := cmd.MakeTLSConfig(*tlsCAArg, *tlsServerNameArg, *tlsInsecureArg)
+		if err != nil {
+			log.Errorf("%v", err)
+			return 1
+		}
+		upstream.TLSConfig = config
+	}
+
+	bindNetwork, bindAddr := cmd.SplitNetworkAddr(*bindArg)
+	server := socks_go.Server{
+		Listeners: []*socks_go.Listener{{Network: bindNetwork, Addr: bindAddr}},
+		Upstream:  upstream,
+	}
+	err := server.Run()
+	if err != nil {
+		log.Errorf("failed to start server: %v", err)
+		return 1
+	} else {
+		return 0
+	}
+}
+
+func main() {
+	os.Exit(realMain())
+}
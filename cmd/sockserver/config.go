@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/account-login/socks_go"
+	"github.com/account-login/socks_go/cmd"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// duration is parsed from strings like "3s" or "250ms"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.Errorf("duration should be a string like \"3s\", got %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.Wrapf(err, "bad duration %q", s)
+	}
+	*d = duration(v)
+	return nil
+}
+
+type logConfig struct {
+	Level string `json:"level"`
+	File  string `json:"file"`
+}
+
+// settings of listener override the global ones
+type listenerConfig struct {
+	// host:port or unix:/path/to/sock
+	Bind string `json:"bind"`
+	// permission of unix socket file in octal, e.g. "0660"
+	Mode string `json:"mode"`
+	// "none" or "password"
+	Auth string `json:"auth"`
+	// accept TLS if both set
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// nil means the global rules
+	Rules *[]ruleConfig `json:"rules"`
+	// name of upstream, overrides dial settings
+	Upstream   string   `json:"upstream"`
+	LocalAddrs []string `json:"local_addrs"`
+	Device     string   `json:"device"`
+}
+
+type userConfig struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type upstreamConfig struct {
+	Proxy         string   `json:"proxy"`
+	User          string   `json:"user"`
+	Password      string   `json:"password"`
+	Timeout       duration `json:"timeout"`
+	TLS           bool     `json:"tls"`
+	TLSCA         string   `json:"tls_ca"`
+	TLSServerName string   `json:"tls_server_name"`
+	TLSInsecure   bool     `json:"tls_insecure"`
+	// carry udp associations on the tcp connection, for networks blocking udp
+	UDPOverTCP bool `json:"udp_over_tcp"`
+	// "remote" or "local", resolve targets here for proxies not accepting domains
+	Resolve string `json:"resolve"`
+	// address family preference of local resolving, same as dial mode
+	ResolveFamily string `json:"resolve_family"`
+}
+
+type ruleConfig struct {
+	// "allow" or "deny"
+	Action string   `json:"action"`
+	Users  []string `json:"users"`
+	// peer credentials on unix socket
+	UIDs []int `json:"uids"`
+	GIDs []int `json:"gids"`
+	// "connect", "bind", "udp", "resolve" or "resolve_ptr"
+	Cmds     []string `json:"cmds"`
+	Networks []string `json:"networks"`
+	Domains  []string `json:"domains"`
+	// "22" or "8000-9000"
+	Ports     []string `json:"ports"`
+	LocalAddr string   `json:"local_addr"`
+	Upstream  string   `json:"upstream"`
+}
+
+type rewriteConfig struct {
+	// domain pattern, ip or cidr, empty matches any target
+	Match string   `json:"match"`
+	Ports []string `json:"ports"`
+	// domain or ip, "*.example.org" replaces the suffix matched by "*.example.com"
+	ToHost string `json:"to_host"`
+	ToPort uint16 `json:"to_port"`
+}
+
+type timeoutConfig struct {
+	Connect      duration `json:"connect"`
+	Handshake    duration `json:"handshake"`
+	Bind         duration `json:"bind"`
+	AttemptDelay duration `json:"attempt_delay"`
+}
+
+type limitConfig struct {
+	MaxConns   int `json:"max_conns"`
+	UDPWorkers int `json:"udp_workers"`
+}
+
+type udpConfig struct {
+	// client-facing port shared by all udp associations, e.g. ":1080".
+	// empty means a port for each association.
+	Relay string `json:"relay"`
+	// ports of outbound udp sockets, e.g. "20000-29999"
+	Ports string `json:"ports"`
+}
+
+type dialConfig struct {
+	// "dual", "prefer-ipv4", "ipv4" or "ipv6"
+	Mode       string   `json:"mode"`
+	LocalAddrs []string `json:"local_addrs"`
+	Device     string   `json:"device"`
+}
+
+type config struct {
+	Log       logConfig                 `json:"log"`
+	Debug     string                    `json:"debug"`
+	Listeners []listenerConfig          `json:"listeners"`
+	Users     []userConfig              `json:"users"`
+	UsersFile string                    `json:"users_file"`
+	Upstreams map[string]upstreamConfig `json:"upstreams"`
+	Rules     []ruleConfig              `json:"rules"`
+	Rewrites  []rewriteConfig           `json:"rewrites"`
+	Timeouts  timeoutConfig             `json:"timeouts"`
+	Limits    limitConfig               `json:"limits"`
+	Dial      dialConfig                `json:"dial"`
+	UDP       udpConfig                 `json:"udp"`
+}
+
+func defaultConfig() config {
+	return config{
+		Debug: "127.0.0.1:6061",
+		Timeouts: timeoutConfig{
+			Connect:      duration(3 * time.Second),
+			Handshake:    duration(10 * time.Second),
+			Bind:         duration(60 * time.Second),
+			AttemptDelay: duration(250 * time.Millisecond),
+		},
+	}
+}
+
+func parseConfig(data []byte) (conf config, err error) {
+	conf = defaultConfig()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&conf)
+	if err != nil {
+		err = errors.Wrap(err, "can not parse config")
+		return
+	}
+	if len(conf.Listeners) == 0 {
+		err = errors.New("no listener configured")
+		return
+	}
+	if conf.Log.Level != "" {
+		if _, ok := log.LogLevelFromString(conf.Log.Level); !ok {
+			err = errors.Errorf("bad log level %q", conf.Log.Level)
+		}
+	}
+	return
+}
+
+func loadConfig(path string) (conf config, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = errors.Wrapf(err, "can not read config %q", path)
+		return
+	}
+	return parseConfig(data)
+}
+
+// parseUsersFile parses "user:password" lines, empty lines and lines starting with # are ignored.
+func parseUsersFile(data []byte, users map[string]string) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx <= 0 {
+			return errors.Errorf("bad user at line %d", lineno)
+		}
+		users[line[:idx]] = line[idx+1:]
+	}
+	return scanner.Err()
+}
+
+// parseNetwork parses cidr or single ip.
+func parseNetwork(s string) (network *net.IPNet, err error) {
+	if !strings.Contains(s, "/") {
+		if strings.Contains(s, ":") {
+			s += "/128"
+		} else {
+			s += "/32"
+		}
+	}
+	if _, network, err = net.ParseCIDR(s); err != nil {
+		return nil, errors.Wrapf(err, "bad network %q", s)
+	}
+	return
+}
+
+func parsePortRange(s string) (pr socks_go.PortRange, err error) {
+	lo, hi := s, s
+	if idx := strings.IndexByte(s, '-'); idx >= 0 {
+		lo, hi = s[:idx], s[idx+1:]
+	}
+
+	loPort, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		err = errors.Errorf("bad port range %q", s)
+		return
+	}
+	hiPort, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil || hiPort < loPort {
+		err = errors.Errorf("bad port range %q", s)
+		return
+	}
+	pr.Lo, pr.Hi = uint16(loPort), uint16(hiPort)
+	return
+}
+
+func parseCmd(s string) (byte, error) {
+	switch s {
+	case "connect":
+		return socks_go.CmdConnect, nil
+	case "bind":
+		return socks_go.CmdBind, nil
+	case "udp":
+		return socks_go.CmdUDP, nil
+	case "resolve":
+		return socks_go.CmdResolve, nil
+	case "resolve_ptr":
+		return socks_go.CmdResolvePTR, nil
+	default:
+		return 0, errors.Errorf("bad command %q", s)
+	}
+}
+
+func parseIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.Errorf("can not parse ip %q", s)
+	}
+	return ip, nil
+}
+
+func (uc *upstreamConfig) makeDialer() (*socks_go.Dialer, error) {
+	if uc.Proxy == "" {
+		return nil, errors.New("proxy address is empty")
+	}
+
+	proxyNetwork, proxyAddr := cmd.SplitNetworkAddr(uc.Proxy)
+	dialer := &socks_go.Dialer{
+		ProxyNetwork: proxyNetwork,
+		ProxyAddr:    proxyAddr,
+		Timeout:      time.Duration(uc.Timeout),
+		AuthMethods:  cmd.ClientAuthMethods(uc.User, uc.Password),
+		Param:        socks_go.ClientParam{FixUDPAddr: true, UDPOverTCP: uc.UDPOverTCP},
+	}
+	if uc.User != "" {
+		dialer.Param.MinSecurity = socks_go.SecurityPassword
+	}
+
+	var err error
+	if dialer.Param.Resolve, err = cmd.ParseResolveMode(uc.Resolve); err != nil {
+		return nil, err
+	}
+	if dialer.Param.ResolveFamily, err = cmd.ParseDialMode(uc.ResolveFamily); err != nil {
+		return nil, err
+	}
+	if uc.TLS {
+		tlsConfig, err := cmd.MakeTLSConfig(uc.TLSCA, uc.TLSServerName, uc.TLSInsecure)
+		if err != nil {
+			return nil, err
+		}
+		dialer.TLSConfig = tlsConfig
+	}
+	return dialer, nil
+}
+
+func parseIPs(ss []string) (ips []net.IP, err error) {
+	for _, s := range ss {
+		var ip net.IP
+		if ip, err = parseIP(s); err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+	return
+}
+
+func makeRules(rcs []ruleConfig, upstreams map[string]*socks_go.Dialer) (rules socks_go.RuleSet, err error) {
+	rules = make(socks_go.RuleSet, 0, len(rcs))
+	for i := range rcs {
+		var rule *socks_go.Rule
+		if rule, err = rcs[i].makeRule(upstreams); err != nil {
+			return nil, errors.Wrapf(err, "rule #%d", i)
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func (rc *ruleConfig) makeRule(upstreams map[string]*socks_go.Dialer) (rule *socks_go.Rule, err error) {
+	rule = &socks_go.Rule{Users: rc.Users, UIDs: rc.UIDs, GIDs: rc.GIDs, Domains: rc.Domains}
+
+	switch rc.Action {
+	case "allow":
+		rule.Action = socks_go.RuleAllow
+	case "deny":
+		rule.Action = socks_go.RuleDeny
+	default:
+		return nil, errors.Errorf("bad action %q", rc.Action)
+	}
+
+	for _, s := range rc.Cmds {
+		var c byte
+		if c, err = parseCmd(s); err != nil {
+			return nil, err
+		}
+		rule.Cmds = append(rule.Cmds, c)
+	}
+
+	for _, s := range rc.Networks {
+		var network *net.IPNet
+		if network, err = parseNetwork(s); err != nil {
+			return nil, err
+		}
+		rule.Networks = append(rule.Networks, network)
+	}
+
+	for _, s := range rc.Ports {
+		var pr socks_go.PortRange
+		if pr, err = parsePortRange(s); err != nil {
+			return nil, err
+		}
+		rule.Ports = append(rule.Ports, pr)
+	}
+
+	if rc.LocalAddr != "" {
+		if rule.LocalAddr, err = parseIP(rc.LocalAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	if rc.Upstream != "" {
+		if rule.Upstream = upstreams[rc.Upstream]; rule.Upstream == nil {
+			return nil, errors.Errorf("unknown upstream %q", rc.Upstream)
+		}
+	}
+	return
+}
+
+func (rc *rewriteConfig) makeRewrite() (rule *socks_go.RewriteRule, err error) {
+	rule = &socks_go.RewriteRule{ToHost: rc.ToHost, ToPort: rc.ToPort}
+
+	if rc.Match != "" {
+		if strings.HasPrefix(rc.Match, "*") || net.ParseIP(strings.SplitN(rc.Match, "/", 2)[0]) == nil {
+			rule.Domain = rc.Match
+		} else if rule.Network, err = parseNetwork(rc.Match); err != nil {
+			return nil, err
+		}
+	}
+	if strings.HasPrefix(rc.ToHost, "*.") && !strings.HasPrefix(rc.Match, "*.") {
+		return nil, errors.Errorf("to_host %q requires match like \"*.example.com\"", rc.ToHost)
+	}
+
+	for _, s := range rc.Ports {
+		var pr socks_go.PortRange
+		if pr, err = parsePortRange(s); err != nil {
+			return nil, err
+		}
+		rule.Ports = append(rule.Ports, pr)
+	}
+	return
+}
+
+// makeServer makes a server with all listeners, the server is not started.
+func (conf *config) makeServer() (server *socks_go.Server, err error) {
+	// users
+	users := make(map[string]string)
+	for _, user := range conf.Users {
+		users[user.Name] = user.Password
+	}
+	if conf.UsersFile != "" {
+		var data []byte
+		if data, err = ioutil.ReadFile(conf.UsersFile); err != nil {
+			return nil, errors.Wrapf(err, "can not read users file %q", conf.UsersFile)
+		}
+		if err = parseUsersFile(data, users); err != nil {
+			return nil, errors.Wrapf(err, "can not parse users file %q", conf.UsersFile)
+		}
+	}
+	checkUser := func(user string, password string) bool {
+		expected, ok := users[user]
+		return ok && expected == password
+	}
+
+	// upstreams
+	upstreams := make(map[string]*socks_go.Dialer)
+	for name, uc := range conf.Upstreams {
+		var dialer *socks_go.Dialer
+		if dialer, err = uc.makeDialer(); err != nil {
+			return nil, errors.Wrapf(err, "upstream %q", name)
+		}
+		upstreams[name] = dialer
+	}
+
+	rules, err := makeRules(conf.Rules, upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrites := make(socks_go.Rewriter, 0, len(conf.Rewrites))
+	for i := range conf.Rewrites {
+		var rule *socks_go.RewriteRule
+		if rule, err = conf.Rewrites[i].makeRewrite(); err != nil {
+			return nil, errors.Wrapf(err, "rewrite #%d", i)
+		}
+		rewrites = append(rewrites, rule)
+	}
+
+	// dial
+	dialMode, err := cmd.ParseDialMode(conf.Dial.Mode)
+	if err != nil {
+		return nil, err
+	}
+	localAddrs, err := parseIPs(conf.Dial.LocalAddrs)
+	if err != nil {
+		return nil, err
+	}
+
+	server = &socks_go.Server{
+		ConnectTimeout:   time.Duration(conf.Timeouts.Connect),
+		DialMode:         dialMode,
+		AttemptDelay:     time.Duration(conf.Timeouts.AttemptDelay),
+		LocalAddrs:       localAddrs,
+		BindDevice:       conf.Dial.Device,
+		BindTimeout:      time.Duration(conf.Timeouts.Bind),
+		Rules:            rules,
+		Rewrites:         rewrites,
+		HandshakeTimeout: time.Duration(conf.Timeouts.Handshake),
+		MaxConns:         conf.Limits.MaxConns,
+		UDPWorkers:       conf.Limits.UDPWorkers,
+	}
+	if conf.UDP.Ports != "" {
+		if server.UDPPortRange, err = parsePortRange(conf.UDP.Ports); err != nil {
+			return nil, errors.Wrap(err, "udp")
+		}
+	}
+
+	binds := make(map[string]bool)
+	for _, lc := range conf.Listeners {
+		if binds[lc.Bind] {
+			return nil, errors.Errorf("duplicated listener %v", lc.Bind)
+		}
+		binds[lc.Bind] = true
+
+		registry := socks_go.NewServerAuthRegistry()
+		switch lc.Auth {
+		case "", "none":
+			err = registry.Register(socks_go.MethodNone, socks_go.ServerNoAuthMethod)
+		case "password":
+			err = registry.Register(socks_go.MethodUserName, socks_go.ServerUserPassMethod(checkUser))
+		default:
+			err = errors.Errorf("listener %v: bad auth %q", lc.Bind, lc.Auth)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		network, addr := cmd.SplitNetworkAddr(lc.Bind)
+		l := &socks_go.Listener{
+			Network:     network,
+			Addr:        addr,
+			AuthHandler: registry.AuthHandler,
+			BindDevice:  lc.Device,
+		}
+		if lc.Mode != "" {
+			var mode uint64
+			if mode, err = strconv.ParseUint(lc.Mode, 8, 32); err != nil {
+				return nil, errors.Errorf("listener %v: bad mode %q", lc.Bind, lc.Mode)
+			}
+			l.Mode = os.FileMode(mode)
+		}
+		if lc.TLSCert != "" || lc.TLSKey != "" {
+			var cert tls.Certificate
+			if cert, err = tls.LoadX509KeyPair(lc.TLSCert, lc.TLSKey); err != nil {
+				return nil, errors.Wrapf(err, "listener %v: can not load TLS certificate", lc.Bind)
+			}
+			l.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		if lc.Rules != nil {
+			if l.Rules, err = makeRules(*lc.Rules, upstreams); err != nil {
+				return nil, errors.Wrapf(err, "listener %v", lc.Bind)
+			}
+		}
+		if lc.Upstream != "" {
+			if l.Upstream = upstreams[lc.Upstream]; l.Upstream == nil {
+				return nil, errors.Errorf("listener %v: unknown upstream %q", lc.Bind, lc.Upstream)
+			}
+		}
+		if l.LocalAddrs, err = parseIPs(lc.LocalAddrs); err != nil {
+			return nil, errors.Wrapf(err, "listener %v", lc.Bind)
+		}
+		server.Listeners = append(server.Listeners, l)
+	}
+	return
+}
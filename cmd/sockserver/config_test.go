@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/account-login/socks_go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"log": {"level": "info"},
+		"listeners": [
+			{"bind": "unix:/tmp/socks.sock", "mode": "0660"},
+			{"bind": ":1081", "auth": "password", "upstream": "up", "rules": [], "local_addrs": ["127.0.0.2"]}
+		],
+		"users": [{"name": "foo", "password": "bar"}],
+		"upstreams": {"up": {"proxy": "10.0.0.1:1080", "user": "u", "password": "p", "timeout": "5s", "udp_over_tcp": true,
+			"resolve": "local", "resolve_family": "ipv4"}},
+		"rules": [
+			{"action": "deny", "cmds": ["bind"], "uids": [1000]},
+			{"action": "allow", "networks": ["10.0.0.0/8", "1.1.1.1"], "ports": ["22", "8000-9000"], "upstream": "up"},
+			{"action": "deny", "domains": ["*.example.com"]}
+		],
+		"rewrites": [
+			{"match": "*.staging.example.com", "ports": ["443"], "to_host": "*.test.internal", "to_port": 8443},
+			{"match": "10.1.0.0/16", "to_host": "10.2.0.1"},
+			{"match": "pinned.example.com", "to_host": "192.0.2.1"}
+		],
+		"timeouts": {"connect": "1s", "handshake": "2s"},
+		"limits": {"max_conns": 100, "udp_workers": 8},
+		"dial": {"mode": "prefer-ipv4", "local_addrs": ["127.0.0.1"]},
+		"udp": {"relay": ":1080", "ports": "20000-29999"}
+	}`))
+	require.NoError(t, err)
+
+	s, err := conf.makeServer()
+	require.NoError(t, err)
+	require.Len(t, s.Listeners, 2)
+
+	l := s.Listeners[1]
+	assert.Equal(t, ":1081", l.Addr)
+	assert.Equal(t, "10.0.0.1:1080", l.Upstream.ProxyAddr)
+	assert.Equal(t, 5*time.Second, l.Upstream.Timeout)
+	assert.True(t, l.Upstream.Param.UDPOverTCP)
+	assert.Equal(t, socks_go.ResolveLocal, l.Upstream.Param.Resolve)
+	assert.Equal(t, socks_go.DialIPv4Only, l.Upstream.Param.ResolveFamily)
+	assert.NotNil(t, l.Rules)
+	assert.Empty(t, l.Rules)
+	assert.Equal(t, "127.0.0.2", l.LocalAddrs[0].String())
+	assert.Equal(t, "unix", s.Listeners[0].Network)
+	assert.Equal(t, "/tmp/socks.sock", s.Listeners[0].Addr)
+	assert.Equal(t, os.FileMode(0660), s.Listeners[0].Mode)
+	assert.Nil(t, s.Listeners[0].Upstream)
+	assert.Nil(t, s.Listeners[0].Rules)
+	assert.Nil(t, s.Listeners[0].TLSConfig)
+
+	assert.Equal(t, "", s.Addr)
+	assert.Equal(t, time.Second, s.ConnectTimeout)
+	assert.Equal(t, 2*time.Second, s.HandshakeTimeout)
+	assert.Equal(t, 60*time.Second, s.BindTimeout) // default
+	assert.Equal(t, 100, s.MaxConns)
+	assert.Equal(t, 8, s.UDPWorkers)
+	assert.Equal(t, ":1080", conf.UDP.Relay)
+	assert.Nil(t, s.UDPMux) // opened on reload
+	assert.Equal(t, socks_go.PortRange{Lo: 20000, Hi: 29999}, s.UDPPortRange)
+	assert.Equal(t, socks_go.DialPreferIPv4, s.DialMode)
+	assert.Len(t, s.LocalAddrs, 1)
+
+	require.Len(t, s.Rules, 3)
+	assert.Equal(t, []byte{socks_go.CmdBind}, s.Rules[0].Cmds)
+	assert.Equal(t, []int{1000}, s.Rules[0].UIDs)
+	assert.Equal(t, "1.1.1.1/32", s.Rules[1].Networks[1].String())
+	assert.Equal(t, []socks_go.PortRange{{Lo: 22, Hi: 22}, {Lo: 8000, Hi: 9000}}, s.Rules[1].Ports)
+	assert.Equal(t, l.Upstream, s.Rules[1].Upstream)
+	assert.Equal(t, socks_go.RuleDeny, s.Rules[2].Action)
+
+	require.Len(t, s.Rewrites, 3)
+	assert.Equal(t, "*.staging.example.com", s.Rewrites[0].Domain)
+	assert.Equal(t, []socks_go.PortRange{{Lo: 443, Hi: 443}}, s.Rewrites[0].Ports)
+	assert.Equal(t, uint16(8443), s.Rewrites[0].ToPort)
+	assert.Equal(t, "10.1.0.0/16", s.Rewrites[1].Network.String())
+	assert.Equal(t, "pinned.example.com", s.Rewrites[2].Domain)
+}
+
+func TestParseConfig_Bad(t *testing.T) {
+	for _, data := range []string{
+		`{}`,
+		`{"listeners": [{"bind": ":1080"}], "unknown": 1}`,
+		`{"listeners": [{"bind": ":1080"}], "timeouts": {"connect": 3}}`,
+		`{"listeners": [{"bind": ":1080"}], "log": {"level": "loud"}}`,
+	} {
+		_, err := parseConfig([]byte(data))
+		assert.Error(t, err, data)
+	}
+
+	for _, data := range []string{
+		`{"listeners": [{"bind": ":1080", "auth": "magic"}]}`,
+		`{"listeners": [{"bind": ":1080"}, {"bind": ":1080"}]}`,
+		`{"listeners": [{"bind": ":1080", "upstream": "nope"}]}`,
+		`{"listeners": [{"bind": ":1080"}], "rules": [{"action": "drop"}]}`,
+		`{"listeners": [{"bind": ":1080"}], "rules": [{"action": "deny", "ports": ["9-1"]}]}`,
+		`{"listeners": [{"bind": ":1080"}], "rules": [{"action": "deny", "networks": ["x"]}]}`,
+		`{"listeners": [{"bind": ":1080"}], "dial": {"mode": "ipv5"}}`,
+		`{"listeners": [{"bind": ":1080", "tls_cert": "/nonexistent"}]}`,
+		`{"listeners": [{"bind": ":1080", "rules": [{"action": "drop"}]}]}`,
+		`{"listeners": [{"bind": "unix:/tmp/socks.sock", "mode": "rw"}]}`,
+		`{"listeners": [{"bind": ":1080"}], "rewrites": [{"match": "example.com", "to_host": "*.example.org"}]}`,
+		`{"listeners": [{"bind": ":1080"}], "rewrites": [{"match": "10.0.0.0/33"}]}`,
+		`{"listeners": [{"bind": ":1080"}], "udp": {"ports": "30000-20000"}}`,
+		`{"listeners": [{"bind": ":1080"}], "upstreams": {"up": {"proxy": "10.0.0.1:1080", "resolve": "here"}}}`,
+	} {
+		conf, err := parseConfig([]byte(data))
+		require.NoError(t, err, data)
+		_, err = conf.makeServer()
+		assert.Error(t, err, data)
+	}
+}
+
+func TestParseUsersFile(t *testing.T) {
+	users := make(map[string]string)
+	require.NoError(t, parseUsersFile([]byte("# comment\nfoo:bar\n\nbaz:a:b\n"), users))
+	assert.Equal(t, map[string]string{"foo": "bar", "baz": "a:b"}, users)
+
+	assert.Error(t, parseUsersFile([]byte("nopassword\n"), users))
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"net"
 	"os"
+	"strings"
 
 	"runtime"
 	"time"
@@ -32,17 +34,76 @@ func realMain() int {
 	cmd.ConfigLogging()
 
 	// args
-	bindArg := flag.String("bind", ":1080", "bind on address")
+	bindArg := flag.String("bind", ":1080", "bind on address, host:port or unix:/path/to/sock")
 	ipv4Arg := flag.Bool("4", false, "ipv4 only")
+	ipv6Arg := flag.Bool("6", false, "ipv6 only")
+	prefer4Arg := flag.Bool("prefer-ipv4", false, "try ipv4 before ipv6 for dual-stack targets")
+	attemptDelayArg := flag.Int("attempt-delay", 250, "delay in ms between connection attempts to multiple addresses")
+	connectTimeoutArg := flag.Int("connect-timeout", 3000, "timeout in ms for connecting to target")
+	localArg := flag.String("local", "", "outbound source addresses seperated by comma, rotated round-robin")
+	deviceArg := flag.String("device", "", "bind outbound sockets to network interface")
 	debugArg := flag.String("debug", "127.0.0.1:6061", "http debug server")
+	udpRelayArg := flag.String("udp-relay", "", "udp port shared by all udp associations, e.g. :1080")
+	udpPortsArg := flag.String("udp-ports", "", "port range of outbound udp sockets, e.g. 20000-29999")
+	configArg := flag.String("config", "", "json config file, other flags are ignored if set, reloaded on SIGHUP")
 	flag.Parse()
 
+	if *configArg != "" {
+		return runConfig(*configArg)
+	}
+
+	localAddrs := make([]net.IP, 0)
+	if len(*localArg) > 0 {
+		for _, piece := range strings.Split(*localArg, ",") {
+			ip := net.ParseIP(piece)
+			if ip == nil {
+				log.Errorf("can not parse local address %q", piece)
+				return 2
+			}
+			localAddrs = append(localAddrs, ip)
+		}
+	}
+
+	var udpPorts socks_go.PortRange
+	if *udpPortsArg != "" {
+		var err error
+		if udpPorts, err = parsePortRange(*udpPortsArg); err != nil {
+			log.Errorf("%v", err)
+			return 2
+		}
+	}
+	var udpMux *socks_go.UDPMux
+	if *udpRelayArg != "" {
+		var err error
+		if udpMux, err = socks_go.ListenUDPMux(*udpRelayArg); err != nil {
+			log.Errorf("failed to start udp relay: %v", err)
+			return 1
+		}
+		defer udpMux.Close()
+	}
+
 	go monitor()
 	cmd.StartDebugServer(*debugArg)
 
+	dialMode := socks_go.DialDualStack
+	if *ipv4Arg {
+		dialMode = socks_go.DialIPv4Only
+	} else if *ipv6Arg {
+		dialMode = socks_go.DialIPv6Only
+	} else if *prefer4Arg {
+		dialMode = socks_go.DialPreferIPv4
+	}
+
+	bindNetwork, bindAddr := cmd.SplitNetworkAddr(*bindArg)
 	server := socks_go.Server{
-		Addr:     *bindArg,
-		IPV4Only: *ipv4Arg,
+		Listeners:      []*socks_go.Listener{{Network: bindNetwork, Addr: bindAddr}},
+		DialMode:       dialMode,
+		AttemptDelay:   time.Duration(*attemptDelayArg) * time.Millisecond,
+		ConnectTimeout: time.Duration(*connectTimeoutArg) * time.Millisecond,
+		LocalAddrs:     localAddrs,
+		BindDevice:     *deviceArg,
+		UDPMux:         udpMux,
+		UDPPortRange:   udpPorts,
 	}
 	err := server.Run()
 	if err != nil {
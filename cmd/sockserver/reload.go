@@ -0,0 +1,177 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/account-login/socks_go"
+	"github.com/account-login/socks_go/cmd"
+	log "github.com/cihub/seelog"
+)
+
+// listenerSlot keeps the listener open across reloads,
+// new connections are handled by the latest server.
+type listenerSlot struct {
+	listener net.Listener
+	binding  atomic.Value // binding
+}
+
+type binding struct {
+	server *socks_go.Server
+	l      *socks_go.Listener
+}
+
+func (ls *listenerSlot) serve() {
+	for {
+		conn, err := ls.listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Errorf("Accept failed: %v", err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			log.Infof("listener %v stopped: %v", ls.listener.Addr(), err)
+			return
+		}
+
+		log.Infof("Accept %v", conn.RemoteAddr())
+		b := ls.binding.Load().(binding)
+		go b.server.ServeConnOn(b.l, conn)
+	}
+}
+
+func slotKey(l *socks_go.Listener) string {
+	return l.Network + " " + l.Addr
+}
+
+type configServer struct {
+	path   string
+	slots  map[string]*listenerSlot
+	server atomic.Value // *socks_go.Server
+	// kept across reloads like listeners
+	udpMux      *socks_go.UDPMux
+	udpMuxRelay string
+}
+
+// Stats returns the counters of the current server, which continues the replaced ones.
+func (cs *configServer) Stats() socks_go.Stats {
+	server, _ := cs.server.Load().(*socks_go.Server)
+	if server == nil {
+		return socks_go.Stats{}
+	}
+	return server.Stats()
+}
+
+// reload applies the config file, the running config is kept on error.
+// Existing sessions are not affected.
+func (cs *configServer) reload() (conf config, err error) {
+	conf, err = loadConfig(cs.path)
+	if err != nil {
+		return
+	}
+	server, err := conf.makeServer()
+	if err != nil {
+		return
+	}
+	// before starting listeners, so they log with the new config
+	if logErr := cmd.ConfigLoggingWith(conf.Log.Level, conf.Log.File); logErr != nil {
+		log.Errorf("%v", logErr)
+	}
+
+	udpMux := cs.udpMux
+	if conf.UDP.Relay != cs.udpMuxRelay {
+		udpMux = nil
+	}
+	if conf.UDP.Relay != "" && udpMux == nil {
+		if udpMux, err = socks_go.ListenUDPMux(conf.UDP.Relay); err != nil {
+			return
+		}
+		log.Infof("udp relay started on %v", udpMux.LocalAddr())
+	}
+	server.UDPMux = udpMux
+
+	slots := make(map[string]*listenerSlot)
+	opened := make([]*listenerSlot, 0)
+	for _, l := range server.Listeners {
+		slot := cs.slots[slotKey(l)]
+		if slot == nil {
+			var listener net.Listener
+			listener, err = l.Listen()
+			if err != nil {
+				for _, s := range opened {
+					s.listener.Close()
+				}
+				if udpMux != nil && udpMux != cs.udpMux {
+					udpMux.Close()
+				}
+				return
+			}
+			log.Infof("server started on %v", listener.Addr())
+			slot = &listenerSlot{listener: listener}
+			opened = append(opened, slot)
+		}
+		slots[slotKey(l)] = slot
+	}
+
+	// sessions of the old server still count, e.g. for MaxConns
+	if old, _ := cs.server.Load().(*socks_go.Server); old != nil {
+		server.InheritStats(old)
+	}
+	for _, l := range server.Listeners {
+		if old, ok := slots[slotKey(l)].binding.Load().(binding); ok {
+			l.InheritStats(old.l)
+		}
+	}
+	cs.server.Store(server)
+	for _, l := range server.Listeners {
+		slots[slotKey(l)].binding.Store(binding{server: server, l: l})
+	}
+
+	for _, slot := range opened {
+		go slot.serve()
+	}
+	for addr, slot := range cs.slots {
+		if slots[addr] == nil {
+			slot.listener.Close()
+		}
+	}
+	cs.slots = slots
+	if cs.udpMux != nil && cs.udpMux != udpMux {
+		cs.udpMux.Close()
+	}
+	cs.udpMux, cs.udpMuxRelay = udpMux, conf.UDP.Relay
+	return
+}
+
+func runConfig(path string) int {
+	cs := configServer{path: path}
+	conf, err := cs.reload()
+	if err != nil {
+		log.Errorf("failed to start server: %v", err)
+		return 1
+	}
+
+	go monitor()
+	expvar.Publish("socks", expvar.Func(func() interface{} { return cs.Stats() }))
+	// not restarted on reload
+	if conf.Debug != "" {
+		cmd.StartDebugServer(conf.Debug)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		log.Infof("reloading config %q", path)
+		if _, err := cs.reload(); err != nil {
+			log.Errorf("failed to reload config, keep running with the old one: %v", err)
+		} else {
+			log.Infof("config reloaded")
+		}
+	}
+	return 0
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"os"
+	"time"
+
+	"github.com/account-login/socks_go"
+	"github.com/account-login/socks_go/cmd"
+	"github.com/account-login/socks_go/util"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+type redirServer struct {
+	bind   string
+	tproxy bool
+	dialer *socks_go.Dialer
+}
+
+func (s *redirServer) listenConfig() net.ListenConfig {
+	if s.tproxy {
+		return net.ListenConfig{Control: transparentControl}
+	}
+	return net.ListenConfig{}
+}
+
+func (s *redirServer) runTCP() error {
+	lc := s.listenConfig()
+	listener, err := lc.Listen(context.Background(), "tcp", s.bind)
+	if err != nil {
+		return errors.Wrapf(err, "runTCP: listen(%q) error", s.bind)
+	}
+	log.Infof("tcp redirector started on %v, tproxy: %v", listener.Addr(), s.tproxy)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Errorf("Accept failed: %v", err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return errors.Wrapf(err, "runTCP: Accept failed on %v", listener.Addr())
+		}
+
+		go s.handleTCP(conn.(*net.TCPConn))
+	}
+}
+
+func (s *redirServer) handleTCP(conn *net.TCPConn) {
+	var err error
+	var target *net.TCPAddr
+	defer func() {
+		if err != nil {
+			log.Errorf("client: %v, target: %v, err: %v", conn.RemoteAddr(), target, err)
+		}
+		conn.Close()
+	}()
+
+	// with TPROXY the socket is bound to the original destination
+	if s.tproxy {
+		target = conn.LocalAddr().(*net.TCPAddr)
+	} else {
+		target, err = originalDst(conn)
+		if err != nil {
+			return
+		}
+	}
+
+	log.Infof("client: %v, target: %v", conn.RemoteAddr(), target)
+
+	tunnel, err := s.dialer.DialSocksAddr(socks_go.NewSocksAddrFromIP(target.IP), uint16(target.Port))
+	if err != nil {
+		return
+	}
+	defer tunnel.Close()
+
+	cr := util.BridgeReaderWriter(conn, tunnel)
+	cw := util.BridgeReaderWriter(tunnel, conn)
+
+	merr := util.NewMultipleErrors()
+	select {
+	case rerr := <-cr:
+		merr.Add("ReadClient", rerr)
+		merr.Add("WriteTunnel", <-cr)
+	case rerr := <-cw:
+		merr.Add("ReadTunnel", rerr)
+		merr.Add("WriteClient", <-cw)
+	}
+	err = merr.ToError()
+}
+
+func realMain() int {
+	// logging
+	defer log.Flush()
+	cmd.ConfigLogging()
+
+	// args
+	bindArg := flag.String("bind", ":1081", "bind on address")
+	proxyArg := flag.String("proxy", "127.0.0.1:1080", "socks5 proxy server, host:port or unix:/path/to/sock")
+	userArg := flag.String("user", "", "username for proxy server")
+	passwordArg := flag.String("password", "", "password for proxy server")
+	timeoutArg := flag.Int("timeout", 5000, "timeout in ms for connecting to proxy server")
+	tproxyArg := flag.Bool("tproxy", false, "accept connections from iptables TPROXY instead of REDIRECT")
+	udpArg := flag.Bool("udp", false, "relay udp packets from iptables TPROXY, requires -tproxy")
+	udpIdleArg := flag.Int("udp-idle", 60, "close udp association after seconds of inactivity, 0 means never")
+	debugArg := flag.String("debug", "127.0.0.1:6063", "http debug server")
+	flag.Parse()
+	proxyNetwork, proxyAddr := cmd.SplitNetworkAddr(*proxyArg)
+
+	if *udpArg && !*tproxyArg {
+		log.Errorf("-udp requires -tproxy")
+		return 1
+	}
+	if *udpIdleArg < 0 {
+		log.Errorf("bad -udp-idle: %d", *udpIdleArg)
+		return 1
+	}
+
+	cmd.StartDebugServer(*debugArg)
+
+	dialer := &socks_go.Dialer{
+		ProxyNetwork: proxyNetwork,
+		ProxyAddr:    proxyAddr,
+		Timeout:      time.Duration(*timeoutArg) * time.Millisecond,
+		AuthMethods:  cmd.ClientAuthMethods(*userArg, *passwordArg),
+	}
+
+	server := &redirServer{bind: *bindArg, tproxy: *tproxyArg, dialer: dialer}
+	errChan := make(chan error, 2)
+	go func() {
+		errChan <- server.runTCP()
+	}()
+	if *udpArg {
+		relay := &udpRelay{
+			bind:   *bindArg,
+			dialer: dialer,
+			idle:   time.Duration(*udpIdleArg) * time.Second,
+		}
+		go func() {
+			errChan <- relay.run()
+		}()
+	}
+
+	err := <-errChan
+	log.Errorf("server error: %v", err)
+	return 2
+}
+
+func main() {
+	os.Exit(realMain())
+}
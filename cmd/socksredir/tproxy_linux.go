@@ -0,0 +1,136 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// from linux/netfilter_ipv4.h, linux/netfilter_ipv6/ip6_tables.h and linux/in6.h
+const (
+	soOriginalDst       = 80
+	ip6tSoOriginalDst   = 80
+	ipv6Transparent     = 75
+	ipv6RecvOrigDstAddr = 74
+)
+
+// originalDst recovers the destination of a connection redirected by iptables REDIRECT.
+func originalDst(conn *net.TCPConn) (addr *net.TCPAddr, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	isV6 := conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	ctrlErr := raw.Control(func(fd uintptr) {
+		// getsockopt of typed results large enough for the sockaddr,
+		// raw getsockopt is a socketcall on some archs, e.g. linux/386
+		if isV6 {
+			var info *syscall.IPv6MTUInfo
+			info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst)
+			if err == nil {
+				sa := info.Addr
+				addr = &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: int(ntohs(sa.Port))}
+			}
+		} else {
+			var mreq *syscall.IPv6Mreq
+			mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if err == nil {
+				sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(mreq))
+				addr = &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: int(ntohs(sa.Port))}
+			}
+		}
+	})
+	if ctrlErr != nil {
+		err = ctrlErr
+	}
+	if err != nil {
+		err = errors.Wrap(err, "getsockopt(SO_ORIGINAL_DST) failed")
+	}
+	return
+}
+
+// port in sockaddr is in network byte order
+func ntohs(port uint16) uint16 {
+	buf := (*[2]byte)(unsafe.Pointer(&port))
+	return binary.BigEndian.Uint16(buf[:])
+}
+
+// transparentControl sets IP_TRANSPARENT on sockets, so they can accept
+// connections or packets for non-local addresses and send packets from them.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if sockErr != nil {
+			return
+		}
+
+		isV6 := network == "tcp6" || network == "udp6" || isV6Address(address)
+		if isV6 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		}
+		if sockErr != nil {
+			sockErr = errors.Wrap(sockErr, "can not set IP_TRANSPARENT")
+			return
+		}
+
+		if network == "udp" || network == "udp4" || network == "udp6" {
+			if isV6 {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+			} else {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func isV6Address(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// parseOrigDstAddr finds the original destination of an udp packet
+// from control messages of a socket with IP_RECVORIGDSTADDR set.
+func parseOrigDstAddr(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not parse control message")
+	}
+
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR:
+			var sa syscall.RawSockaddrInet4
+			if len(msg.Data) < int(unsafe.Sizeof(sa)) {
+				return nil, errors.Errorf("IP_ORIGDSTADDR too short: %d", len(msg.Data))
+			}
+			sa = *(*syscall.RawSockaddrInet4)(unsafe.Pointer(&msg.Data[0]))
+			return &net.UDPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: int(ntohs(sa.Port))}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr:
+			var sa syscall.RawSockaddrInet6
+			if len(msg.Data) < int(unsafe.Sizeof(sa)) {
+				return nil, errors.Errorf("IPV6_ORIGDSTADDR too short: %d", len(msg.Data))
+			}
+			sa = *(*syscall.RawSockaddrInet6)(unsafe.Pointer(&msg.Data[0]))
+			return &net.UDPAddr{IP: net.IP(sa.Addr[:]), Port: int(ntohs(sa.Port))}, nil
+		}
+	}
+	return nil, errors.New("original destination not found in control message")
+}
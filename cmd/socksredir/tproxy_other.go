@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+var errNotSupported = errors.New("transparent proxy is only supported on linux")
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errNotSupported
+}
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return errNotSupported
+}
+
+func parseOrigDstAddr(oob []byte) (*net.UDPAddr, error) {
+	return nil, errNotSupported
+}
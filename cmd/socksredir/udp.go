@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/account-login/socks_go"
+	"github.com/account-login/socks_go/cmd"
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// udpRelay relays packets from iptables TPROXY through udp associations,
+// one association per client address.
+type udpRelay struct {
+	bind   string
+	dialer *socks_go.Dialer
+	idle   time.Duration
+}
+
+func (r *udpRelay) run() error {
+	lc := net.ListenConfig{Control: transparentControl}
+	pc, err := lc.ListenPacket(context.Background(), "udp", r.bind)
+	if err != nil {
+		return errors.Wrapf(err, "udpRelay: listen(%q) error", r.bind)
+	}
+	conn := pc.(*net.UDPConn)
+	defer conn.Close()
+	log.Infof("udp relay started on %v", conn.LocalAddr())
+
+	sessions := &cmd.UDPSessions{
+		Dialer:  r.dialer,
+		Idle:    r.idle,
+		Reply:   replyFrom,
+		OnClose: closeReplyConns,
+	}
+	defer sessions.Close()
+
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, client, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return errors.Wrap(err, "udpRelay: ReadMsgUDP error")
+		}
+
+		target, err := parseOrigDstAddr(oob[:oobn])
+		if err != nil {
+			log.Errorf("client: %v, can not get original destination: %v", client, err)
+			continue
+		}
+
+		if !sessions.Send(client, buf[:n], socks_go.NewSocksAddrFromIP(target.IP), uint16(target.Port)) {
+			log.Warnf("client: %v, target: %v, udp association busy, drop packet", client, target)
+		}
+	}
+}
+
+// replyFrom sends the reply through a transparent socket bound to the remote address,
+// so that the client sees replies coming from where it sent the packet.
+// Sockets are kept in Data of session.
+func replyFrom(sess *cmd.UDPSession, data []byte, from *net.UDPAddr) error {
+	conns, _ := sess.Data.(map[string]*net.UDPConn)
+	if conns == nil {
+		conns = make(map[string]*net.UDPConn)
+		sess.Data = conns
+	}
+
+	key := from.String()
+	conn, ok := conns[key]
+	if !ok {
+		lc := net.ListenConfig{Control: transparentControl}
+		pc, err := lc.ListenPacket(context.Background(), "udp", key)
+		if err != nil {
+			return errors.Wrapf(err, "can not bind reply socket on %v", key)
+		}
+		conn = pc.(*net.UDPConn)
+		conns[key] = conn
+	}
+
+	_, err := conn.WriteToUDP(data, sess.Peer)
+	return err
+}
+
+func closeReplyConns(sess *cmd.UDPSession) {
+	conns, _ := sess.Data.(map[string]*net.UDPConn)
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
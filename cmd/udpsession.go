@@ -0,0 +1,251 @@
+package cmd
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/account-login/socks_go"
+	log "github.com/cihub/seelog"
+)
+
+// UDPSessions relays datagrams of local peers through udp associations, one per peer.
+// Associations are created by the goroutine of each session, so the reader of local
+// socket is never blocked by proxy server.
+type UDPSessions struct {
+	Dialer *socks_go.Dialer
+	// sessions without datagrams in either direction for longer are closed, zero means never
+	Idle time.Duration
+	// writes a datagram from tunnel to the peer
+	Reply func(sess *UDPSession, data []byte, from *net.UDPAddr) error
+	// optional, called after the last Reply of a session with association
+	OnClose func(sess *UDPSession)
+
+	initOnce sync.Once
+	mu       sync.Mutex
+	sessions map[string]*UDPSession
+	closed   bool
+	done     chan struct{}
+}
+
+// UDPSession is the udp association of a local peer.
+type UDPSession struct {
+	// first field for 64-bit atomic alignment on 32-bit platforms
+	lastActive int64 // unix nano
+
+	Peer *net.UDPAddr
+	// state of caller, used by Reply and OnClose, which are called by the same goroutine
+	Data interface{}
+
+	key    string
+	queue  chan udpDatagram
+	done   chan struct{}
+	mu     sync.Mutex
+	tunnel *socks_go.ClientUDPTunnel
+}
+
+type udpDatagram struct {
+	data []byte
+	addr socks_go.SocksAddr
+	port uint16
+}
+
+// datagrams queued while the association is being created, further ones are dropped
+const udpSessionQueueLen = 64
+
+func (s *UDPSessions) init() {
+	s.initOnce.Do(func() {
+		s.sessions = make(map[string]*UDPSession)
+		s.done = make(chan struct{})
+		if s.Idle > 0 {
+			go s.expire()
+		}
+	})
+}
+
+// Send queues a copy of data from peer to addr:port, creates the session of peer if none.
+// Returns false if dropped.
+func (s *UDPSessions) Send(peer *net.UDPAddr, data []byte, addr socks_go.SocksAddr, port uint16) bool {
+	sess := s.get(peer)
+	if sess == nil {
+		return false
+	}
+	sess.touch()
+
+	select {
+	case sess.queue <- udpDatagram{append([]byte(nil), data...), addr, port}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *UDPSessions) get(peer *net.UDPAddr) *UDPSession {
+	s.init()
+	key := peer.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	if sess, ok := s.sessions[key]; ok {
+		return sess
+	}
+	sess := &UDPSession{
+		Peer:  peer,
+		key:   key,
+		queue: make(chan udpDatagram, udpSessionQueueLen),
+		done:  make(chan struct{}),
+	}
+	sess.touch()
+	s.sessions[key] = sess
+	go s.run(sess)
+	return sess
+}
+
+// run creates the association and forwards queued datagrams until the session closed.
+func (s *UDPSessions) run(sess *UDPSession) {
+	tunnel, err := s.Dialer.UDPAssociation()
+	if err != nil {
+		log.Errorf("peer: %v, can not create udp association: %v", sess.Peer, err)
+		s.remove(sess)
+		return
+	}
+
+	sess.mu.Lock()
+	select {
+	case <-sess.done:
+		sess.mu.Unlock()
+		tunnel.Close()
+		return
+	default:
+	}
+	sess.tunnel = tunnel
+	sess.mu.Unlock()
+
+	log.Debugf("peer: %v, udp association created, server bind: %v:%d", sess.Peer, tunnel.BindAddr, tunnel.BindPort)
+	go s.receive(sess, tunnel)
+
+	for {
+		select {
+		case dg := <-sess.queue:
+			if _, err = tunnel.WriteToSocksAddr(dg.data, dg.addr, dg.port); err != nil {
+				log.Errorf("peer: %v, target: %v:%d, write to tunnel error: %v", sess.Peer, dg.addr, dg.port, err)
+				s.remove(sess)
+				return
+			}
+		case <-sess.done:
+			return
+		}
+	}
+}
+
+// receive forwards replies from tunnel to peer
+func (s *UDPSessions) receive(sess *UDPSession, tunnel *socks_go.ClientUDPTunnel) {
+	defer func() {
+		s.remove(sess)
+		if s.OnClose != nil {
+			s.OnClose(sess)
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := tunnel.ReadFrom(buf)
+		if err != nil {
+			log.Debugf("peer: %v, udp association finished: %v", sess.Peer, err)
+			return
+		}
+		sess.touch()
+
+		fromAddr, _ := from.(*net.UDPAddr)
+		if err = s.Reply(sess, buf[:n], fromAddr); err != nil {
+			log.Errorf("peer: %v, from: %v, write reply error: %v", sess.Peer, from, err)
+		}
+	}
+}
+
+func (s *UDPSessions) remove(sess *UDPSession) {
+	s.mu.Lock()
+	if s.sessions[sess.key] == sess {
+		delete(s.sessions, sess.key)
+	}
+	s.mu.Unlock()
+
+	sess.close()
+}
+
+func (s *UDPSessions) expire() {
+	ticker := time.NewTicker(s.Idle / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		var expired []*UDPSession
+		s.mu.Lock()
+		for _, sess := range s.sessions {
+			if time.Since(sess.idleSince()) > s.Idle {
+				expired = append(expired, sess)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, sess := range expired {
+			log.Debugf("peer: %v, udp association expired", sess.Peer)
+			s.remove(sess)
+		}
+	}
+}
+
+// Close closes all sessions, datagrams sent later are dropped.
+func (s *UDPSessions) Close() {
+	s.init()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	sessions := s.sessions
+	s.sessions = make(map[string]*UDPSession)
+	s.mu.Unlock()
+
+	close(s.done)
+	for _, sess := range sessions {
+		sess.close()
+	}
+}
+
+func (sess *UDPSession) touch() {
+	atomic.StoreInt64(&sess.lastActive, time.Now().UnixNano())
+}
+
+func (sess *UDPSession) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&sess.lastActive))
+}
+
+func (sess *UDPSession) close() {
+	sess.mu.Lock()
+	select {
+	case <-sess.done:
+		sess.mu.Unlock()
+		return
+	default:
+	}
+	close(sess.done)
+	tunnel := sess.tunnel
+	sess.mu.Unlock()
+
+	if tunnel != nil {
+		tunnel.Close()
+	}
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/account-login/socks_go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startUDPEcho(t *testing.T) *net.UDPConn {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	return echo
+}
+
+func (s *UDPSessions) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+func TestUDPSessions(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &socks_go.Server{}
+	go server.Serve(listener)
+	defer server.Close()
+	dialer := &socks_go.Dialer{ProxyAddr: listener.Addr().String(), Timeout: 3 * time.Second}
+
+	type reply struct {
+		peer *net.UDPAddr
+		data string
+	}
+	replies := make(chan reply, 10)
+	closed := make(chan *UDPSession, 10)
+	sessions := &UDPSessions{
+		Dialer: dialer,
+		Idle:   200 * time.Millisecond,
+		Reply: func(sess *UDPSession, data []byte, from *net.UDPAddr) error {
+			replies <- reply{sess.Peer, string(data)}
+			return nil
+		},
+		OnClose: func(sess *UDPSession) {
+			closed <- sess
+		},
+	}
+	defer sessions.Close()
+
+	peerA, peerB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2}
+	target := socks_go.NewSocksAddrFromIP(echoAddr.IP)
+	// queued until the association is created
+	require.True(t, sessions.Send(peerA, []byte("a1"), target, uint16(echoAddr.Port)))
+	require.True(t, sessions.Send(peerA, []byte("a2"), target, uint16(echoAddr.Port)))
+	require.True(t, sessions.Send(peerB, []byte("b1"), target, uint16(echoAddr.Port)))
+
+	got := make(map[string]*net.UDPAddr)
+	for i := 0; i < 3; i++ {
+		select {
+		case r := <-replies:
+			got[r.data] = r.peer
+		case <-time.After(3 * time.Second):
+			t.Fatal("reply timeout")
+		}
+	}
+	assert.Equal(t, map[string]*net.UDPAddr{"a1": peerA, "a2": peerA, "b1": peerB}, got)
+	assert.Equal(t, 2, sessions.count())
+
+	// expired
+	assert.Eventually(t, func() bool {
+		return sessions.count() == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-closed:
+		case <-time.After(3 * time.Second):
+			t.Fatal("OnClose not called")
+		}
+	}
+
+	// never expired
+	forever := &UDPSessions{Dialer: dialer, Reply: sessions.Reply}
+	require.True(t, forever.Send(peerA, []byte("a3"), target, uint16(echoAddr.Port)))
+	<-replies
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, forever.count())
+	forever.Close()
+	assert.Zero(t, forever.count())
+	assert.False(t, forever.Send(peerA, []byte("a4"), target, uint16(echoAddr.Port)))
+}
+
+func TestUDPSessions_SlowProxy(t *testing.T) {
+	// accepts but never replies
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	sessions := &UDPSessions{
+		Dialer: &socks_go.Dialer{ProxyAddr: listener.Addr().String(), Timeout: 3 * time.Second},
+		Reply: func(sess *UDPSession, data []byte, from *net.UDPAddr) error {
+			return nil
+		},
+	}
+	defer sessions.Close()
+
+	// the sender is not blocked, datagrams beyond the queue are dropped
+	target := socks_go.NewSocksAddrFromString("example.com")
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1}
+		for j := 0; j < udpSessionQueueLen; j++ {
+			assert.True(t, sessions.Send(peer, []byte("x"), target, 53))
+		}
+		assert.False(t, sessions.Send(peer, []byte("x"), target, 53))
+	}
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 4, sessions.count())
+}
@@ -2,10 +2,10 @@ package socks_go
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
-
-	"bytes"
+	"strings"
 
 	"github.com/account-login/socks_go/util"
 	"github.com/pkg/errors"
@@ -49,23 +49,56 @@ func NewSocksAddrFromString(addr string) SocksAddr {
 	}
 }
 
-func (sa SocksAddr) ToBytes() (data []byte) {
-	data = append(data, sa.Type)
+func (sa SocksAddr) ToBytes() (data []byte, err error) {
+	return AppendSocksAddr(nil, sa)
+}
+
+// AppendSocksAddr appends the encoded addr to dst, dst is returned unchanged on error.
+func AppendSocksAddr(dst []byte, sa SocksAddr) ([]byte, error) {
 	switch sa.Type {
 	case ATypeIPV4:
-		data = append(data, sa.IP.To4()...)
+		ip := sa.IP.To4()
+		if ip == nil {
+			return dst, &AddrError{sa, "not an ipv4 address"}
+		}
+		dst = append(dst, sa.Type)
+		dst = append(dst, ip...)
 	case ATypeIPV6:
-		data = append(data, sa.IP.To16()...)
+		ip := sa.IP.To16()
+		if ip == nil {
+			return dst, &AddrError{sa, "not an ipv6 address"}
+		}
+		dst = append(dst, sa.Type)
+		dst = append(dst, ip...)
 	case ATypeDomain:
-		if len(sa.Domain) > 256 {
-			panic("domain name to long")
+		if len(sa.Domain) == 0 || len(sa.Domain) > 255 {
+			return dst, &AddrError{sa, "domain name length not in 1-255"}
 		}
-		data = append(data, byte(len(sa.Domain)))
-		data = append(data, sa.Domain...)
+		dst = append(dst, sa.Type, byte(len(sa.Domain)))
+		dst = append(dst, sa.Domain...)
 	default:
-		panic("bad atype")
+		return dst, &AddrError{sa, "bad atype"}
 	}
-	return
+	return dst, nil
+}
+
+// encodedLen returns the size of encoded addr, or 0 if it can not be encoded.
+func (sa SocksAddr) encodedLen() int {
+	switch sa.Type {
+	case ATypeIPV4:
+		if sa.IP.To4() != nil {
+			return 1 + net.IPv4len
+		}
+	case ATypeIPV6:
+		if sa.IP.To16() != nil {
+			return 1 + net.IPv6len
+		}
+	case ATypeDomain:
+		if len(sa.Domain) > 0 && len(sa.Domain) <= 255 {
+			return 2 + len(sa.Domain)
+		}
+	}
+	return 0
 }
 
 func (sa SocksAddr) String() string {
@@ -75,15 +108,52 @@ func (sa SocksAddr) String() string {
 	case ATypeDomain:
 		return sa.Domain
 	default:
-		panic("bad atype")
+		return fmt.Sprintf("<bad atype %#x>", sa.Type)
+	}
+}
+
+// AddrError is returned when SocksAddr can not be encoded.
+type AddrError struct {
+	Addr   SocksAddr
+	Reason string
+}
+
+func (e *AddrError) Error() string {
+	return fmt.Sprintf("bad socks addr %v: %s", e.Addr, e.Reason)
+}
+
+// StateError is returned when protocol methods are called in wrong order,
+// the state of protocol is not changed.
+type StateError struct {
+	Op string
+	// ServerState or ClientState
+	State   fmt.Stringer
+	Expects []fmt.Stringer
+}
+
+func (e *StateError) Error() string {
+	expects := make([]string, 0, len(e.Expects))
+	for _, expect := range e.Expects {
+		expects = append(expects, expect.String())
 	}
+	return fmt.Sprintf("%s: bad state %v, expect %s", e.Op, e.State, strings.Join(expects, " or "))
 }
 
+const (
+	// atype, domain length and domain
+	maxSocksAddrLen = 1 + 1 + 255
+	// ver, cmd or reply, rsv, addr and port
+	maxRequestLen = 3 + maxSocksAddrLen + 2
+	// rsv, frag, addr and port
+	maxUDPHeaderLen = 3 + maxSocksAddrLen + 2
+)
+
 const (
 	MethodNone         byte = 0
 	MethodGSSApi       byte = 1
 	MethodUserName     byte = 2
 	MethodPrivateBegin byte = 0x80
+	MethodPrivateEnd   byte = 0xfe
 	MethodReject       byte = 0xff
 )
 
@@ -91,6 +161,13 @@ const (
 	CmdConnect byte = 1
 	CmdBind    byte = 2
 	CmdUDP     byte = 3
+	// private command, udp datagrams are carried by the tcp connection, see udp_tcp.go
+	CmdUDPOverTCP byte = 0x83
+	// private command, streams of requests are multiplexed on the tcp connection, see mux.go
+	CmdMux byte = 0x84
+	// tor extensions, the reply carries the resolved address
+	CmdResolve    byte = 0xf0
+	CmdResolvePTR byte = 0xf1
 )
 
 const (
@@ -100,26 +177,33 @@ const (
 )
 
 const (
-	ReplyOK              byte = 0
-	ReplyFail            byte = 1
-	ReplyCmdNotSupported byte = 7
+	ReplyOK                byte = 0
+	ReplyFail              byte = 1
+	ReplyNotAllowed        byte = 2
+	ReplyNetUnreachable    byte = 3
+	ReplyHostUnreachable   byte = 4
+	ReplyConnRefused       byte = 5
+	ReplyTTLExpired        byte = 6
+	ReplyCmdNotSupported   byte = 7
+	ReplyATypeNotSupported byte = 8
 )
 
-func readSocksAddr(atype byte, reader io.Reader) (addr SocksAddr, err error) {
+// readSocksAddr reads addr with buf as scratch space, buf is allocated if too small.
+func readSocksAddr(atype byte, reader io.Reader, buf []byte) (addr SocksAddr, err error) {
 	switch atype {
-	case ATypeIPV4:
-		addr.IP, err = util.ReadRequired(reader, 4)
-		if err != nil {
-			return
+	case ATypeIPV4, ATypeIPV6:
+		ipLen := net.IPv4len
+		if atype == ATypeIPV6 {
+			ipLen = net.IPv6len
 		}
-	case ATypeIPV6:
-		addr.IP, err = util.ReadRequired(reader, 16)
+		buf, err = util.ReadRequiredBuf(reader, buf, ipLen)
 		if err != nil {
 			return
 		}
+		// copied since buf is reused by caller
+		addr.IP = append(net.IP(nil), buf...)
 	case ATypeDomain:
-		var buf []byte
-		buf, err = util.ReadRequired(reader, 1)
+		buf, err = util.ReadRequiredBuf(reader, buf, 1)
 		if err != nil {
 			return
 		}
@@ -129,7 +213,7 @@ func readSocksAddr(atype byte, reader io.Reader) (addr SocksAddr, err error) {
 			return
 		}
 
-		buf, err = util.ReadRequired(reader, int(domainLen))
+		buf, err = util.ReadRequiredBuf(reader, buf, int(domainLen))
 		if err != nil {
 			return
 		}
@@ -144,10 +228,49 @@ func readSocksAddr(atype byte, reader io.Reader) (addr SocksAddr, err error) {
 	return
 }
 
-func readRequestOrReply(reader io.Reader) (cmdOrRep byte, addr SocksAddr, port uint16, err error) {
-	var buf []byte
+// parseSocksAddr parses addr in place, addr.IP refers to buf.
+func parseSocksAddr(atype byte, buf []byte) (addr SocksAddr, n int, err error) {
+	switch atype {
+	case ATypeIPV4, ATypeIPV6:
+		n = net.IPv4len
+		if atype == ATypeIPV6 {
+			n = net.IPv6len
+		}
+		if len(buf) < n {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		addr.IP = net.IP(buf[:n:n])
+	case ATypeDomain:
+		if len(buf) < 1 {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		domainLen := int(buf[0])
+		if domainLen == 0 {
+			err = errors.New("zero length domain")
+			return
+		}
+		n = 1 + domainLen
+		if len(buf) < n {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		addr.Domain = string(buf[1:n])
+	default:
+		err = errors.Errorf("bad addr type: %#x", atype)
+		return
+	}
+
+	addr.Type = atype
+	return
+}
+
+// readRequestOrReply reads with buf as scratch space, buf is allocated if too small.
+func readRequestOrReply(reader io.Reader, buf []byte) (cmdOrRep byte, addr SocksAddr, port uint16, err error) {
+	scratch := buf
 	// ver
-	buf, err = util.ReadRequired(reader, 4)
+	buf, err = util.ReadRequiredBuf(reader, scratch, 4)
 	if err != nil {
 		err = errors.Wrap(err, "readRequestOrReply: can not read header")
 		return
@@ -164,14 +287,14 @@ func readRequestOrReply(reader io.Reader) (cmdOrRep byte, addr SocksAddr, port u
 
 	// addr
 	atype := buf[3]
-	addr, err = readSocksAddr(atype, reader)
+	addr, err = readSocksAddr(atype, reader, scratch)
 	if err != nil {
 		err = errors.Wrap(err, "readSocksAddr() failed")
 		return
 	}
 
 	// port
-	buf, err = util.ReadRequired(reader, 2)
+	buf, err = util.ReadRequiredBuf(reader, scratch, 2)
 	if err != nil {
 		err = errors.Wrap(err, "can not read port")
 		return
@@ -181,17 +304,28 @@ func readRequestOrReply(reader io.Reader) (cmdOrRep byte, addr SocksAddr, port u
 	return
 }
 
-func writeResponseOrRequest(writer io.Writer, replyOrCmd byte, addr SocksAddr, port uint16) (err error) {
-	data := make([]byte, 0, 10)
-	data = append(data, 0x05, replyOrCmd, 0)
-	data = append(data, addr.ToBytes()...)
-	data = append(data, 0, 0)
-	binary.BigEndian.PutUint16(data[len(data)-2:], port)
+// appendResponseOrRequest appends the encoded request or reply to dst.
+func appendResponseOrRequest(dst []byte, replyOrCmd byte, addr SocksAddr, port uint16) ([]byte, error) {
+	dst = append(dst, 0x05, replyOrCmd, 0)
+	dst, err := AppendSocksAddr(dst, addr)
+	if err != nil {
+		return dst[:len(dst)-3], err
+	}
+	return append(dst, byte(port>>8), byte(port)), nil
+}
+
+// writeResponseOrRequest encodes into buf if it is large enough.
+func writeResponseOrRequest(writer io.Writer, buf []byte, replyOrCmd byte, addr SocksAddr, port uint16) (err error) {
+	data, err := appendResponseOrRequest(buf[:0], replyOrCmd, addr, port)
+	if err != nil {
+		return
+	}
 
 	_, err = writer.Write(data)
 	return
 }
 
+// ParseUDPMsg parses msg in place, addr.IP and data refer to msg.
 func ParseUDPMsg(msg []byte) (addr SocksAddr, port uint16, data []byte, err error) {
 	if len(msg) < 4+4+2 {
 		err = errors.Errorf("udp request to short. size: %d", len(msg))
@@ -202,36 +336,59 @@ func ParseUDPMsg(msg []byte) (addr SocksAddr, port uint16, data []byte, err erro
 	frag := msg[2]
 	if frag != 0 {
 		err = errors.Errorf("FRAG field not supported. frag: %d", frag)
+		return
 	}
 
 	// dst addr
-	reader := bytes.NewReader(msg[4:])
-	addr, err = readSocksAddr(msg[3], reader)
+	addr, n, err := parseSocksAddr(msg[3], msg[4:])
 	if err != nil {
 		err = errors.Wrapf(err, "can not read SocksAddr")
 		return
 	}
 
 	// dst port
-	var buf []byte
-	buf, err = util.ReadRequired(reader, 2)
-	if err != nil {
-		err = errors.Wrap(err, "can not read port")
+	rest := msg[4+n:]
+	if len(rest) < 2 {
+		err = errors.Wrap(io.ErrUnexpectedEOF, "can not read port")
 		return
 	}
-	port = binary.BigEndian.Uint16(buf)
+	port = binary.BigEndian.Uint16(rest)
 
-	data = make([]byte, reader.Len())
-	_, err = reader.Read(data) // err must be nil
+	data = rest[2:]
 	return
 }
 
-func MakeUDPMsg(addr SocksAddr, port uint16, data []byte) (msg []byte) {
-	msg = make([]byte, 0, 10+len(data))
-	msg = append(msg, 0, 0, 0)
-	msg = append(msg, addr.ToBytes()...)
-	msg = append(msg, 0, 0)
-	binary.BigEndian.PutUint16(msg[len(msg)-2:], port)
-	msg = append(msg, data...)
+func MakeUDPMsg(addr SocksAddr, port uint16, data []byte) (msg []byte, err error) {
+	msg, err = AppendUDPMsg(make([]byte, 0, udpHeaderLen(addr)+len(data)), addr, port, data)
+	if err != nil {
+		return nil, err
+	}
 	return
 }
+
+// AppendUDPMsg appends the udp datagram with header to dst.
+func AppendUDPMsg(dst []byte, addr SocksAddr, port uint16, data []byte) ([]byte, error) {
+	dst, err := appendUDPHeader(dst, addr, port)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, data...), nil
+}
+
+func appendUDPHeader(dst []byte, addr SocksAddr, port uint16) ([]byte, error) {
+	dst = append(dst, 0, 0, 0)
+	dst, err := AppendSocksAddr(dst, addr)
+	if err != nil {
+		return dst[:len(dst)-3], err
+	}
+	return append(dst, byte(port>>8), byte(port)), nil
+}
+
+// udpHeaderLen returns the header size of udp datagram, or 0 if addr can not be encoded.
+func udpHeaderLen(addr SocksAddr) int {
+	n := addr.encodedLen()
+	if n == 0 {
+		return 0
+	}
+	return 3 + n + 2
+}
@@ -10,23 +10,26 @@ import (
 )
 
 func TestSocksAddr_ToBytes(t *testing.T) {
-	assert.Equal(t,
-		[]byte{0x03, 4, 'a', 's', 'd', 'f'},
-		NewSocksAddrFromDomain("asdf").ToBytes())
-	assert.Equal(t,
-		[]byte{0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
-		NewSocksAddrFromIPV6(net.IPv6loopback).ToBytes())
+	data, err := NewSocksAddrFromDomain("asdf").ToBytes()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x03, 4, 'a', 's', 'd', 'f'}, data)
+
+	data, err = NewSocksAddrFromIPV6(net.IPv6loopback).ToBytes()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, data)
 }
 
 func TestReadSocksAddr(t *testing.T) {
 	buf := []byte{0x03, 4, 'a', 's', 'd', 'f'}
-	sa, err := readSocksAddr(buf[0], bytes.NewReader(buf[1:]))
+	sa, err := readSocksAddr(buf[0], bytes.NewReader(buf[1:]), nil)
 	require.NoError(t, err)
 	assert.Equal(t, NewSocksAddrFromDomain("asdf"), sa)
 }
 
 func doUDPProtocolTest(t *testing.T, addr SocksAddr, port uint16, data []byte, msg []byte) {
-	assert.Equal(t, msg, MakeUDPMsg(addr, port, data))
+	packed, err := MakeUDPMsg(addr, port, data)
+	require.NoError(t, err)
+	assert.Equal(t, msg, packed)
 
 	paddr, pport, pdata, err := ParseUDPMsg(msg)
 	require.NoError(t, err)
@@ -41,3 +44,111 @@ func TestUDPProtocol(t *testing.T) {
 		[]byte{0, 0, 0, 0x01, 0x7f, 0, 0, 1, 0x12, 0x34, 0x56},
 	)
 }
+
+func TestSocksAddr_ToBytesError(t *testing.T) {
+	for _, sa := range []SocksAddr{
+		{Type: ATypeIPV4, IP: net.IP{1, 2, 3}},
+		{Type: ATypeIPV6, IP: net.IP{1, 2, 3}},
+		NewSocksAddrFromDomain(""),
+		NewSocksAddrFromDomain(string(make([]byte, 256))),
+		{Type: 0x7f},
+	} {
+		_, err := sa.ToBytes()
+		assert.IsType(t, &AddrError{}, err, "%#v", sa)
+	}
+
+	_, err := MakeUDPMsg(SocksAddr{Type: 0x7f}, 0, nil)
+	assert.Error(t, err)
+	assert.Equal(t, "<bad atype 0x7f>", SocksAddr{Type: 0x7f}.String())
+}
+
+func TestParseUDPMsg_InPlace(t *testing.T) {
+	msg := []byte{0, 0, 0, 0x01, 0x7f, 0, 0, 1, 0x12, 0x34, 'a', 'b'}
+	addr, port, data, err := ParseUDPMsg(msg)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", addr.String())
+	assert.Equal(t, uint16(0x1234), port)
+	assert.Equal(t, []byte("ab"), data)
+	// refer to msg
+	assert.True(t, &msg[10] == &data[0])
+	assert.True(t, &msg[4] == &addr.IP[0])
+
+	for _, bad := range [][]byte{
+		{0, 0, 0, 0x01, 0x7f, 0, 0, 1, 0x12},
+		{0, 0, 0, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0x03, 10, 'a', 'b', 'c', 0, 0},
+		{0, 0, 0, 0x03, 0, 'a', 'b', 'c', 0, 0},
+		{0, 0, 1, 0x01, 0x7f, 0, 0, 1, 0x12, 0x34},
+	} {
+		_, _, _, err = ParseUDPMsg(bad)
+		assert.Error(t, err, "%v", bad)
+	}
+}
+
+func TestAppendUDPMsg(t *testing.T) {
+	dst := []byte{'x'}
+	dst, err := AppendUDPMsg(dst, NewSocksAddrFromDomain("ab"), 0x1234, []byte{0x56})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{'x', 0, 0, 0, 0x03, 2, 'a', 'b', 0x12, 0x34, 0x56}, dst)
+	assert.Equal(t, len(dst)-2, udpHeaderLen(NewSocksAddrFromDomain("ab")))
+
+	// dst is kept on error
+	dst, err = AppendUDPMsg(dst[:1], SocksAddr{Type: 0x7f}, 0, []byte{0x56})
+	assert.Error(t, err)
+	assert.Equal(t, []byte{'x'}, dst)
+}
+
+func TestReadRequestOrReply_Allocs(t *testing.T) {
+	req := []byte{0x05, CmdConnect, 0, 0x01, 1, 2, 3, 4, 0x12, 0x34}
+	reader := bytes.NewReader(req)
+	var buf [maxRequestLen]byte
+
+	allocs := testing.AllocsPerRun(100, func() {
+		reader.Reset(req)
+		_, _, _, err := readRequestOrReply(reader, buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	// the returned ip
+	assert.Equal(t, 1.0, allocs)
+}
+
+func BenchmarkParseUDPMsg(b *testing.B) {
+	msg, err := MakeUDPMsg(NewSocksAddrFromString("127.0.0.1"), 53, make([]byte, 1200))
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := ParseUDPMsg(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendUDPMsg(b *testing.B) {
+	addr := NewSocksAddrFromString("127.0.0.1")
+	data := make([]byte, 1200)
+	buf := make([]byte, 0, maxUDPHeaderLen+len(data))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := AppendUDPMsg(buf[:0], addr, 53, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadRequestOrReply(b *testing.B) {
+	req := []byte{0x05, CmdConnect, 0, 0x03, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 80}
+	reader := bytes.NewReader(req)
+	var buf [maxRequestLen]byte
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(req)
+		if _, _, _, err := readRequestOrReply(reader, buf[:]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
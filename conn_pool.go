@@ -0,0 +1,187 @@
+package socks_go
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// connPool keeps connections to proxy server authenticated and parked before the request,
+// so a tunnel costs one round trip. Each parked connection is watched by a blocking read,
+// nothing is expected from server until the request, so the read returns only when the
+// connection is broken, expires or is taken.
+type connPool struct {
+	d *Dialer
+
+	mu      sync.Mutex
+	idle    []*pooledConn
+	dialing int
+	closed  bool
+}
+
+type pooledConn struct {
+	conn   net.Conn
+	client *Client
+	// zero if no PoolMaxAge
+	expires time.Time
+	// set by get, under connPool.mu
+	taken bool
+	// result of watch, valid after watchDone closed
+	healthy   bool
+	watchDone chan struct{}
+}
+
+// a deadline in the past interrupts the read of watch
+var pastDeadline = time.Unix(1, 0)
+
+// get takes a healthy connection with Timeout applied, nil if none.
+func (p *connPool) get() (conn net.Conn, client *Client) {
+	defer p.refill()
+
+	for {
+		pc := p.take()
+		if pc == nil {
+			return nil, nil
+		}
+
+		_ = pc.conn.SetReadDeadline(pastDeadline)
+		<-pc.watchDone
+		if !pc.healthy {
+			pc.conn.Close()
+			continue
+		}
+
+		if p.d.Timeout > 0 {
+			_ = pc.conn.SetDeadline(time.Now().Add(p.d.Timeout))
+		} else {
+			_ = pc.conn.SetReadDeadline(time.Time{})
+		}
+		return pc.conn, pc.client
+	}
+}
+
+// take removes the first unexpired connection from idle, expired ones are closed.
+// The age is checked under the same lock as watch, so a connection is either
+// taken or expired, never both.
+func (p *connPool) take() *pooledConn {
+	var expired []*pooledConn
+	defer func() {
+		// watch removes nothing from idle for taken ones
+		for _, pc := range expired {
+			pc.conn.Close()
+		}
+	}()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for len(p.idle) > 0 {
+		pc := p.idle[0]
+		p.idle = p.idle[1:]
+		pc.taken = true
+		if !pc.expires.IsZero() && !now.Before(pc.expires) {
+			expired = append(expired, pc)
+			continue
+		}
+		return pc
+	}
+	return nil
+}
+
+// refill connects in background until PoolSize connections are parked or being prepared.
+func (p *connPool) refill() {
+	p.mu.Lock()
+	n := p.d.PoolSize - len(p.idle) - p.dialing
+	if p.closed || n <= 0 {
+		p.mu.Unlock()
+		return
+	}
+	p.dialing += n
+	p.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		go p.prepare()
+	}
+}
+
+// prepare connects and authenticates a connection, failures are not retried until next get.
+func (p *connPool) prepare() {
+	conn, client, err := p.d.connect()
+	if err == nil {
+		if err = client.doAuth(); err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		p.mu.Lock()
+		p.dialing--
+		p.mu.Unlock()
+		log.Warnf("can not prepare connection to proxy %v: %v", p.d.ProxyAddr, err)
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	pc := &pooledConn{conn: conn, client: client, watchDone: make(chan struct{})}
+	if p.d.PoolMaxAge > 0 {
+		pc.expires = time.Now().Add(p.d.PoolMaxAge)
+		_ = conn.SetReadDeadline(pc.expires)
+	}
+
+	p.mu.Lock()
+	p.dialing--
+	if p.closed {
+		p.mu.Unlock()
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, pc)
+	p.mu.Unlock()
+
+	go p.watch(pc)
+}
+
+func (p *connPool) watch(pc *pooledConn) {
+	var b [1]byte
+	n, err := pc.conn.Read(b[:])
+
+	p.mu.Lock()
+	taken := pc.taken
+	if !taken {
+		for i := range p.idle {
+			if p.idle[i] == pc {
+				p.idle = append(p.idle[:i], p.idle[i+1:]...)
+				break
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	if taken {
+		// interrupted by get, anything else leaves the connection unusable
+		netErr, ok := err.(net.Error)
+		pc.healthy = n == 0 && ok && netErr.Timeout()
+		close(pc.watchDone)
+		return
+	}
+
+	log.Debugf("parked connection to proxy %v dropped, read: %d, err: %v", p.d.ProxyAddr, n, err)
+	pc.conn.Close()
+	close(pc.watchDone)
+	p.refill()
+}
+
+// close closes parked connections, connections being prepared are closed when done.
+func (p *connPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	for _, pc := range idle {
+		pc.conn.Close()
+	}
+}
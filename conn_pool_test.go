@@ -0,0 +1,166 @@
+package socks_go
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func poolIdle(p *connPool) (idle int, dialing int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle), p.dialing
+}
+
+func TestDialer_Pool(t *testing.T) {
+	target := startEchoTarget(t)
+	defer target.Close()
+
+	server := &Server{}
+	defer server.Close()
+	dialer := startServer(t, server)
+	dialer.PoolSize = 2
+
+	dial := func() {
+		conn, err := dialer.Dial("tcp", target.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		data, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+	}
+	waitFull := func() {
+		assert.Eventually(t, func() bool {
+			idle, dialing := poolIdle(dialer.connPool())
+			return idle == 2 && dialing == 0
+		}, 3*time.Second, 10*time.Millisecond)
+	}
+
+	// the first one is not pooled
+	dial()
+	waitFull()
+	assert.Equal(t, int64(3), server.Stats().Accepted)
+
+	// a parked one is taken and replaced
+	dial()
+	waitFull()
+	assert.Equal(t, int64(4), server.Stats().Accepted)
+
+	require.NoError(t, dialer.Close())
+	idle, _ := poolIdle(dialer.connPool())
+	assert.Zero(t, idle)
+	dial()
+	idle, dialing := poolIdle(dialer.connPool())
+	assert.Zero(t, idle+dialing)
+}
+
+func TestDialer_PoolDropped(t *testing.T) {
+	target := startEchoTarget(t)
+	defer target.Close()
+
+	// parked connections are closed by server
+	server := &Server{HandshakeTimeout: 50 * time.Millisecond}
+	defer server.Close()
+	dialer := startServer(t, server)
+	dialer.PoolSize = 1
+	defer dialer.Close()
+
+	conn, err := dialer.Dial("tcp", target.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		return server.Stats().Accepted >= 4
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestDialer_PoolMaxAge(t *testing.T) {
+	target := startEchoTarget(t)
+	defer target.Close()
+
+	server := &Server{}
+	defer server.Close()
+	dialer := startServer(t, server)
+	dialer.PoolSize = 1
+	dialer.PoolMaxAge = 50 * time.Millisecond
+	defer dialer.Close()
+
+	conn, err := dialer.Dial("tcp", target.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		return server.Stats().Accepted >= 4
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// replaced ones are usable
+	conn, err = dialer.Dial("tcp", target.Addr().String())
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	conn.Close()
+}
+
+func TestDialer_FillPool(t *testing.T) {
+	target := startEchoTarget(t)
+	defer target.Close()
+
+	server := &Server{}
+	defer server.Close()
+	dialer := startServer(t, server)
+	dialer.PoolSize = 2
+	defer dialer.Close()
+
+	dialer.FillPool()
+	assert.Eventually(t, func() bool {
+		idle, dialing := poolIdle(dialer.connPool())
+		return idle == 2 && dialing == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(2), server.Stats().Accepted)
+
+	// the first one is pooled
+	conn, err := dialer.Dial("tcp", target.Addr().String())
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		return server.Stats().Accepted == 3
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestDialer_PoolTakeExpired(t *testing.T) {
+	target := startEchoTarget(t)
+	defer target.Close()
+
+	server := &Server{}
+	defer server.Close()
+	dialer := startServer(t, server)
+	dialer.PoolSize = 2
+	dialer.PoolMaxAge = time.Hour
+	defer dialer.Close()
+
+	p := dialer.connPool()
+	p.refill()
+	assert.Eventually(t, func() bool {
+		idle, dialing := poolIdle(p)
+		return idle == 2 && dialing == 0
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// the first one is expired but not yet dropped by watch
+	p.mu.Lock()
+	expired, fresh := p.idle[0], p.idle[1]
+	expired.expires = time.Now().Add(-time.Second)
+	p.mu.Unlock()
+
+	conn, client := p.get()
+	require.NotNil(t, conn)
+	assert.Equal(t, fresh.conn, conn)
+	assert.Equal(t, fresh.client, client)
+	<-expired.watchDone
+	assert.False(t, expired.healthy)
+	conn.Close()
+}
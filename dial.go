@@ -0,0 +1,251 @@
+package socks_go
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type DialMode int
+
+const (
+	// race IPv6 and IPv4 candidates, IPv6 first (RFC 8305)
+	DialDualStack DialMode = iota
+	// race IPv4 and IPv6 candidates, IPv4 first
+	DialPreferIPv4
+	DialIPv4Only
+	DialIPv6Only
+)
+
+func (m DialMode) String() string {
+	switch m {
+	case DialDualStack:
+		return "dual-stack"
+	case DialPreferIPv4:
+		return "prefer-ipv4"
+	case DialIPv4Only:
+		return "ipv4-only"
+	case DialIPv6Only:
+		return "ipv6-only"
+	default:
+		return "DialMode(" + strconv.Itoa(int(m)) + ")"
+	}
+}
+
+// "Connection Attempt Delay" of RFC 8305
+const defaultAttemptDelay = 250 * time.Millisecond
+
+// dials candidate addresses of a target with staggered attempts
+type happyDialer struct {
+	// addresses of domain target, looked up if nil
+	IPs          []net.IPAddr
+	Mode         DialMode
+	Timeout      time.Duration
+	AttemptDelay time.Duration
+	// source address, only targets of the same family are dialed
+	LocalIP net.IP
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+func (d *happyDialer) network() string {
+	switch d.Mode {
+	case DialIPv4Only:
+		return "tcp4"
+	case DialIPv6Only:
+		return "tcp6"
+	default:
+		return "tcp"
+	}
+}
+
+func (d *happyDialer) Dial(addr SocksAddr, port uint16) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+
+	// with zones, link-local addresses are dialed on the interface
+	ips := d.IPs
+	if ips == nil && addr.Type == ATypeDomain {
+		var err error
+		if ips, err = net.DefaultResolver.LookupIPAddr(ctx, addr.Domain); err != nil {
+			return nil, errors.Wrapf(err, "can not resolve %q", addr.Domain)
+		}
+	} else if ips == nil {
+		ips = []net.IPAddr{{IP: addr.IP}}
+	}
+
+	mode := d.Mode
+	if d.LocalIP != nil {
+		if d.LocalIP.To4() != nil {
+			mode = DialIPv4Only
+		} else {
+			mode = DialIPv6Only
+		}
+	}
+
+	ips = sortDialCandidates(ips, mode)
+	if len(ips) == 0 {
+		return nil, errors.Errorf("no %s address for %v", mode, addr)
+	}
+
+	return d.dialCandidates(ctx, ips, port)
+}
+
+// sortDialCandidates filters addresses by mode and interleaves address families,
+// the preferred family goes first.
+func sortDialCandidates(ips []net.IPAddr, mode DialMode) (sorted []net.IPAddr) {
+	var v4, v6 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	var primary, secondary []net.IPAddr
+	switch mode {
+	case DialIPv4Only:
+		return v4
+	case DialIPv6Only:
+		return v6
+	case DialPreferIPv4:
+		primary, secondary = v4, v6
+	default:
+		primary, secondary = v6, v4
+	}
+
+	for len(primary) > 0 || len(secondary) > 0 {
+		if len(primary) > 0 {
+			sorted = append(sorted, primary[0])
+			primary = primary[1:]
+		}
+		if len(secondary) > 0 {
+			sorted = append(sorted, secondary[0])
+			secondary = secondary[1:]
+		}
+	}
+	return
+}
+
+// dialCandidates starts a new attempt every AttemptDelay or as soon as the
+// previous one failed. The remaining time is split between attempts not yet started.
+func (d *happyDialer) dialCandidates(ctx context.Context, ips []net.IPAddr, port uint16) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	delay := d.AttemptDelay
+	if delay <= 0 {
+		delay = defaultAttemptDelay
+	}
+
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	startNext := func() {
+		ip := ips[next]
+		timeout := d.Timeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline) / time.Duration(len(ips)-next)
+		}
+		next++
+		pending++
+
+		go func() {
+			dialer := net.Dialer{Timeout: timeout, Control: d.Control}
+			if d.LocalIP != nil {
+				dialer.LocalAddr = &net.TCPAddr{IP: d.LocalIP}
+			}
+			target := net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+			conn, err := dialer.DialContext(ctx, d.network(), target)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var lastErr error
+	for {
+		select {
+		case <-timer.C:
+			if next < len(ips) {
+				startNext()
+				timer.Reset(delay)
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// close connections won by other attempts
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.err == nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+
+			lastErr = result.err
+			if next < len(ips) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				startNext()
+				timer.Reset(delay)
+			} else if pending == 0 {
+				return nil, lastErr
+			}
+		}
+	}
+}
+
+// dialErrorReply maps dial errors to reply codes.
+func dialErrorReply(err error) byte {
+	err = errors.Cause(err)
+	// from upstream server
+	if replyErr, ok := err.(*ReplyError); ok {
+		return replyErr.Reply
+	}
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		if dnsErr.IsTimeout {
+			return ReplyTTLExpired
+		}
+		return ReplyHostUnreachable
+	}
+
+	if opErr, ok := err.(*net.OpError); ok {
+		if opErr.Timeout() {
+			return ReplyTTLExpired
+		}
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+
+	switch err {
+	case syscall.ECONNREFUSED:
+		return ReplyConnRefused
+	case syscall.ENETUNREACH:
+		return ReplyNetUnreachable
+	case syscall.EHOSTUNREACH:
+		return ReplyHostUnreachable
+	case context.DeadlineExceeded:
+		return ReplyTTLExpired
+	default:
+		return ReplyFail
+	}
+}
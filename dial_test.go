@@ -0,0 +1,66 @@
+package socks_go
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortDialCandidates(t *testing.T) {
+	a4, b4 := net.IPAddr{IP: net.ParseIP("1.1.1.1")}, net.IPAddr{IP: net.ParseIP("2.2.2.2")}
+	a6, b6 := net.IPAddr{IP: net.ParseIP("::1")}, net.IPAddr{IP: net.ParseIP("::2")}
+	// zone is kept for dialing link-local addresses
+	c6 := net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}
+	ips := []net.IPAddr{a4, b4, a6, b6, c6}
+
+	assert.Equal(t, []net.IPAddr{a6, a4, b6, b4, c6}, sortDialCandidates(ips, DialDualStack))
+	assert.Equal(t, []net.IPAddr{a4, a6, b4, b6, c6}, sortDialCandidates(ips, DialPreferIPv4))
+	assert.Equal(t, []net.IPAddr{a4, b4}, sortDialCandidates(ips, DialIPv4Only))
+	assert.Equal(t, []net.IPAddr{a6, b6, c6}, sortDialCandidates(ips, DialIPv6Only))
+}
+
+func TestHappyDialer_Fallback(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	// nothing listens on the first candidate
+	dialer := happyDialer{Timeout: 3 * time.Second, AttemptDelay: time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := dialer.dialCandidates(ctx, []net.IPAddr{{IP: net.ParseIP("127.0.0.2")}, {IP: net.ParseIP("127.0.0.1")}}, port)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, listener.Addr().String(), conn.RemoteAddr().String())
+	assert.True(t, time.Since(start) < time.Second, "next attempt starts on failure")
+}
+
+func TestDialErrorReply(t *testing.T) {
+	err := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	assert.Equal(t, ReplyConnRefused, dialErrorReply(err))
+	assert.Equal(t, ReplyHostUnreachable, dialErrorReply(&net.DNSError{Err: "no such host"}))
+	assert.Equal(t, ReplyFail, dialErrorReply(syscall.EPERM))
+}
+
+func TestBindDeviceControl(t *testing.T) {
+	lc := net.ListenConfig{Control: bindDeviceControl("nonexistent0")}
+	_, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Error(t, err)
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	dialer := happyDialer{Timeout: time.Second, Control: bindDeviceControl("nonexistent0")}
+	_, err = dialer.Dial(NewSocksAddrFromIP(net.ParseIP("127.0.0.1")), port)
+	assert.Error(t, err)
+}
@@ -0,0 +1,320 @@
+package socks_go
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/account-login/socks_go/util"
+	"github.com/pkg/errors"
+)
+
+// Dialer makes a connection to the proxy server for every tunnel, unless Mux is set.
+type Dialer struct {
+	// "tcp" if empty
+	ProxyNetwork string
+	ProxyAddr    string
+	// timeout for connecting to proxy server and the socks handshake, zero means no timeout
+	Timeout     time.Duration
+	AuthMethods []ClientAuthMethod
+	Param       ClientParam
+	// talk to proxy server over TLS if not nil, an empty ServerName defaults to
+	// the host of ProxyAddr
+	TLSConfig *tls.Config
+	// tunnels of DialSocksAddr are streams of a connection shared with CmdMux,
+	// the server must support this private command
+	Mux bool
+	// keep PoolSize connections authenticated before the request, so a tunnel costs
+	// one round trip to proxy server. zero means no pool.
+	PoolSize int
+	// parked connections older than this are replaced, should be less than the
+	// handshake timeout of server and idle timeout of NATs. zero means no limit.
+	PoolMaxAge time.Duration
+
+	muxMu    sync.Mutex
+	mux      *MuxSession
+	poolOnce sync.Once
+	pool     *connPool
+}
+
+// tunnelConn is the net.Conn to the proxy server, reads and writes go through
+// the tunnel which may be encapsulated by auth method.
+type tunnelConn struct {
+	net.Conn
+	tunnel io.ReadWriter
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	return c.tunnel.Read(b)
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	return c.tunnel.Write(b)
+}
+
+// ProxyError marks failures of the proxy itself, i.e. connecting, TLS and auth,
+// as opposed to rejections of the request or failures of the target.
+// Callbacks of Balancer.DialFunc return it for failing over. The failure is wrapped
+// as is, errors.Cause, errors.Is and errors.As see through ProxyError.
+// AuthMethodError is a failure of the proxy too, it is returned without wrapping.
+type ProxyError struct {
+	Err error
+}
+
+func (e *ProxyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ProxyError) Cause() error {
+	return e.Err
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// isProxyError tells whether err or errors wrapped by it is ProxyError or AuthMethodError.
+func isProxyError(err error) bool {
+	for err != nil {
+		switch err.(type) {
+		case *ProxyError, *AuthMethodError:
+			return true
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = causer.Cause()
+	}
+	return false
+}
+
+func (d *Dialer) proxyNetwork() string {
+	if d.ProxyNetwork == "" {
+		return "tcp"
+	}
+	return d.ProxyNetwork
+}
+
+// connect connects to proxy server, the deadline of Timeout is set on conn.
+func (d *Dialer) connect() (conn net.Conn, client *Client, err error) {
+	conn, err = net.DialTimeout(d.proxyNetwork(), d.ProxyAddr, d.Timeout)
+	if err != nil {
+		err = errors.Wrapf(err, "can not connect to proxy %v", d.ProxyAddr)
+		return
+	}
+
+	if d.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+
+	if d.TLSConfig != nil {
+		tlsConn := tls.Client(conn, d.tlsConfig())
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			conn = nil
+			err = errors.Wrapf(err, "TLS handshake with proxy %v failed", d.ProxyAddr)
+			return
+		}
+		conn = tlsConn
+	}
+
+	newClient := NewClientWithAuthMethods(conn, d.AuthMethods, d.Param)
+	client = &newClient
+	return
+}
+
+func (d *Dialer) tlsConfig() *tls.Config {
+	if d.TLSConfig.ServerName != "" {
+		return d.TLSConfig
+	}
+	host, _, err := net.SplitHostPort(d.ProxyAddr)
+	if err != nil {
+		return d.TLSConfig
+	}
+	config := d.TLSConfig.Clone()
+	config.ServerName = host
+	return config
+}
+
+func (d *Dialer) connPool() *connPool {
+	d.poolOnce.Do(func() {
+		d.pool = &connPool{d: d}
+	})
+	return d.pool
+}
+
+// FillPool starts preparing PoolSize connections in background, so the first tunnel
+// does not wait for the handshake. Optional, the pool is filled by the first tunnel otherwise.
+func (d *Dialer) FillPool() {
+	if d.PoolSize > 0 {
+		d.connPool().refill()
+	}
+}
+
+// handshake calls fn with an authenticated connection to proxy server, either parked
+// in pool or a fresh one. The connection is closed if fn fails. Failures before fn are ProxyError
+// or AuthMethodError.
+func (d *Dialer) handshake(fn func(conn net.Conn, client *Client) error) (conn net.Conn, err error) {
+	var client *Client
+	if d.PoolSize > 0 {
+		conn, client = d.connPool().get()
+	}
+	if conn == nil {
+		if conn, client, err = d.connect(); err != nil {
+			err = &ProxyError{err}
+			return
+		}
+	}
+
+	if err = client.doAuth(); err != nil {
+		conn.Close()
+		conn = nil
+		if _, ok := err.(*AuthMethodError); !ok {
+			err = &ProxyError{errors.Wrapf(err, "auth with proxy %v failed", d.ProxyAddr)}
+		}
+		return
+	}
+
+	err = fn(conn, client)
+	if err != nil {
+		conn.Close()
+		conn = nil
+		return
+	}
+
+	if d.Timeout > 0 {
+		_ = conn.SetDeadline(time.Time{})
+	}
+	return
+}
+
+// resolveTarget resolves addr by Param before connecting to proxy, so the timeout applies.
+func (d *Dialer) resolveTarget(addr SocksAddr) (SocksAddr, error) {
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	return d.Param.resolveTarget(ctx, addr)
+}
+
+func (d *Dialer) DialSocksAddr(addr SocksAddr, port uint16) (net.Conn, error) {
+	addr, err := d.resolveTarget(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Mux {
+		return d.dialMux(addr, port)
+	}
+
+	var tunnel ClientTunnel
+	conn, err := d.handshake(func(conn net.Conn, client *Client) (err error) {
+		tunnel, err = client.ConnectSockAddr(addr, port)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tunnelConn{Conn: conn, tunnel: tunnel.ReadWriter}, nil
+}
+
+// dialMux opens a stream on the shared session, a broken session is replaced once.
+func (d *Dialer) dialMux(addr SocksAddr, port uint16) (conn net.Conn, err error) {
+	for retry := 0; retry < 2; retry++ {
+		var m *MuxSession
+		if m, err = d.muxSession(); err != nil {
+			return
+		}
+		if conn, err = m.dialStream(addr, port, d.Timeout); err == nil || !m.isClosed() {
+			return
+		}
+	}
+	// session broken again
+	err = &ProxyError{err}
+	return
+}
+
+// muxSession returns the shared session, connects to proxy server if none or broken.
+func (d *Dialer) muxSession() (*MuxSession, error) {
+	d.muxMu.Lock()
+	defer d.muxMu.Unlock()
+
+	if d.mux != nil && !d.mux.isClosed() {
+		return d.mux, nil
+	}
+	var m *MuxSession
+	_, err := d.handshake(func(conn net.Conn, client *Client) (err error) {
+		m, err = client.Mux()
+		return
+	})
+	if err != nil {
+		// the session does not involve target
+		if !isProxyError(err) {
+			err = &ProxyError{err}
+		}
+		return nil, err
+	}
+	d.mux = m
+	return m, nil
+}
+
+// Close closes the connection shared by streams of Mux and parked connections, other tunnels are not affected.
+func (d *Dialer) Close() (err error) {
+	if d.PoolSize > 0 {
+		d.connPool().close()
+	}
+
+	d.muxMu.Lock()
+	defer d.muxMu.Unlock()
+
+	if d.mux != nil {
+		err = d.mux.Close()
+		d.mux = nil
+	}
+	return
+}
+
+// Dial implements the Dial method of golang.org/x/net/proxy.Dialer, only tcp is supported.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	addr, port, err := parseDialAddress(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialSocksAddr(addr, port)
+}
+
+func parseDialAddress(network, address string) (addr SocksAddr, port uint16, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		err = errors.Errorf("network not supported: %v", network)
+		return
+	}
+
+	host, port, err := util.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	return NewSocksAddrFromString(host), port, nil
+}
+
+// UDPAssociation creates an udp tunnel, the control connection is closed along with the tunnel.
+func (d *Dialer) UDPAssociation() (*ClientUDPTunnel, error) {
+	var tunnel ClientUDPTunnel
+	conn, err := d.handshake(func(conn net.Conn, client *Client) (err error) {
+		tunnel, err = client.UDPAssociation()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	tunnel.ctrl = conn
+	return &tunnel, nil
+}
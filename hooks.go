@@ -0,0 +1,143 @@
+package socks_go
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Session is a client connection passed to hooks.
+type Session struct {
+	// first fields for 64-bit atomic alignment on 32-bit platforms
+	bytesUp   int64
+	bytesDown int64
+
+	Listener *Listener
+	// client connection, may be wrapped in OnAccept
+	Conn  net.Conn
+	Proto *ServerProtocol
+	// auth methods offered by client
+	Methods []byte
+
+	// request, may be rewritten in OnRequest
+	Cmd  byte
+	Addr SocksAddr
+	Port uint16
+	// the matched rule, nil if none
+	Rule *Rule
+	// allowed addresses of domain target, if resolved for rules
+	resolved []net.IPAddr
+
+	// connection to the target of CONNECT or the peer of BIND, may be wrapped in OnDial
+	Target net.Conn
+	// client side of the tunnel, may be wrapped in OnDial
+	Client io.ReadWriter
+
+	Start time.Time
+	// error ended the session, nil if finished normally
+	Err error
+}
+
+// BytesUp returns payload bytes relayed from client.
+func (sess *Session) BytesUp() int64 {
+	return atomic.LoadInt64(&sess.bytesUp)
+}
+
+// BytesDown returns payload bytes relayed to client.
+func (sess *Session) BytesDown() int64 {
+	return atomic.LoadInt64(&sess.bytesDown)
+}
+
+// Hooks are called through the session lifecycle, nil hooks are skipped.
+// Returning error from a hook ends the session, the request is rejected with
+// the reply of HookError or ReplyNotAllowed if a reply is still expected.
+// Streams of CmdMux are sessions of their own, starting from OnRequest.
+type Hooks struct {
+	// after accept, before handshake
+	OnAccept func(sess *Session) error
+	// after auth method selected, before replying client
+	OnMethod func(sess *Session, method byte) error
+	// after auth, Proto.Identity is set
+	OnAuth func(sess *Session) error
+	// after request got, before checking rules and dialing
+	OnRequest func(sess *Session) error
+	// after connected to target of CONNECT or accepted peer of BIND, before replying client
+	OnDial func(sess *Session) error
+	// after client connection closed
+	OnClose func(sess *Session)
+}
+
+// HookError rejects the request with Reply.
+type HookError struct {
+	Reply byte
+	Err   error
+}
+
+func (e *HookError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HookError) Cause() error {
+	return e.Err
+}
+
+func hookReply(err error) byte {
+	if hookErr, ok := err.(*HookError); ok {
+		return hookErr.Reply
+	}
+	return ReplyNotAllowed
+}
+
+func (h *Hooks) accept(sess *Session) error {
+	if h.OnAccept == nil {
+		return nil
+	}
+	return h.OnAccept(sess)
+}
+
+func (h *Hooks) method(sess *Session, method byte) error {
+	if h.OnMethod == nil {
+		return nil
+	}
+	return h.OnMethod(sess, method)
+}
+
+func (h *Hooks) auth(sess *Session) error {
+	if h.OnAuth == nil {
+		return nil
+	}
+	return h.OnAuth(sess)
+}
+
+func (h *Hooks) request(sess *Session) error {
+	if h.OnRequest == nil {
+		return nil
+	}
+	return h.OnRequest(sess)
+}
+
+func (h *Hooks) dial(sess *Session) error {
+	if h.OnDial == nil {
+		return nil
+	}
+	return h.OnDial(sess)
+}
+
+func (h *Hooks) close(sess *Session) {
+	if h.OnClose != nil {
+		h.OnClose(sess)
+	}
+}
+
+// countingReader counts bytes read into n.
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (r countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
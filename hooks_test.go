@@ -0,0 +1,114 @@
+package socks_go
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upperConn upper-cases data read from target
+type upperConn struct {
+	net.Conn
+}
+
+func (c upperConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	copy(b, bytes.ToUpper(b[:n]))
+	return n, err
+}
+
+func TestServer_Hooks(t *testing.T) {
+	target := startEchoTarget(t)
+	defer target.Close()
+	tcpAddr := target.Addr().(*net.TCPAddr)
+
+	var mu sync.Mutex
+	events := make([]string, 0)
+	addEvent := func(event string) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}
+	closed := make(chan *Session, 10)
+	server := &Server{Hooks: Hooks{
+		OnAccept: func(sess *Session) error {
+			addEvent("accept")
+			return nil
+		},
+		OnMethod: func(sess *Session, method byte) error {
+			addEvent("method")
+			return nil
+		},
+		OnAuth: func(sess *Session) error {
+			addEvent("auth")
+			return nil
+		},
+		OnRequest: func(sess *Session) error {
+			addEvent("request")
+			if sess.Port == 2 {
+				return &HookError{Reply: ReplyHostUnreachable, Err: errors.New("no way")}
+			}
+			// rewrite
+			sess.Addr, sess.Port = NewSocksAddrFromIP(tcpAddr.IP), uint16(tcpAddr.Port)
+			return nil
+		},
+		OnDial: func(sess *Session) error {
+			addEvent("dial")
+			sess.Target = upperConn{sess.Target}
+			return nil
+		},
+		OnClose: func(sess *Session) {
+			closed <- sess
+		},
+	}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	defer server.Close()
+
+	dialer := &Dialer{ProxyAddr: listener.Addr().String(), Timeout: 3 * time.Second}
+	conn, err := dialer.DialSocksAddr(NewSocksAddrFromString("example.com"), 1)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(conn)
+	conn.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "HELLO", string(data))
+
+	sess := <-closed
+	mu.Lock()
+	assert.Equal(t, []string{"accept", "method", "auth", "request", "dial"}, events)
+	mu.Unlock()
+	assert.NoError(t, sess.Err)
+	assert.Equal(t, int64(5), sess.BytesDown())
+	assert.Equal(t, int64(0), sess.BytesUp())
+
+	// veto with reply
+	_, err = dialer.DialSocksAddr(NewSocksAddrFromString("example.com"), 2)
+	assert.Equal(t, &ReplyError{Reply: ReplyHostUnreachable}, err)
+	sess = <-closed
+	assert.Error(t, sess.Err)
+}
+
+func TestServer_HooksMethodVeto(t *testing.T) {
+	server := &Server{Hooks: Hooks{
+		OnMethod: func(sess *Session, method byte) error {
+			return errors.New("no anonymous")
+		},
+	}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	defer server.Close()
+
+	dialer := &Dialer{ProxyAddr: listener.Addr().String(), Timeout: 3 * time.Second}
+	_, err = dialer.DialSocksAddr(NewSocksAddrFromString("example.com"), 80)
+	assert.IsType(t, &AuthMethodError{}, err)
+}
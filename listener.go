@@ -0,0 +1,148 @@
+package socks_go
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Listener is a listening address of Server with its own policy,
+// unset fields fall back to the settings of Server.
+type Listener struct {
+	// first field for 64-bit atomic alignment on 32-bit platforms
+	stats counters
+
+	// "tcp" if empty, or "unix" with path or "@name" for abstract socket on linux
+	Network string
+	Addr    string
+	// permission of unix socket file, zero means default
+	Mode os.FileMode
+	// accept TLS connections if not nil
+	TLSConfig   *tls.Config
+	AuthHandler AuthHandlerFunc
+	// nil means Server.Rules, use an empty RuleSet to allow everything
+	Rules      RuleSet
+	LocalAddrs []net.IP
+	BindDevice string
+	Upstream   *Dialer
+
+	localAddrIdx uint32
+	// counters of the replaced listener, see InheritStats
+	inherited *counters
+}
+
+func (l *Listener) network() string {
+	if l.Network == "" {
+		return "tcp"
+	}
+	return l.Network
+}
+
+// Listen listens on the address of l. Unix socket files are created with Mode,
+// a stale one left by a crashed server is replaced.
+func (l *Listener) Listen() (listener net.Listener, err error) {
+	if l.network() != "unix" || strings.HasPrefix(l.Addr, "@") {
+		return net.Listen(l.network(), l.Addr)
+	}
+
+	// no window with the default permission
+	listen := func() error {
+		return withUmask(l.Mode, func() (err error) {
+			listener, err = net.Listen("unix", l.Addr)
+			return
+		})
+	}
+
+	if err = listen(); err != nil && errors.Is(err, errAddrInUse) && isStaleSocket(l.Addr) {
+		if rmErr := os.Remove(l.Addr); rmErr != nil {
+			return nil, errors.Wrapf(rmErr, "can not remove stale socket %v", l.Addr)
+		}
+		err = listen()
+	}
+	if err != nil {
+		return
+	}
+
+	if l.Mode != 0 {
+		if err = os.Chmod(l.Addr, l.Mode); err != nil {
+			listener.Close()
+			return nil, errors.Wrapf(err, "can not chmod %v", l.Addr)
+		}
+	}
+	return
+}
+
+// isStaleSocket tells whether path is a unix socket nobody listens on.
+func isStaleSocket(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return errors.Is(err, syscall.ECONNREFUSED)
+	}
+	conn.Close()
+	return false
+}
+
+// Stats returns the counters of connections accepted on this listener.
+func (l *Listener) Stats() Stats {
+	return l.counters().snapshot()
+}
+
+// InheritStats makes l continue the counters of old, which l replaces, e.g. on config reload.
+// Connections still served with old are counted by both. Call it before serving.
+func (l *Listener) InheritStats(old *Listener) {
+	l.inherited = old.counters()
+}
+
+func (l *Listener) counters() *counters {
+	if l.inherited != nil {
+		return l.inherited
+	}
+	return &l.stats
+}
+
+// Stats is the connection counters of Server or Listener.
+type Stats struct {
+	// connections accepted
+	Accepted int64
+	// connections being served
+	Active int64
+	// requests denied by rules
+	Denied int64
+	// connections ended with error
+	Failed int64
+}
+
+const (
+	counterAccepted = iota
+	counterActive
+	counterDenied
+	counterFailed
+	numCounters
+)
+
+type counters [numCounters]int64
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		Accepted: atomic.LoadInt64(&c[counterAccepted]),
+		Active:   atomic.LoadInt64(&c[counterActive]),
+		Denied:   atomic.LoadInt64(&c[counterDenied]),
+		Failed:   atomic.LoadInt64(&c[counterFailed]),
+	}
+}
+
+// addCounter updates the counter of both server and listener, returns the server one.
+func addCounter(s *Server, l *Listener, counter int, delta int64) int64 {
+	atomic.AddInt64(&l.counters()[counter], delta)
+	return atomic.AddInt64(&s.counters()[counter], delta)
+}
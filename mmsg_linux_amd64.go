@@ -0,0 +1,7 @@
+package socks_go
+
+// not defined by package syscall on all architectures
+const (
+	sysRECVMMSG = 299
+	sysSENDMMSG = 307
+)
@@ -0,0 +1,729 @@
+package socks_go
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// Multiplexing saves the connection and handshake to proxy server for every tunnel,
+// for clients making many short connections over high-latency links.
+// After CmdMux is accepted, the tcp connection carries frames of logical streams:
+//
+//	TYPE(1) RSV(1) LEN(2) STREAM_ID(4) PAYLOAD(LEN)
+//
+// Streams are opened by client with odd ids, each carries a request without auth,
+// e.g. CONNECT, followed by the tunnel. Each direction of a stream may have at most
+// muxWindow bytes in flight, the receiver returns the window with muxFrameWindow
+// carrying the increment in 4 bytes big endian. FIN closes a direction, RST aborts
+// the stream.
+
+const (
+	muxFrameOpen byte = iota
+	muxFrameData
+	muxFrameWindow
+	muxFrameFin
+	muxFrameReset
+)
+
+const (
+	muxHeaderLen = 8
+	muxMaxData   = 32 * 1024
+	muxWindow    = 256 * 1024
+	// concurrent streams of a session accepted by server
+	muxMaxStreams = 1024
+	// streams opened by client and not yet served, more are reset
+	muxAcceptQueueLen = 16
+)
+
+var errMuxStreamReset = errors.New("mux stream reset by peer")
+
+type muxTimeoutError struct{}
+
+func (muxTimeoutError) Error() string   { return "mux stream i/o timeout" }
+func (muxTimeoutError) Timeout() bool   { return true }
+func (muxTimeoutError) Temporary() bool { return true }
+
+// MuxSession carries streams on a connection to proxy server, created by Client.Mux.
+type MuxSession struct {
+	trans  io.ReadWriter
+	conn   net.Conn
+	reader *bufio.Reader
+	param  ClientParam
+
+	writeMu sync.Mutex
+	wbuf    [muxHeaderLen + muxMaxData]byte
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error
+	// streams opened by client, nil on client side
+	accepts chan *muxStream
+	done    chan struct{}
+	// ids of streams to reset, sent by a single goroutine so recvLoop is never blocked
+	resets    []uint32
+	resetting bool
+}
+
+// newMuxSession starts reading frames from trans, conn is closed with the session.
+func newMuxSession(trans io.ReadWriter, conn net.Conn, server bool) *MuxSession {
+	m := &MuxSession{
+		trans:   trans,
+		conn:    conn,
+		reader:  bufio.NewReader(trans),
+		streams: make(map[uint32]*muxStream),
+		nextID:  1,
+		done:    make(chan struct{}),
+	}
+	if server {
+		m.accepts = make(chan *muxStream, muxAcceptQueueLen)
+	}
+	go m.recvLoop()
+	return m
+}
+
+// DialSocksAddr opens a stream connected to addr:port.
+func (m *MuxSession) DialSocksAddr(addr SocksAddr, port uint16) (net.Conn, error) {
+	return m.dialStream(addr, port, 0)
+}
+
+// dialStream sends CONNECT on a new stream, timeout applies to the request if not zero.
+func (m *MuxSession) dialStream(addr SocksAddr, port uint16, timeout time.Duration) (conn net.Conn, err error) {
+	addr, err = m.param.resolveTarget(context.Background(), addr)
+	if err != nil {
+		return
+	}
+
+	stream, err := m.open()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			stream.Close()
+		}
+	}()
+
+	if timeout > 0 {
+		_ = stream.SetDeadline(time.Now().Add(timeout))
+	}
+	proto := NewClientProtocol(stream)
+	proto.State = PSCAuthDone
+	if err = proto.SendCommand(CmdConnect, addr, port); err != nil {
+		return
+	}
+	reply, _, _, err := proto.ReceiveReply()
+	if err != nil {
+		return
+	}
+	if reply != ReplyOK {
+		err = &ReplyError{reply}
+		return
+	}
+	if timeout > 0 {
+		_ = stream.SetDeadline(time.Time{})
+	}
+	return stream, nil
+}
+
+// Close closes the connection, streams on it are aborted.
+func (m *MuxSession) Close() error {
+	m.fail(errors.New("mux session closed"))
+	return nil
+}
+
+func (m *MuxSession) isClosed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail ends the session with err, the first error is kept.
+func (m *MuxSession) fail(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	close(m.done)
+	streams := m.streams
+	m.streams = make(map[uint32]*muxStream)
+	m.mu.Unlock()
+
+	if m.conn != nil {
+		m.conn.Close()
+	}
+	for _, stream := range streams {
+		stream.abort(err)
+	}
+}
+
+func (m *MuxSession) open() (*muxStream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	stream := newMuxStream(m, m.nextID)
+	m.streams[stream.id] = stream
+	m.nextID += 2
+	m.mu.Unlock()
+
+	if err := m.writeFrame(muxFrameOpen, stream.id, nil); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// accept returns the next stream opened by client.
+func (m *MuxSession) accept() (*muxStream, error) {
+	select {
+	case stream := <-m.accepts:
+		return stream, nil
+	case <-m.done:
+		return nil, m.err
+	}
+}
+
+func (m *MuxSession) stream(id uint32) *muxStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+func (m *MuxSession) removeStream(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.streams, id)
+}
+
+// reset removes the stream and queues RST for it.
+func (m *MuxSession) reset(id uint32) error {
+	m.mu.Lock()
+	delete(m.streams, id)
+	if len(m.resets) >= muxMaxStreams {
+		// peer is not reading
+		m.mu.Unlock()
+		return errors.New("mux session: too many pending resets")
+	}
+	m.resets = append(m.resets, id)
+	start := !m.resetting
+	m.resetting = true
+	m.mu.Unlock()
+
+	if start {
+		go m.sendResets()
+	}
+	return nil
+}
+
+func (m *MuxSession) sendResets() {
+	for {
+		m.mu.Lock()
+		ids := m.resets
+		m.resets = nil
+		if len(ids) == 0 {
+			m.resetting = false
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+
+		for _, id := range ids {
+			_ = m.writeFrame(muxFrameReset, id, nil) // ignore err
+		}
+	}
+}
+
+func (m *MuxSession) writeFrame(typ byte, id uint32, payload []byte) (err error) {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	select {
+	case <-m.done:
+		return m.err
+	default:
+	}
+
+	frame := m.wbuf[:muxHeaderLen+len(payload)]
+	frame[0], frame[1] = typ, 0
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], id)
+	copy(frame[muxHeaderLen:], payload)
+	if _, err = m.trans.Write(frame); err != nil {
+		err = errors.Wrap(err, "mux session broken")
+		m.fail(err)
+	}
+	return
+}
+
+func (m *MuxSession) recvLoop() {
+	var header [muxHeaderLen]byte
+	buf := make([]byte, muxMaxData)
+	for {
+		if _, err := io.ReadFull(m.reader, header[:]); err != nil {
+			m.fail(errors.Wrap(err, "mux session broken"))
+			return
+		}
+
+		typ, id := header[0], binary.BigEndian.Uint32(header[4:])
+		n := int(binary.BigEndian.Uint16(header[2:]))
+		if n > muxMaxData {
+			m.fail(errors.Errorf("mux frame too large: %d bytes", n))
+			return
+		}
+		if _, err := io.ReadFull(m.reader, buf[:n]); err != nil {
+			m.fail(errors.Wrap(err, "mux session broken"))
+			return
+		}
+
+		if err := m.handleFrame(typ, id, buf[:n]); err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+func (m *MuxSession) handleFrame(typ byte, id uint32, payload []byte) error {
+	if typ == muxFrameOpen {
+		return m.handleOpen(id)
+	}
+
+	// frames of streams closed locally are dropped
+	stream := m.stream(id)
+	switch typ {
+	case muxFrameData:
+		if stream != nil && !stream.push(payload) {
+			// peer is not aware of the local close yet
+			return m.reset(id)
+		}
+	case muxFrameWindow:
+		if len(payload) != 4 {
+			return errors.Errorf("bad mux window frame of %d bytes", len(payload))
+		}
+		if stream != nil {
+			stream.addWindow(binary.BigEndian.Uint32(payload))
+		}
+	case muxFrameFin:
+		if stream != nil {
+			stream.finish()
+		}
+	case muxFrameReset:
+		if stream != nil {
+			m.removeStream(id)
+			stream.abort(errMuxStreamReset)
+		}
+	default:
+		return errors.Errorf("unknown mux frame type: %#x", typ)
+	}
+	return nil
+}
+
+func (m *MuxSession) handleOpen(id uint32) error {
+	if m.accepts == nil || id%2 == 0 {
+		return errors.Errorf("unexpected mux stream %d opened by peer", id)
+	}
+
+	m.mu.Lock()
+	if _, ok := m.streams[id]; ok {
+		m.mu.Unlock()
+		return errors.Errorf("mux stream %d opened twice", id)
+	}
+	if len(m.streams) >= muxMaxStreams {
+		m.mu.Unlock()
+		return m.reset(id)
+	}
+	stream := newMuxStream(m, id)
+	m.streams[id] = stream
+	m.mu.Unlock()
+
+	select {
+	case m.accepts <- stream:
+		return nil
+	default:
+		log.Warnf("mux session: accept queue full, reset stream %d", id)
+		return m.reset(id)
+	}
+}
+
+// muxStream is a logical connection of MuxSession.
+type muxStream struct {
+	m  *MuxSession
+	id uint32
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+	// bytes read but not returned to peer
+	consumed   int
+	sendWindow int
+	finRecv    bool
+	finSent    bool
+	closed     bool
+	// set on reset or session failure
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// notified on changes
+	readCh  chan struct{}
+	writeCh chan struct{}
+}
+
+func newMuxStream(m *MuxSession, id uint32) *muxStream {
+	return &muxStream{
+		m:          m,
+		id:         id,
+		sendWindow: muxWindow,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push buffers data from peer, returns false if the stream is closed locally.
+func (s *muxStream) push(data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.buf.Len()+s.consumed+len(data) > muxWindow {
+		// peer exceeds the window, the stream can not be trusted
+		s.err = errors.Errorf("mux stream %d: window exceeded", s.id)
+	} else {
+		s.buf.Write(data)
+	}
+	notify(s.readCh)
+	return true
+}
+
+func (s *muxStream) addWindow(n uint32) {
+	s.mu.Lock()
+	s.sendWindow += int(n)
+	s.mu.Unlock()
+	notify(s.writeCh)
+}
+
+func (s *muxStream) finish() {
+	s.mu.Lock()
+	s.finRecv = true
+	remove := s.closed
+	s.mu.Unlock()
+
+	if remove {
+		s.m.removeStream(s.id)
+	}
+	notify(s.readCh)
+}
+
+func (s *muxStream) abort(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	notify(s.readCh)
+	notify(s.writeCh)
+}
+
+// wait blocks until ch is notified or deadline.
+func (s *muxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return muxTimeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return muxTimeoutError{}
+	}
+}
+
+func (s *muxStream) Read(b []byte) (n int, err error) {
+	for {
+		s.mu.Lock()
+		if s.buf.Len() > 0 && !s.closed {
+			n, _ = s.buf.Read(b)
+			s.consumed += n
+			var inc int
+			if s.consumed >= muxWindow/2 && !s.finRecv {
+				inc, s.consumed = s.consumed, 0
+			}
+			s.mu.Unlock()
+
+			if inc > 0 {
+				var payload [4]byte
+				binary.BigEndian.PutUint32(payload[:], uint32(inc))
+				_ = s.m.writeFrame(muxFrameWindow, s.id, payload[:]) // ignore err
+			}
+			return n, nil
+		}
+
+		switch {
+		case s.closed:
+			err = io.ErrClosedPipe
+		case s.finRecv:
+			err = io.EOF
+		case s.err != nil:
+			err = s.err
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+		if err = s.wait(s.readCh, deadline); err != nil {
+			return
+		}
+	}
+}
+
+func (s *muxStream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		s.mu.Lock()
+		switch {
+		case s.closed || s.finSent:
+			err = io.ErrClosedPipe
+		case s.err != nil:
+			err = s.err
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return
+		}
+
+		if s.sendWindow == 0 {
+			deadline := s.writeDeadline
+			s.mu.Unlock()
+			if err = s.wait(s.writeCh, deadline); err != nil {
+				return
+			}
+			continue
+		}
+
+		chunk := len(b)
+		if chunk > s.sendWindow {
+			chunk = s.sendWindow
+		}
+		if chunk > muxMaxData {
+			chunk = muxMaxData
+		}
+		s.sendWindow -= chunk
+		s.mu.Unlock()
+
+		if err = s.m.writeFrame(muxFrameData, s.id, b[:chunk]); err != nil {
+			return
+		}
+		n += chunk
+		b = b[chunk:]
+	}
+	return
+}
+
+// CloseWrite sends FIN, peer reads io.EOF after data sent.
+func (s *muxStream) CloseWrite() error {
+	s.mu.Lock()
+	if s.finSent || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.finSent = true
+	s.mu.Unlock()
+
+	return s.m.writeFrame(muxFrameFin, s.id, nil)
+}
+
+// Close sends FIN, data from peer afterwards is answered with RST.
+func (s *muxStream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	sendFin := !s.finSent && s.err == nil
+	s.finSent = true
+	remove := s.finRecv || s.err != nil
+	s.buf.Reset()
+	s.mu.Unlock()
+
+	notify(s.readCh)
+	notify(s.writeCh)
+	if remove {
+		s.m.removeStream(s.id)
+	}
+	if sendFin {
+		return s.m.writeFrame(muxFrameFin, s.id, nil)
+	}
+	return nil
+}
+
+func (s *muxStream) LocalAddr() net.Addr {
+	if s.m.conn == nil {
+		return nil
+	}
+	return s.m.conn.LocalAddr()
+}
+
+func (s *muxStream) RemoteAddr() net.Addr {
+	if s.m.conn == nil {
+		return nil
+	}
+	return s.m.conn.RemoteAddr()
+}
+
+func (s *muxStream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline, s.writeDeadline = t, t
+	s.mu.Unlock()
+	notify(s.readCh)
+	notify(s.writeCh)
+	return nil
+}
+
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	notify(s.readCh)
+	return nil
+}
+
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	notify(s.writeCh)
+	return nil
+}
+
+// Mux negotiates a multiplexed session with CmdMux, the server must support this private command.
+func (c *Client) Mux() (m *MuxSession, err error) {
+	err = c.doAuth()
+	if err != nil {
+		return
+	}
+
+	err = c.protocol.SendCommand(CmdMux, NewSocksAddr(), 0)
+	if err != nil {
+		return
+	}
+
+	reply, _, _, err := c.protocol.ReceiveReply()
+	if err != nil {
+		return
+	}
+	if reply != ReplyOK {
+		err = &ReplyError{reply}
+		return
+	}
+
+	trans, err := c.protocol.GetConnection()
+	if err != nil {
+		return
+	}
+	conn, _ := c.conn.(net.Conn)
+	m = newMuxSession(trans, conn, false)
+	m.param = c.param
+	return
+}
+
+// cmdMux serves streams until the client connection is broken.
+func (s *Server) cmdMux(sess *Session) (err error) {
+	trans, err := sess.Proto.AcceptConnection(NewSocksAddr(), 0)
+	if err != nil {
+		return
+	}
+
+	m := newMuxSession(trans, sess.Conn, true)
+	for {
+		var stream *muxStream
+		if stream, err = m.accept(); err != nil {
+			if errors.Cause(err) == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if !s.admit(sess.Listener, sess.Conn.RemoteAddr()) {
+			if err = m.reset(stream.id); err != nil {
+				return
+			}
+			continue
+		}
+		go s.handleStream(sess, stream)
+	}
+}
+
+// handleStream serves the request on stream with the identity of parent,
+// only hooks after auth are called. The stream is admitted by caller.
+func (s *Server) handleStream(parent *Session, stream *muxStream) {
+	var err error
+	l := parent.Listener
+	sess := &Session{Listener: l, Conn: stream, Methods: parent.Methods, Start: time.Now()}
+
+	defer addCounter(s, l, counterActive, -1)
+	defer func() {
+		if err != nil {
+			addCounter(s, l, counterFailed, 1)
+			log.Errorf("client: %v, stream: %d, err: %v", stream.RemoteAddr(), stream.id, err)
+		}
+		sess.Err = err
+
+		if closeErr := sess.Conn.Close(); closeErr != nil {
+			log.Errorf("client: %v, stream: %d, close err: %v", stream.RemoteAddr(), stream.id, closeErr)
+		}
+		s.Hooks.close(sess)
+	}()
+
+	proto := NewServerProtocol(stream)
+	proto.State = PSAuthDone
+	proto.Identity = parent.Proto.Identity
+	sess.Proto = &proto
+
+	if s.HandshakeTimeout > 0 {
+		_ = stream.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+	sess.Cmd, sess.Addr, sess.Port, err = proto.GetRequest()
+	if err != nil {
+		return
+	}
+	if s.HandshakeTimeout > 0 {
+		_ = stream.SetDeadline(time.Time{})
+	}
+
+	switch sess.Cmd {
+	case CmdConnect, CmdResolve, CmdResolvePTR:
+		err = s.handleRequest(sess)
+	default:
+		err = errors.Errorf("unsupported cmd in mux stream: %#x", sess.Cmd)
+		proto.RejectRequest(ReplyCmdNotSupported) // ignore err
+	}
+}
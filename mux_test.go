@@ -0,0 +1,197 @@
+package socks_go
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMuxPair(t *testing.T) (client *MuxSession, server *MuxSession) {
+	c1, c2 := net.Pipe()
+	client = newMuxSession(c1, c1, false)
+	server = newMuxSession(c2, c2, true)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+func TestMuxSession_Stream(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	cs, err := client.open()
+	require.NoError(t, err)
+	ss, err := server.accept()
+	require.NoError(t, err)
+	assert.Equal(t, cs.id, ss.id)
+
+	// more than the window, in both directions
+	data := bytes.Repeat([]byte("0123456789abcdef"), muxWindow/4)
+	go func() {
+		_, _ = cs.Write(data)
+		_ = cs.CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(ss)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	go func() {
+		_, _ = ss.Write(data)
+		_ = ss.Close()
+	}()
+	got, err = ioutil.ReadAll(cs)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	require.NoError(t, cs.Close())
+
+	// removed after closed by both sides
+	assert.Eventually(t, func() bool {
+		return client.stream(cs.id) == nil && server.stream(ss.id) == nil
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestMuxSession_Reset(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	cs, err := client.open()
+	require.NoError(t, err)
+	ss, err := server.accept()
+	require.NoError(t, err)
+	require.NoError(t, ss.Close())
+
+	// data after close is answered with RST
+	assert.Eventually(t, func() bool {
+		_, err := cs.Write([]byte("x"))
+		return err == errMuxStreamReset
+	}, 3*time.Second, 10*time.Millisecond)
+	_, err = cs.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMuxSession_Deadline(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	cs, err := client.open()
+	require.NoError(t, err)
+	_, err = server.accept()
+	require.NoError(t, err)
+
+	require.NoError(t, cs.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = cs.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	require.True(t, ok, "%v", err)
+	assert.True(t, netErr.Timeout())
+
+	// streams are aborted with session
+	require.NoError(t, cs.SetReadDeadline(time.Time{}))
+	server.Close()
+	_, err = cs.Read(make([]byte, 1))
+	assert.Error(t, err)
+	_, err = client.open()
+	assert.Error(t, err)
+}
+
+func TestServer_Mux(t *testing.T) {
+	target := startEchoTarget(t, true)
+	defer target.Close()
+
+	server := &Server{Rules: RuleSet{{Action: RuleDeny, Domains: []string{"denied.example.com"}}}}
+	defer server.Close()
+	dialer := startServer(t, server)
+	dialer.Mux = true
+	defer dialer.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(size int) {
+			defer wg.Done()
+			conn, err := dialer.Dial("tcp", target.Addr().String())
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+
+			data := bytes.Repeat([]byte{byte(size)}, size)
+			go conn.Write(data)
+			got := make([]byte, size)
+			_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			_, err = io.ReadFull(conn, got)
+			assert.NoError(t, err)
+			assert.Equal(t, data, got)
+		}(1000 << uint(i))
+	}
+	wg.Wait()
+
+	// streams are checked by rules, and counted as connections
+	_, err := dialer.Dial("tcp", "denied.example.com:80")
+	assert.Equal(t, &ReplyError{Reply: ReplyNotAllowed}, err)
+	assert.Equal(t, int64(1+9), server.Stats().Accepted)
+	assert.Equal(t, int64(1), server.Stats().Denied)
+
+	// a broken session is replaced
+	dialer.mux.Close()
+	conn, err := dialer.Dial("tcp", target.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, int64(1+9+2), server.Stats().Accepted)
+}
+
+func TestServer_MuxMaxConns(t *testing.T) {
+	target := startEchoTarget(t, true)
+	defer target.Close()
+
+	server := &Server{MaxConns: 2}
+	defer server.Close()
+	dialer := startServer(t, server)
+	dialer.Mux = true
+	defer dialer.Close()
+
+	// the session and a stream
+	conn, err := dialer.Dial("tcp", target.Addr().String())
+	require.NoError(t, err)
+	_, err = dialer.Dial("tcp", target.Addr().String())
+	assert.Equal(t, errMuxStreamReset, errors.Cause(err))
+
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		return server.Stats().Active == 1
+	}, 3*time.Second, 10*time.Millisecond)
+	conn, err = dialer.Dial("tcp", target.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestMuxSession_AcceptQueueFull(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	// streams beyond the queue are reset, the session is not blocked
+	var streams []*muxStream
+	for i := 0; i < muxAcceptQueueLen+1; i++ {
+		cs, err := client.open()
+		require.NoError(t, err)
+		streams = append(streams, cs)
+	}
+	_, err := streams[muxAcceptQueueLen].Read(make([]byte, 1))
+	assert.Equal(t, errMuxStreamReset, err)
+
+	for i := 0; i < muxAcceptQueueLen; i++ {
+		ss, err := server.accept()
+		require.NoError(t, err)
+		assert.Equal(t, streams[i].id, ss.id)
+	}
+	cs, err := client.open()
+	require.NoError(t, err)
+	ss, err := server.accept()
+	require.NoError(t, err)
+	assert.Equal(t, cs.id, ss.id)
+}
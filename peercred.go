@@ -0,0 +1,8 @@
+package socks_go
+
+// PeerCred is the credentials of the process on the other side of unix socket.
+type PeerCred struct {
+	PID int
+	UID int
+	GID int
+}
@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package socks_go
+
+import (
+	"net"
+	"syscall"
+
+	log "github.com/cihub/seelog"
+)
+
+// getPeerCred gets peer credentials of unix socket with SO_PEERCRED.
+func getPeerCred(conn net.Conn) *PeerCred {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		log.Warnf("can not get peer credentials: %v", err)
+		return nil
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		log.Warnf("can not get peer credentials: %v", err)
+		return nil
+	}
+	return &PeerCred{PID: int(ucred.Pid), UID: int(ucred.Uid), GID: int(ucred.Gid)}
+}
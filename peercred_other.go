@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package socks_go
+
+import (
+	"net"
+)
+
+func getPeerCred(conn net.Conn) *PeerCred {
+	return nil
+}
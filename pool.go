@@ -0,0 +1,34 @@
+package socks_go
+
+import "sync"
+
+// room reserved before payload, so the socks header and the length
+// of udp over tcp can be prepended in place
+const udpHeadroom = udpFrameHeaderLen + maxUDPHeaderLen
+
+// udp payload can not exceed 64KiB
+const udpBufSize = udpHeadroom + 64*1024
+
+var udpBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, udpBufSize)
+		return &buf
+	},
+}
+
+func getUDPBuf() *[]byte {
+	return udpBufPool.Get().(*[]byte)
+}
+
+func putUDPBuf(buf *[]byte) {
+	udpBufPool.Put(buf)
+}
+
+var udpBatchPool = sync.Pool{
+	New: func() interface{} { return newUDPBatch(udpBatchSize) },
+}
+
+// for sockets read one datagram at a time, held while waiting for data
+var udpSinglePool = sync.Pool{
+	New: func() interface{} { return newUDPBatch(1) },
+}
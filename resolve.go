@@ -0,0 +1,207 @@
+package socks_go
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// ResolveMode tells where domain targets of CONNECT are resolved.
+type ResolveMode int
+
+const (
+	// domains are sent to proxy server
+	ResolveRemote ResolveMode = iota
+	// domains are resolved on local machine and ips are sent, for servers not accepting domains
+	ResolveLocal
+)
+
+func (m ResolveMode) String() string {
+	switch m {
+	case ResolveRemote:
+		return "remote"
+	case ResolveLocal:
+		return "local"
+	default:
+		return "ResolveMode(" + strconv.Itoa(int(m)) + ")"
+	}
+}
+
+// Resolver looks up domains for ResolveLocal, implemented by *net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// lookupIP returns the ip of host that would be dialed first in mode.
+func lookupIP(ctx context.Context, resolver Resolver, host string, mode DialMode) (ip net.IP, err error) {
+	ipAddrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return
+	}
+
+	if ipAddrs = sortDialCandidates(ipAddrs, mode); len(ipAddrs) == 0 {
+		err = &net.DNSError{Err: "no " + mode.String() + " address", Name: host, IsNotFound: true}
+		return
+	}
+	return ipAddrs[0].IP, nil
+}
+
+// resolveTarget resolves domain of addr on local machine with ResolveLocal.
+func (p *ClientParam) resolveTarget(ctx context.Context, addr SocksAddr) (SocksAddr, error) {
+	if p.Resolve != ResolveLocal || addr.Type != ATypeDomain {
+		return addr, nil
+	}
+
+	var resolver Resolver = net.DefaultResolver
+	if p.Resolver != nil {
+		resolver = p.Resolver
+	}
+	ip, err := lookupIP(ctx, resolver, addr.Domain, p.ResolveFamily)
+	if err != nil {
+		return addr, errors.Wrapf(err, "can not resolve %q", addr.Domain)
+	}
+	return NewSocksAddrFromIP(ip), nil
+}
+
+// Resolve resolves host at server with CmdResolve, the tor extension.
+func (c *Client) Resolve(host string) (ip net.IP, err error) {
+	addr, err := c.resolveCmd(CmdResolve, SocksAddr{Type: ATypeDomain, Domain: host})
+	if err != nil {
+		return
+	}
+	if addr.Type == ATypeDomain {
+		err = errors.Errorf("Resolve: got domain %q instead of ip", addr.Domain)
+		return
+	}
+	return addr.IP, nil
+}
+
+// ResolvePTR resolves the name of ip at server with CmdResolvePTR, the tor extension.
+func (c *Client) ResolvePTR(ip net.IP) (name string, err error) {
+	addr, err := c.resolveCmd(CmdResolvePTR, NewSocksAddrFromIP(ip))
+	if err != nil {
+		return
+	}
+	if addr.Type != ATypeDomain {
+		err = errors.Errorf("ResolvePTR: got ip %v instead of domain", addr.IP)
+		return
+	}
+	return addr.Domain, nil
+}
+
+func (c *Client) resolveCmd(cmd byte, addr SocksAddr) (result SocksAddr, err error) {
+	err = c.doAuth()
+	if err != nil {
+		return
+	}
+
+	err = c.protocol.SendCommand(cmd, addr, 0)
+	if err != nil {
+		return
+	}
+
+	var reply byte
+	reply, result, _, err = c.protocol.ReceiveReply()
+	if err != nil {
+		return
+	}
+	if reply != ReplyOK {
+		err = &ReplyError{reply}
+	}
+	return
+}
+
+// Resolve resolves host at proxy server, the connection is closed after that.
+func (d *Dialer) Resolve(host string) (ip net.IP, err error) {
+	conn, err := d.handshake(func(conn net.Conn, client *Client) (err error) {
+		ip, err = client.Resolve(host)
+		return
+	})
+	if err == nil {
+		conn.Close()
+	}
+	return
+}
+
+// ResolvePTR resolves the name of ip at proxy server, the connection is closed after that.
+func (d *Dialer) ResolvePTR(ip net.IP) (name string, err error) {
+	conn, err := d.handshake(func(conn net.Conn, client *Client) (err error) {
+		name, err = client.ResolvePTR(ip)
+		return
+	})
+	if err == nil {
+		conn.Close()
+	}
+	return
+}
+
+// cmdResolve replies CmdResolve and CmdResolvePTR, with upstream if any.
+func (s *Server) cmdResolve(sess *Session) (err error) {
+	conn, proto := sess.Conn, sess.Proto
+
+	var result SocksAddr
+	if sess.Cmd == CmdResolvePTR {
+		if sess.Addr.Type == ATypeDomain {
+			proto.RejectRequest(ReplyATypeNotSupported) // ignore err
+			return errors.Errorf("RESOLVE_PTR of domain %q", sess.Addr.Domain)
+		}
+		result, err = s.resolvePTR(sess)
+	} else {
+		result, err = s.resolve(sess)
+	}
+	if err != nil {
+		proto.RejectRequest(dialErrorReply(err)) // ignore err
+		return
+	}
+
+	log.Infof("client: %v, resolved %v to %v", conn.RemoteAddr(), sess.Addr, result)
+	return proto.AcceptResolve(result)
+}
+
+func (s *Server) resolve(sess *Session) (result SocksAddr, err error) {
+	if sess.Addr.Type != ATypeDomain {
+		// ip from client or rewriting
+		return sess.Addr, nil
+	}
+	if upstream := s.upstream(sess.Listener, sess.Rule); upstream != nil {
+		var ip net.IP
+		if ip, err = upstream.Resolve(sess.Addr.Domain); err != nil {
+			return
+		}
+		return NewSocksAddrFromIP(ip), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.ConnectTimeout)
+	defer cancel()
+	ip, err := lookupIP(ctx, net.DefaultResolver, sess.Addr.Domain, s.DialMode)
+	if err != nil {
+		return
+	}
+	return NewSocksAddrFromIP(ip), nil
+}
+
+func (s *Server) resolvePTR(sess *Session) (result SocksAddr, err error) {
+	if upstream := s.upstream(sess.Listener, sess.Rule); upstream != nil {
+		var name string
+		if name, err = upstream.ResolvePTR(sess.Addr.IP); err != nil {
+			return
+		}
+		return SocksAddr{Type: ATypeDomain, Domain: name}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.ConnectTimeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, sess.Addr.IP.String())
+	if err != nil {
+		return
+	}
+	if len(names) == 0 {
+		err = &net.DNSError{Err: "no name", Name: sess.Addr.IP.String(), IsNotFound: true}
+		return
+	}
+	return SocksAddr{Type: ATypeDomain, Domain: strings.TrimSuffix(names[0], ".")}, nil
+}
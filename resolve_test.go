@@ -0,0 +1,131 @@
+package socks_go
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Resolve(t *testing.T) {
+	server := &Server{
+		Rewrites: Rewriter{{Domain: "pinned.example.com", ToHost: "192.0.2.1"}},
+		Rules:    RuleSet{{Action: RuleDeny, Domains: []string{"denied.example.com"}}},
+	}
+	defer server.Close()
+	dialer := startServer(t, server)
+
+	ip, err := dialer.Resolve("localhost")
+	require.NoError(t, err)
+	assert.True(t, ip.IsLoopback(), "%v", ip)
+
+	ip, err = dialer.Resolve("pinned.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", ip.String())
+
+	_, err = dialer.Resolve("denied.example.com")
+	assert.Equal(t, &ReplyError{Reply: ReplyNotAllowed}, err)
+
+	name, err := dialer.ResolvePTR(net.IPv4(127, 0, 0, 1))
+	require.NoError(t, err)
+	assert.NotEmpty(t, name)
+
+	// RESOLVE_PTR requires ip
+	_, err = dialer.handshake(func(conn net.Conn, client *Client) (err error) {
+		_, err = client.resolveCmd(CmdResolvePTR, NewSocksAddrFromString("example.com"))
+		return
+	})
+	assert.Equal(t, &ReplyError{Reply: ReplyATypeNotSupported}, err)
+}
+
+func TestServer_ResolveUpstream(t *testing.T) {
+	upstream := &Server{Rewrites: Rewriter{{Domain: "pinned.example.com", ToHost: "192.0.2.1"}}}
+	defer upstream.Close()
+
+	server := &Server{Upstream: startServer(t, upstream)}
+	defer server.Close()
+	dialer := startServer(t, server)
+
+	// resolved at the vantage point of upstream
+	ip, err := dialer.Resolve("pinned.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", ip.String())
+
+	name, err := dialer.ResolvePTR(net.IPv4(127, 0, 0, 1))
+	require.NoError(t, err)
+	assert.NotEmpty(t, name)
+}
+
+type staticResolver map[string][]net.IPAddr
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ipAddrs, ok := r[host]; ok {
+		return ipAddrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestClientParam_ResolveTarget(t *testing.T) {
+	resolver := staticResolver{"dual.test": {{IP: net.ParseIP("2001:db8::1")}, {IP: net.IPv4(192, 0, 2, 1)}}}
+	ctx := context.Background()
+	domain := NewSocksAddrFromString("dual.test")
+
+	// remote by default
+	param := ClientParam{Resolver: resolver}
+	addr, err := param.resolveTarget(ctx, domain)
+	require.NoError(t, err)
+	assert.Equal(t, domain, addr)
+
+	param.Resolve = ResolveLocal
+	for mode, expected := range map[DialMode]string{
+		DialDualStack:  "2001:db8::1",
+		DialPreferIPv4: "192.0.2.1",
+		DialIPv4Only:   "192.0.2.1",
+		DialIPv6Only:   "2001:db8::1",
+	} {
+		param.ResolveFamily = mode
+		addr, err = param.resolveTarget(ctx, domain)
+		require.NoError(t, err)
+		assert.Equal(t, expected, addr.String(), mode.String())
+	}
+
+	// ip is sent as is
+	addr, err = param.resolveTarget(ctx, NewSocksAddrFromString("10.0.0.1"))
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", addr.String())
+
+	_, err = param.resolveTarget(ctx, NewSocksAddrFromString("nope.test"))
+	assert.Error(t, err)
+
+	resolver["v6.test"] = []net.IPAddr{{IP: net.ParseIP("2001:db8::2")}}
+	param.ResolveFamily = DialIPv4Only
+	_, err = param.resolveTarget(ctx, NewSocksAddrFromString("v6.test"))
+	assert.Error(t, err)
+}
+
+func TestDialer_ResolveLocal(t *testing.T) {
+	target := startEchoTarget(t)
+	defer target.Close()
+
+	// a server not accepting domains
+	server := &Server{Rules: RuleSet{{Action: RuleDeny, Domains: []string{"*"}}}}
+	defer server.Close()
+	dialer := startServer(t, server)
+	dialer.Param.Resolver = staticResolver{"target.test": {{IP: net.IPv4(127, 0, 0, 1)}}}
+	address := net.JoinHostPort("target.test", strconv.Itoa(target.Addr().(*net.TCPAddr).Port))
+
+	_, err := dialer.Dial("tcp", address)
+	assert.Equal(t, &ReplyError{Reply: ReplyNotAllowed}, err)
+
+	dialer.Param.Resolve = ResolveLocal
+	conn, err := dialer.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	data, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
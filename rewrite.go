@@ -0,0 +1,83 @@
+package socks_go
+
+import (
+	"net"
+	"strings"
+)
+
+// RewriteRule maps matched destinations to ToHost and ToPort.
+// Domain and Network both empty matches any target.
+type RewriteRule struct {
+	// target domain, "example.com", "*.example.com" or "*"
+	Domain string
+	// target ip
+	Network *net.IPNet
+	// empty matches any port
+	Ports []PortRange
+
+	// domain or ip, empty keeps the original host.
+	// "*.example.org" replaces the suffix matched by "*.example.com" in Domain.
+	ToHost string
+	// zero keeps the original port
+	ToPort uint16
+}
+
+func (r *RewriteRule) match(addr SocksAddr, port uint16) bool {
+	if len(r.Ports) > 0 {
+		found := false
+		for _, pr := range r.Ports {
+			if pr.Contains(port) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	switch {
+	case r.Domain != "":
+		return addr.Type == ATypeDomain && MatchDomain(r.Domain, addr.Domain)
+	case r.Network != nil:
+		return addr.Type != ATypeDomain && r.Network.Contains(addr.IP)
+	default:
+		return true
+	}
+}
+
+func (r *RewriteRule) rewriteHost(addr SocksAddr) SocksAddr {
+	if r.ToHost == "" {
+		return addr
+	}
+
+	if strings.HasPrefix(r.ToHost, "*.") && strings.HasPrefix(r.Domain, "*.") && addr.Type == ATypeDomain {
+		domain := strings.ToLower(strings.TrimSuffix(addr.Domain, "."))
+		suffix := strings.ToLower(strings.TrimSuffix(r.Domain[2:], "."))
+		prefix := strings.TrimSuffix(strings.TrimSuffix(domain, suffix), ".")
+		if prefix == "" {
+			return NewSocksAddrFromString(r.ToHost[2:])
+		}
+		return NewSocksAddrFromString(prefix + "." + r.ToHost[2:])
+	}
+	return NewSocksAddrFromString(r.ToHost)
+}
+
+// Rewriter is checked in order, the first matched rule applies.
+type Rewriter []*RewriteRule
+
+// Rewrite maps the destination, ok is false if no rule matched.
+func (rw Rewriter) Rewrite(addr SocksAddr, port uint16) (newAddr SocksAddr, newPort uint16, ok bool) {
+	for _, rule := range rw {
+		if !rule.match(addr, port) {
+			continue
+		}
+
+		newAddr, newPort = rule.rewriteHost(addr), port
+		if rule.ToPort != 0 {
+			newPort = rule.ToPort
+		}
+		return newAddr, newPort, true
+	}
+	return addr, port, false
+}
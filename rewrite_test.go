@@ -0,0 +1,93 @@
+package socks_go
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewriter(t *testing.T) {
+	_, staging, _ := net.ParseCIDR("10.1.0.0/16")
+	rw := Rewriter{
+		{Domain: "pinned.example.com", ToHost: "192.0.2.1"},
+		{Domain: "*.staging.example.com", ToHost: "*.test.internal", Ports: []PortRange{{Lo: 443, Hi: 443}}, ToPort: 8443},
+		{Network: staging, ToHost: "10.2.0.1"},
+		{Ports: []PortRange{{Lo: 8080, Hi: 8080}}, ToPort: 80},
+	}
+
+	check := func(host string, port uint16, expectHost string, expectPort uint16, expectOK bool) {
+		addr, newPort, ok := rw.Rewrite(NewSocksAddrFromString(host), port)
+		assert.Equal(t, expectOK, ok, host)
+		assert.Equal(t, NewSocksAddrFromString(expectHost), addr, host)
+		assert.Equal(t, expectPort, newPort, host)
+	}
+
+	check("pinned.example.com", 80, "192.0.2.1", 80, true)
+	check("api.staging.example.com", 443, "api.test.internal", 8443, true)
+	check("a.b.staging.example.com", 443, "a.b.test.internal", 8443, true)
+	check("staging.example.com", 443, "test.internal", 8443, true)
+	check("api.staging.example.com", 80, "api.staging.example.com", 80, false)
+	check("10.1.2.3", 22, "10.2.0.1", 22, true)
+	check("10.3.2.3", 22, "10.3.2.3", 22, false)
+	check("example.org", 8080, "example.org", 80, true)
+}
+
+func TestServer_Rewrite(t *testing.T) {
+	target := startEchoTarget(t)
+	defer target.Close()
+	tcpAddr := target.Addr().(*net.TCPAddr)
+
+	udpEcho := startUDPEcho(t)
+	defer udpEcho.Close()
+
+	_, fake, _ := net.ParseCIDR("192.0.2.0/24")
+	_, fakeDomain, _ := net.ParseCIDR("198.51.100.0/24")
+	udpPort := uint16(udpEcho.LocalAddr().(*net.UDPAddr).Port)
+	server := &Server{
+		Rewrites: Rewriter{
+			{Domain: "echo.test", ToHost: "127.0.0.1", ToPort: uint16(tcpAddr.Port)},
+			{Network: fake, ToHost: "127.0.0.1", ToPort: udpPort},
+			{Network: fakeDomain, ToHost: "udp-echo.test", ToPort: udpPort},
+		},
+		// checked after rewriting
+		Rules:       RuleSet{{Action: RuleDeny, Domains: []string{"echo.test"}}},
+		udpResolver: staticResolver{"udp-echo.test": {{IP: net.IPv4(127, 0, 0, 1)}}},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	defer server.Close()
+
+	dialer := &Dialer{ProxyAddr: listener.Addr().String(), Timeout: 3 * time.Second}
+	conn, err := dialer.DialSocksAddr(NewSocksAddrFromString("echo.test"), 1)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(conn)
+	conn.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// udp replies come from the original destination
+	tunnel, err := dialer.UDPAssociation()
+	require.NoError(t, err)
+	defer tunnel.Close()
+	_ = tunnel.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 1024)
+	// rewritten to ip, to domain resolved by relay, and to the cached domain
+	for _, fakeAddr := range []*net.UDPAddr{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 9},
+		{IP: net.IPv4(198, 51, 100, 1), Port: 9},
+		{IP: net.IPv4(198, 51, 100, 2), Port: 9},
+	} {
+		_, err = tunnel.WriteTo([]byte("ping"), fakeAddr)
+		require.NoError(t, err)
+
+		n, from, err := tunnel.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buf[:n]))
+		assert.Equal(t, fakeAddr.String(), from.String())
+	}
+}
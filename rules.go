@@ -0,0 +1,201 @@
+package socks_go
+
+import (
+	"net"
+	"strings"
+)
+
+type RuleAction int
+
+const (
+	RuleAllow RuleAction = iota
+	RuleDeny
+)
+
+type PortRange struct {
+	Lo, Hi uint16
+}
+
+func (pr PortRange) Contains(port uint16) bool {
+	return pr.Lo <= port && port <= pr.Hi
+}
+
+// Rule matches requests by user, command and target, empty fields match anything.
+// For udp association, rules are matched against the target of every datagram,
+// and only Action applies.
+// Networks match domain targets by the resolved address, if the domain is not
+// resolved, deny rules with Networks match it, so a domain can not get around them.
+type Rule struct {
+	Action RuleAction
+	Users  []string
+	// peer credentials on unix socket, never match clients without credentials
+	UIDs []int
+	GIDs []int
+	Cmds []byte
+	// target ip
+	Networks []*net.IPNet
+	// target domain, "example.com", "*.example.com" or "*"
+	Domains []string
+	Ports   []PortRange
+
+	// outbound source address for matched requests, overrides Server.LocalAddrs
+	LocalAddr net.IP
+	// upstream for matched requests, overrides Server.Upstream
+	Upstream *Dialer
+}
+
+// MatchDomain matches domain against pattern, "*.example.com" matches
+// example.com and all its subdomains, "*" matches anything.
+func MatchDomain(pattern string, domain string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return domain == pattern[2:] || strings.HasSuffix(domain, suffix)
+	}
+	return pattern == domain
+}
+
+func containsInt(list []int, x int) bool {
+	for _, v := range list {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchCred(cred *PeerCred) bool {
+	if len(r.UIDs) == 0 && len(r.GIDs) == 0 {
+		return true
+	}
+	if cred == nil {
+		return false
+	}
+	if len(r.UIDs) > 0 && !containsInt(r.UIDs, cred.UID) {
+		return false
+	}
+	return len(r.GIDs) == 0 || containsInt(r.GIDs, cred.GID)
+}
+
+// matchTarget matches addr, ip is the resolved address of domain, nil if unknown.
+func (r *Rule) matchTarget(addr SocksAddr, ip net.IP) bool {
+	if len(r.Networks) == 0 && len(r.Domains) == 0 {
+		return true
+	}
+
+	if addr.Type == ATypeDomain {
+		for _, pattern := range r.Domains {
+			if MatchDomain(pattern, addr.Domain) {
+				return true
+			}
+		}
+		if ip == nil {
+			// fail closed
+			return len(r.Networks) > 0 && r.Action == RuleDeny
+		}
+	} else {
+		ip = addr.IP
+	}
+
+	for _, network := range r.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) Match(identity Identity, cmd byte, addr SocksAddr, port uint16) bool {
+	return r.MatchIP(identity, cmd, addr, port, nil)
+}
+
+// MatchIP is Match with ip, the resolved address of domain target, checked against Networks.
+func (r *Rule) MatchIP(identity Identity, cmd byte, addr SocksAddr, port uint16, ip net.IP) bool {
+	if len(r.Users) > 0 {
+		found := false
+		for _, user := range r.Users {
+			if user == identity.User {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if !r.matchCred(identity.Cred) {
+		return false
+	}
+
+	if len(r.Cmds) > 0 {
+		found := false
+		for _, c := range r.Cmds {
+			if c == cmd {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Ports) > 0 {
+		found := false
+		for _, pr := range r.Ports {
+			if pr.Contains(port) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return r.matchTarget(addr, ip)
+}
+
+// RuleSet is checked in order, the first matched rule wins.
+// Requests matching no rule are allowed.
+type RuleSet []*Rule
+
+func (rs RuleSet) Match(identity Identity, cmd byte, addr SocksAddr, port uint16) *Rule {
+	return rs.MatchIP(identity, cmd, addr, port, nil)
+}
+
+// MatchIP is Match with ip, the resolved address of domain target.
+func (rs RuleSet) MatchIP(identity Identity, cmd byte, addr SocksAddr, port uint16, ip net.IP) *Rule {
+	for _, rule := range rs {
+		if rule.MatchIP(identity, cmd, addr, port, ip) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Allowed checks whether a request is allowed, rule is the matched one or nil.
+func (rs RuleSet) Allowed(identity Identity, cmd byte, addr SocksAddr, port uint16) (allowed bool, rule *Rule) {
+	return rs.AllowedIP(identity, cmd, addr, port, nil)
+}
+
+// AllowedIP is Allowed with ip, the resolved address of domain target.
+func (rs RuleSet) AllowedIP(identity Identity, cmd byte, addr SocksAddr, port uint16, ip net.IP) (allowed bool, rule *Rule) {
+	rule = rs.MatchIP(identity, cmd, addr, port, ip)
+	return rule == nil || rule.Action == RuleAllow, rule
+}
+
+// hasNetworks tells whether domain targets must be resolved for rules.
+func (rs RuleSet) hasNetworks() bool {
+	for _, rule := range rs {
+		if len(rule.Networks) > 0 {
+			return true
+		}
+	}
+	return false
+}
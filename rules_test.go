@@ -0,0 +1,130 @@
+package socks_go
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchDomain(t *testing.T) {
+	assert.True(t, MatchDomain("example.com", "Example.COM."))
+	assert.False(t, MatchDomain("example.com", "www.example.com"))
+	assert.True(t, MatchDomain("*.example.com", "example.com"))
+	assert.True(t, MatchDomain("*.example.com", "a.b.example.com"))
+	assert.False(t, MatchDomain("*.example.com", "badexample.com"))
+	assert.True(t, MatchDomain("*", "anything"))
+}
+
+func TestRuleSet(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.0.0/16")
+	rules := RuleSet{
+		{Action: RuleAllow, Users: []string{"admin"}},
+		{Action: RuleDeny, Networks: []*net.IPNet{lan}},
+		{Action: RuleDeny, Domains: []string{"*.example.com"}, Ports: []PortRange{{Lo: 1, Hi: 1023}}},
+		{Action: RuleDeny, Cmds: []byte{CmdBind}},
+		{Action: RuleDeny, UIDs: []int{1000}, GIDs: []int{100}},
+	}
+
+	lanAddr := NewSocksAddrFromString("192.168.1.1")
+	domain := NewSocksAddrFromString("www.example.com")
+	public := NewSocksAddrFromString("1.1.1.1")
+	user := Identity{Method: MethodUserName, User: "foo"}
+
+	allowed, rule := rules.Allowed(Identity{User: "admin"}, CmdConnect, lanAddr, 80)
+	assert.True(t, allowed)
+	assert.Equal(t, rules[0], rule)
+
+	allowed, rule = rules.Allowed(user, CmdConnect, lanAddr, 80)
+	assert.False(t, allowed)
+	assert.Equal(t, rules[1], rule)
+
+	allowed, _ = rules.Allowed(user, CmdUDP, domain, 443)
+	assert.False(t, allowed)
+	// domains are checked against networks by the resolved address, denied if not resolved
+	allowed, _ = rules.AllowedIP(user, CmdConnect, domain, 8080, public.IP)
+	assert.True(t, allowed)
+	allowed, rule = rules.AllowedIP(user, CmdConnect, domain, 8080, lanAddr.IP)
+	assert.False(t, allowed)
+	assert.Equal(t, rules[1], rule)
+	allowed, rule = rules.Allowed(user, CmdConnect, domain, 8080)
+	assert.False(t, allowed)
+	assert.Equal(t, rules[1], rule)
+
+	allowed, _ = rules.Allowed(user, CmdBind, public, 0)
+	assert.False(t, allowed)
+
+	allowed, _ = rules.Allowed(Identity{Cred: &PeerCred{UID: 1000, GID: 100}}, CmdConnect, public, 443)
+	assert.False(t, allowed)
+	allowed, _ = rules.Allowed(Identity{Cred: &PeerCred{UID: 1000, GID: 1000}}, CmdConnect, public, 443)
+	assert.True(t, allowed)
+
+	// no rule matched
+	allowed, rule = rules.Allowed(user, CmdConnect, public, 443)
+	assert.True(t, allowed)
+	assert.Nil(t, rule)
+}
+
+func TestServer_RuleNetworksOfDomain(t *testing.T) {
+	target := startEchoTarget(t)
+	defer target.Close()
+	tcpPort := uint16(target.Addr().(*net.TCPAddr).Port)
+	udpEcho := startUDPEcho(t)
+	defer udpEcho.Close()
+	udpPort := uint16(udpEcho.LocalAddr().(*net.UDPAddr).Port)
+
+	_, loopback4, _ := net.ParseCIDR("127.0.0.0/8")
+	_, loopback6, _ := net.ParseCIDR("::1/128")
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	localhost := NewSocksAddrFromString("localhost")
+
+	for _, noBatch := range []bool{false, true} {
+		// localhost resolves into denied networks
+		server := &Server{
+			Rules:      RuleSet{{Action: RuleDeny, Networks: []*net.IPNet{loopback4, loopback6}}},
+			noUDPBatch: noBatch,
+		}
+		dialer := startServer(t, server)
+
+		_, err := dialer.DialSocksAddr(localhost, tcpPort)
+		require.Error(t, err)
+		assert.Equal(t, &ReplyError{ReplyNotAllowed}, errors.Cause(err))
+
+		tunnel, err := dialer.UDPAssociation()
+		require.NoError(t, err)
+		_, err = tunnel.WriteToSocksAddr([]byte("ping"), localhost, udpPort)
+		require.NoError(t, err)
+		_ = tunnel.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, _, err = tunnel.ReadFrom(make([]byte, 100))
+		assert.Error(t, err, "datagram not denied")
+		tunnel.Close()
+		server.Close()
+
+		// not in denied networks
+		server = &Server{Rules: RuleSet{{Action: RuleDeny, Networks: []*net.IPNet{lan}}}, noUDPBatch: noBatch}
+		dialer = startServer(t, server)
+
+		conn, err := dialer.DialSocksAddr(localhost, tcpPort)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(conn)
+		conn.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+
+		tunnel, err = dialer.UDPAssociation()
+		require.NoError(t, err)
+		_, err = tunnel.WriteToSocksAddr([]byte("ping"), localhost, udpPort)
+		require.NoError(t, err)
+		_ = tunnel.SetReadDeadline(time.Now().Add(3 * time.Second))
+		buf := make([]byte, 100)
+		n, _, err := tunnel.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buf[:n]))
+		tunnel.Close()
+		server.Close()
+	}
+}
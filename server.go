@@ -1,9 +1,15 @@
 package socks_go
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
 	"io"
+	"math/rand"
 	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"bytes"
@@ -16,10 +22,66 @@ import (
 type AuthHandlerFunc func(methods []byte, proto *ServerProtocol) error
 
 type Server struct {
+	// first field for 64-bit atomic alignment on 32-bit platforms
+	stats counters
+
+	// listen on Addr if not empty, in addition to Listeners
 	Addr           string
 	AuthHandler    AuthHandlerFunc
 	ConnectTimeout time.Duration
-	IPV4Only       bool
+	// deprecated: use DialMode
+	IPV4Only bool
+	DialMode DialMode
+	// delay between connection attempts to multiple addresses of a target
+	AttemptDelay time.Duration
+	// outbound source addresses, rotated round-robin
+	LocalAddrs []net.IP
+	// chooses outbound source address per request, e.g. per user, overrides LocalAddrs.
+	// nil means default.
+	LocalAddrFunc func(proto *ServerProtocol, addr SocksAddr, port uint16) net.IP
+	// bind outbound sockets to the network interface (SO_BINDTODEVICE)
+	BindDevice string
+	// chain requests to another socks5 server instead of connecting to targets directly
+	Upstream *Dialer
+	// how long to wait for the peer of BIND command
+	BindTimeout time.Duration
+	// access rules, checked against rewritten destinations
+	Rules RuleSet
+	// destination rewriting for CONNECT and udp relay
+	Rewrites Rewriter
+	// timeout for auth and reading request, zero means no timeout
+	HandshakeTimeout time.Duration
+	// maximum number of concurrent connections of all listeners, streams of mux
+	// are counted as connections. zero means no limit
+	MaxConns int
+	// more listeners with their own policy
+	Listeners []*Listener
+	// extension points through the session lifecycle
+	Hooks Hooks
+	// at most UDPWorkers batches of udp datagrams are forwarded at a time, shared by all
+	// udp associations, each of which waits for data without buffers. zero or negative
+	// means 4 * GOMAXPROCS.
+	UDPWorkers int
+	// if not nil, udp associations share the client-facing port of UDPMux
+	// instead of opening one for each
+	UDPMux *UDPMux
+	// ports of outbound udp sockets, zero means ephemeral ports
+	UDPPortRange PortRange
+
+	localAddrIdx    uint32
+	defaultListener *Listener
+	udpWorkers      *udpWorkerPool
+	initOnce        sync.Once
+	mu              sync.Mutex
+	listeners       map[net.Listener]struct{}
+	closed          bool
+	// counters of the replaced server, see InheritStats
+	inherited *counters
+
+	// batching is used if supported, disabled in tests for the portable path
+	noUDPBatch bool
+	// for domains of udp datagrams, net.DefaultResolver if nil, replaced in tests
+	udpResolver Resolver
 }
 
 func noAuthHandler(methods []byte, proto *ServerProtocol) error {
@@ -27,63 +89,238 @@ func noAuthHandler(methods []byte, proto *ServerProtocol) error {
 }
 
 func (s *Server) init() {
+	s.initOnce.Do(s.doInit)
+}
+
+func (s *Server) doInit() {
 	if s.AuthHandler == nil {
 		s.AuthHandler = noAuthHandler
 	}
 	if s.ConnectTimeout == 0 {
 		s.ConnectTimeout = 3 * time.Second
 	}
+	if s.IPV4Only {
+		s.DialMode = DialIPv4Only
+	}
+	if s.AttemptDelay == 0 {
+		s.AttemptDelay = defaultAttemptDelay
+	}
+	if s.BindTimeout == 0 {
+		s.BindTimeout = 60 * time.Second
+	}
+	if s.UDPWorkers <= 0 {
+		s.UDPWorkers = 4 * runtime.GOMAXPROCS(0)
+	}
+	s.udpWorkers = newUDPWorkerPool(s.UDPWorkers)
+	s.defaultListener = &Listener{Addr: s.Addr}
 }
 
-// TODO: quitable?
+// Stats returns the counters of all listeners.
+func (s *Server) Stats() Stats {
+	return s.counters().snapshot()
+}
+
+// InheritStats makes s continue the counters of old, which s replaces, e.g. on config reload.
+// Sessions still served by old are counted by both, MaxConns included. Call it before serving.
+func (s *Server) InheritStats(old *Server) {
+	s.inherited = old.counters()
+}
+
+func (s *Server) counters() *counters {
+	if s.inherited != nil {
+		return s.inherited
+	}
+	return &s.stats
+}
+
+// Run listens on Addr and all Listeners, returns after all of them stopped.
 func (s *Server) Run() (err error) {
 	s.init()
 
-	listener, err := net.Listen("tcp", s.Addr)
-	if err != nil {
-		return
+	all := s.Listeners
+	if s.Addr != "" {
+		all = append([]*Listener{s.defaultListener}, all...)
+	}
+	if len(all) == 0 {
+		return errors.New("no listener")
+	}
+
+	netListeners := make([]net.Listener, 0, len(all))
+	for _, l := range all {
+		var listener net.Listener
+		listener, err = l.Listen()
+		if err != nil {
+			for _, opened := range netListeners {
+				opened.Close()
+			}
+			return errors.Wrapf(err, "can not listen on %v", l.Addr)
+		}
+		log.Infof("server started on %v", listener.Addr())
+		netListeners = append(netListeners, listener)
+	}
+
+	errChan := make(chan error, len(all))
+	for i := range all {
+		go func(l *Listener, listener net.Listener) {
+			errChan <- s.ServeOn(l, listener)
+		}(all[i], netListeners[i])
+	}
+	for range all {
+		if serveErr := <-errChan; serveErr != nil && err == nil {
+			err = serveErr
+		}
+	}
+	return
+}
+
+// Serve accepts connections on listener until Close is called.
+func (s *Server) Serve(listener net.Listener) error {
+	s.init()
+	return s.ServeOn(s.defaultListener, listener)
+}
+
+// ServeOn accepts connections on listener with the policy of l until Close is called.
+func (s *Server) ServeOn(l *Listener, listener net.Listener) error {
+	s.init()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return errors.New("server closed")
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
 	}
-	log.Infof("server started on %v", listener.Addr())
+	s.listeners[listener] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, listener)
+		s.mu.Unlock()
+	}()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Errorf("Accept failed: %v", err)
-			continue
-		} else {
-			log.Infof("Accept %v", conn.RemoteAddr())
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Errorf("Accept failed: %v", err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return errors.Wrapf(err, "Accept failed on %v", listener.Addr())
 		}
 
-		go s.handleConnection(conn)
+		log.Infof("Accept %v on %v", conn.RemoteAddr(), listener.Addr())
+		go s.ServeConnOn(l, conn)
+	}
+}
+
+// ServeConn handles a client connection and closes it when done.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.init()
+	s.ServeConnOn(s.defaultListener, conn)
+}
+
+// ServeConnOn handles a client connection with the policy of l and closes it when done.
+func (s *Server) ServeConnOn(l *Listener, conn net.Conn) {
+	s.init()
+
+	if !s.admit(l, conn.RemoteAddr()) {
+		conn.Close()
+		return
+	}
+	defer addCounter(s, l, counterActive, -1)
+
+	cred := getPeerCred(conn)
+	if l.TLSConfig != nil {
+		conn = tls.Server(conn, l.TLSConfig)
 	}
+	s.handleConnection(l, conn, cred)
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
+// admit counts a client connection or mux stream as accepted and active, returns false
+// if over MaxConns. The active counter is decremented by caller when admitted.
+func (s *Server) admit(l *Listener, remote net.Addr) bool {
+	addCounter(s, l, counterAccepted, 1)
+	numConns := addCounter(s, l, counterActive, 1)
+	if s.MaxConns > 0 && int(numConns) > s.MaxConns {
+		addCounter(s, l, counterActive, -1)
+		log.Warnf("client: %v, too many connections: %d", remote, numConns)
+		return false
+	}
+	return true
+}
+
+// Close stops accepting new connections on all listeners, existing sessions are not affected.
+func (s *Server) Close() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for listener := range s.listeners {
+		if closeErr := listener.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return
+}
+
+func (s *Server) handleConnection(l *Listener, conn net.Conn, cred *PeerCred) {
 	var err error
+	sess := &Session{Listener: l, Conn: conn, Start: time.Now()}
 
 	defer func() {
 		if err != nil {
+			addCounter(s, l, counterFailed, 1)
 			log.Errorf("client: %v, err: %v", conn.RemoteAddr(), err)
 		}
+		sess.Err = err
 
-		err = conn.Close()
+		err = sess.Conn.Close()
 		if err != nil {
 			log.Errorf("client: %v, close err: %v", conn.RemoteAddr(), err)
 		}
 
 		log.Infof("client: %v, gone", conn.RemoteAddr())
+		s.Hooks.close(sess)
 	}()
 
-	proto := NewServerProtocol(conn)
+	err = s.Hooks.accept(sess)
+	if err != nil {
+		err = errors.Wrap(err, "rejected by OnAccept")
+		return
+	}
+
+	proto := NewServerProtocol(sess.Conn)
+	sess.Proto = &proto
+	proto.Identity.Cred = cred
+	if cred != nil {
+		log.Infof("client: %v, peer pid: %d, uid: %d, gid: %d", conn.RemoteAddr(), cred.PID, cred.UID, cred.GID)
+	}
+	proto.methodHook = func(method byte) error {
+		return s.Hooks.method(sess, method)
+	}
+
+	if s.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
 
 	// auth
-	var methods []byte
-	methods, err = proto.GetAuthMethods()
+	sess.Methods, err = proto.GetAuthMethods()
 	if err != nil {
 		return
 	}
 
-	err = s.AuthHandler(methods, &proto)
+	err = s.authHandler(l)(sess.Methods, &proto)
 	if err != nil {
 		return
 	}
@@ -93,37 +330,257 @@ func (s *Server) handleConnection(conn net.Conn) {
 		return
 	}
 
+	err = s.Hooks.auth(sess)
+	if err != nil {
+		err = errors.Wrap(err, "rejected by OnAuth")
+		return
+	}
+
 	// request
-	var cmd byte
-	var addr SocksAddr
-	var port uint16
-	cmd, addr, port, err = proto.GetRequest()
+	sess.Cmd, sess.Addr, sess.Port, err = proto.GetRequest()
+	if err != nil {
+		return
+	}
+
+	if s.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Time{})
+	}
+
+	err = s.handleRequest(sess)
+	return
+}
+
+// handleRequest checks and serves the request of sess, of a client connection or a mux stream.
+func (s *Server) handleRequest(sess *Session) (err error) {
+	conn, proto, l := sess.Conn, sess.Proto, sess.Listener
+
+	err = s.Hooks.request(sess)
 	if err != nil {
+		proto.RejectRequest(hookReply(err)) // ignore err
+		err = errors.Wrap(err, "rejected by OnRequest")
 		return
 	}
 
-	switch cmd {
+	// udp datagrams are rewritten and checked one by one
+	if sess.Cmd == CmdConnect || sess.Cmd == CmdResolve {
+		if addr, port, ok := s.Rewrites.Rewrite(sess.Addr, sess.Port); ok {
+			log.Infof("client: %v, rewrite %v:%d to %v:%d", conn.RemoteAddr(), sess.Addr, sess.Port, addr, port)
+			sess.Addr, sess.Port = addr, port
+		}
+	}
+	// streams of mux are checked one by one
+	if sess.Cmd != CmdUDP && sess.Cmd != CmdUDPOverTCP && sess.Cmd != CmdMux {
+		var allowed bool
+		allowed, sess.Rule = s.checkRules(sess)
+		if !allowed {
+			addCounter(s, l, counterDenied, 1)
+			err = errors.Errorf("request denied by rule. user: %q, cmd: %#x, target: %v:%d",
+				proto.Identity.User, sess.Cmd, sess.Addr, sess.Port)
+			proto.RejectRequest(ReplyNotAllowed) // ignore err
+			return
+		}
+	}
+
+	switch sess.Cmd {
 	case CmdConnect:
-		log.Infof("client: %v, cmd: connect, target: %v:%d", conn.RemoteAddr(), addr, port)
-		err = s.cmdConnect(conn, &proto, addr, port)
+		log.Infof("client: %v, cmd: connect, target: %v:%d", conn.RemoteAddr(), sess.Addr, sess.Port)
+		err = s.cmdConnect(sess)
 	case CmdUDP:
-		log.Infof("client: %v, cmd: udp, client_from: %v:%d", conn.RemoteAddr(), addr, port)
-		err = s.cmdUDP(conn, &proto, addr, port)
+		log.Infof("client: %v, cmd: udp, client_from: %v:%d", conn.RemoteAddr(), sess.Addr, sess.Port)
+		err = s.cmdUDP(sess)
+	case CmdUDPOverTCP:
+		log.Infof("client: %v, cmd: udp over tcp", conn.RemoteAddr())
+		err = s.cmdUDPOverTCP(sess)
+	case CmdBind:
+		log.Infof("client: %v, cmd: bind, peer: %v:%d", conn.RemoteAddr(), sess.Addr, sess.Port)
+		err = s.cmdBind(sess)
+	case CmdResolve, CmdResolvePTR:
+		log.Infof("client: %v, cmd: %#x, target: %v", conn.RemoteAddr(), sess.Cmd, sess.Addr)
+		err = s.cmdResolve(sess)
+	case CmdMux:
+		log.Infof("client: %v, cmd: mux", conn.RemoteAddr())
+		err = s.cmdMux(sess)
 	default:
-		err = errors.Errorf("unsupported cmd: %#x", cmd)
+		err = errors.Errorf("unsupported cmd: %#x", sess.Cmd)
 		proto.RejectRequest(ReplyCmdNotSupported) // ignore err
 	}
 	return
 }
 
-func (s *Server) makeConnection(addr SocksAddr, port uint16) (net.Conn, error) {
-	network := "tcp"
-	if s.IPV4Only {
-		network = "tcp4"
+// checkRules matches the request against rules. Domain targets of CONNECT are resolved
+// for Networks of rules, and only the allowed addresses are dialed.
+func (s *Server) checkRules(sess *Session) (allowed bool, rule *Rule) {
+	rules, identity := s.rules(sess.Listener), sess.Proto.Identity
+	if sess.Cmd != CmdConnect || sess.Addr.Type != ATypeDomain || !rules.hasNetworks() {
+		return rules.Allowed(identity, sess.Cmd, sess.Addr, sess.Port)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.ConnectTimeout)
+	defer cancel()
+	ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, sess.Addr.Domain)
+	if err != nil {
+		log.Warnf("client: %v, can not resolve %q for rules: %v", sess.Conn.RemoteAddr(), sess.Addr.Domain, err)
+		return rules.Allowed(identity, sess.Cmd, sess.Addr, sess.Port)
+	}
+
+	var denied *Rule
+	sess.resolved = nil
+	for _, ipAddr := range ipAddrs {
+		ok, r := rules.AllowedIP(identity, sess.Cmd, sess.Addr, sess.Port, ipAddr.IP)
+		if !ok {
+			if denied == nil {
+				denied = r
+			}
+			continue
+		}
+		if len(sess.resolved) == 0 {
+			rule = r
+		}
+		sess.resolved = append(sess.resolved, ipAddr)
+	}
+	if len(sess.resolved) == 0 {
+		return false, denied
+	}
+	return true, rule
+}
+
+func (s *Server) authHandler(l *Listener) AuthHandlerFunc {
+	if l.AuthHandler != nil {
+		return l.AuthHandler
+	}
+	return s.AuthHandler
+}
+
+func (s *Server) rules(l *Listener) RuleSet {
+	if l.Rules != nil {
+		return l.Rules
+	}
+	return s.Rules
+}
+
+func (s *Server) upstream(l *Listener, rule *Rule) *Dialer {
+	if rule != nil && rule.Upstream != nil {
+		return rule.Upstream
+	}
+	if l.Upstream != nil {
+		return l.Upstream
+	}
+	return s.Upstream
+}
+
+// localAddr chooses outbound source address for a request.
+func (s *Server) localAddr(proto *ServerProtocol, l *Listener, rule *Rule, addr SocksAddr, port uint16) net.IP {
+	if rule != nil && rule.LocalAddr != nil {
+		return rule.LocalAddr
+	}
+	if len(l.LocalAddrs) > 0 {
+		idx := atomic.AddUint32(&l.localAddrIdx, 1)
+		return l.LocalAddrs[int(idx)%len(l.LocalAddrs)]
+	}
+	if s.LocalAddrFunc != nil {
+		return s.LocalAddrFunc(proto, addr, port)
+	}
+	if len(s.LocalAddrs) == 0 {
+		return nil
+	}
+	idx := atomic.AddUint32(&s.localAddrIdx, 1)
+	return s.LocalAddrs[int(idx)%len(s.LocalAddrs)]
+}
+
+func (s *Server) control(l *Listener) func(network, address string, c syscall.RawConn) error {
+	device := l.BindDevice
+	if device == "" {
+		device = s.BindDevice
+	}
+	if device == "" {
+		return nil
+	}
+	return bindDeviceControl(device)
+}
+
+// makeConnection dials the target, ips are the resolved addresses of domain, looked up if nil.
+func (s *Server) makeConnection(proto *ServerProtocol, l *Listener, rule *Rule, addr SocksAddr, port uint16, ips []net.IPAddr) (net.Conn, error) {
+	if upstream := s.upstream(l, rule); upstream != nil {
+		return upstream.DialSocksAddr(addr, port)
+	}
+
+	dialer := happyDialer{
+		IPs:          ips,
+		Mode:         s.DialMode,
+		Timeout:      s.ConnectTimeout,
+		AttemptDelay: s.AttemptDelay,
+		LocalIP:      s.localAddr(proto, l, rule, addr, port),
+		Control:      s.control(l),
+	}
+	return dialer.Dial(addr, port)
+}
+
+// outbound side of udp relay
+type udpRemote interface {
+	net.PacketConn
+	WriteToSocksAddr(b []byte, addr SocksAddr, port uint16) (int, error)
+}
+
+// sends to targets directly
+type directUDPRemote struct {
+	*net.UDPConn
+}
+
+func (r directUDPRemote) WriteToSocksAddr(b []byte, addr SocksAddr, port uint16) (int, error) {
+	// find out destination addr
+	// TODO: create domain to ip mapping
+	toAddr, err := socksAddrToUDPAddr(addr, port)
+	if err != nil {
+		return 0, errors.Wrapf(err, "socksAddrToUDPAddr error")
 	}
-	return net.DialTimeout(network, fmt.Sprintf("%v:%d", addr, port), s.ConnectTimeout)
+	return r.WriteToUDP(b, toAddr)
 }
 
+// makeUDPRemote creates the outbound socket of udp relay.
+func (s *Server) makeUDPRemote(proto *ServerProtocol, l *Listener, addr SocksAddr, port uint16) (udpRemote, error) {
+	if upstream := s.upstream(l, nil); upstream != nil {
+		tunnel, err := upstream.UDPAssociation()
+		if err != nil {
+			return nil, errors.Wrap(err, "upstream udp association failed")
+		}
+		return tunnel, nil
+	}
+
+	lc := net.ListenConfig{Control: s.control(l)}
+	local := &net.UDPAddr{IP: s.localAddr(proto, l, nil, addr, port)}
+	if s.UDPPortRange.Hi == 0 {
+		conn, err := lc.ListenPacket(context.Background(), "udp", local.String())
+		if err != nil {
+			return nil, err
+		}
+		return directUDPRemote{conn.(*net.UDPConn)}, nil
+	}
+
+	// try ports from a random one, so that ports freed recently are less likely reused
+	pr := s.UDPPortRange
+	count := int(pr.Hi) - int(pr.Lo) + 1
+	start := rand.Intn(count)
+	var err error
+	for i := 0; i < count; i++ {
+		local.Port = int(pr.Lo) + (start+i)%count
+		var conn net.PacketConn
+		conn, err = lc.ListenPacket(context.Background(), "udp", local.String())
+		if err == nil {
+			return directUDPRemote{conn.(*net.UDPConn)}, nil
+		}
+		if !isAddrInUse(err) {
+			return nil, err
+		}
+	}
+	return nil, errors.Wrapf(err, "no free udp port in %d-%d", pr.Lo, pr.Hi)
+}
+
+func isAddrInUse(err error) bool {
+	return errors.Is(err, errAddrInUse)
+}
+
+// parseNetAddr converts ip addresses for replies, addresses without ip,
+// e.g. unix sockets of upstream proxies, are 0.0.0.0:0.
 func parseNetAddr(netAddr net.Addr) (addr SocksAddr, port uint16, err error) {
 	switch concreteAddr := netAddr.(type) {
 	case *net.TCPAddr:
@@ -132,47 +589,58 @@ func parseNetAddr(netAddr net.Addr) (addr SocksAddr, port uint16, err error) {
 	case *net.UDPAddr:
 		addr = NewSocksAddrFromIP(concreteAddr.IP)
 		port = uint16(concreteAddr.Port)
+	case *net.UnixAddr, nil:
+		addr = NewSocksAddr()
 	default:
 		err = errors.Errorf("unknown addr: %v (%T)", netAddr, netAddr)
 	}
 	return
 }
 
-func (s *Server) cmdConnect(conn net.Conn, proto *ServerProtocol, addr SocksAddr, port uint16) (err error) {
+func (s *Server) cmdConnect(sess *Session) (err error) {
+	proto := sess.Proto
 	var targetConn net.Conn
 
 	defer func() {
-		if targetConn != nil {
-			// TODO: reject connection on error
-			closeErr := targetConn.Close()
+		if sess.Target != nil {
+			closeErr := sess.Target.Close()
 			if closeErr != nil {
 				log.Errorf("close target conn err: %v", closeErr)
 			}
 		}
 	}()
 
-	targetConn, err = s.makeConnection(addr, port)
+	targetConn, err = s.makeConnection(proto, sess.Listener, sess.Rule, sess.Addr, sess.Port, sess.resolved)
 	if err != nil {
+		proto.RejectRequest(dialErrorReply(err)) // ignore err
 		return
 	}
 	log.Infof("connected to %v from %v", targetConn.RemoteAddr(), targetConn.LocalAddr())
 
+	sess.Target, sess.Client = targetConn, proto.Transport
+	err = s.Hooks.dial(sess)
+	if err != nil {
+		proto.RejectRequest(hookReply(err)) // ignore err
+		err = errors.Wrap(err, "rejected by OnDial")
+		return
+	}
+
 	var bindAddr SocksAddr
 	var bindPort uint16
 	bindAddr, bindPort, err = parseNetAddr(targetConn.LocalAddr())
 	if err != nil {
+		proto.RejectRequest(ReplyFail) // ignore err
 		err = errors.Wrapf(err, "can not parse LocalAddr: %v", targetConn.LocalAddr())
 		return
 	}
 
-	var tunnel io.ReadWriter
-	tunnel, err = proto.AcceptConnection(bindAddr, bindPort)
+	_, err = proto.AcceptConnection(bindAddr, bindPort)
 	if err != nil {
 		return
 	}
 
-	cr := util.BridgeReaderWriter(tunnel, targetConn)
-	cw := util.BridgeReaderWriter(targetConn, tunnel)
+	cr := util.BridgeReaderWriter(countingReader{sess.Client, &sess.bytesUp}, sess.Target)
+	cw := util.BridgeReaderWriter(countingReader{sess.Target, &sess.bytesDown}, sess.Client)
 
 	// wait for client or target
 	merr := util.NewMultipleErrors()
@@ -190,193 +658,245 @@ func (s *Server) cmdConnect(conn net.Conn, proto *ServerProtocol, addr SocksAddr
 	return
 }
 
-func doClose(closer io.Closer, closed *bool, msg string) {
-	if closer == nil || *closed {
-		return
+// acceptBindPeer waits for a connection from the expected peer ip,
+// any ip is allowed if addr is not an ip or unspecified.
+func acceptBindPeer(listener *net.TCPListener, addr SocksAddr) (net.Conn, error) {
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+
+		if addr.Type == ATypeDomain || addr.IP.IsUnspecified() {
+			return conn, nil
+		}
+		peerIP := conn.RemoteAddr().(*net.TCPAddr).IP
+		if peerIP.Equal(addr.IP) {
+			return conn, nil
+		}
+
+		log.Warnf("bind: unexpected peer %v, expect %v", conn.RemoteAddr(), addr)
+		conn.Close()
+	}
+}
+
+func (s *Server) cmdBind(sess *Session) (err error) {
+	conn, proto, addr := sess.Conn, sess.Proto, sess.Addr
+	if s.upstream(sess.Listener, nil) != nil {
+		proto.RejectRequest(ReplyCmdNotSupported) // ignore err
+		return errors.New("bind: not supported with upstream")
 	}
 
-	err := closer.Close()
+	// listen on the ip which client connected to
+	var listenIP net.IP
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		listenIP = tcpAddr.IP
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: listenIP})
 	if err != nil {
-		log.Errorf("close %s err: %v", msg, err)
+		proto.RejectRequest(ReplyFail) // ignore err
+		err = errors.Wrap(err, "bind: can not listen")
+		return
 	}
-	*closed = true
-}
+	defer func() {
+		if listener != nil {
+			listener.Close()
+		}
+	}()
 
-func (s *Server) cmdUDP(conn net.Conn, proto *ServerProtocol, addr SocksAddr, port uint16) (err error) {
-	// udp sockets will be close when:
-	// 	a. tcp connnection is finished (success or not)
-	//  b. reading/writing error on udp sockets
-	//  c. other error before entering main loop
-	var clientConn, remoteConn *net.UDPConn
-	clientConnClosed, remoteConnClosed := false, false
+	bindAddr, bindPort, err := parseNetAddr(listener.Addr())
+	if err != nil {
+		proto.RejectRequest(ReplyFail) // ignore err
+		return
+	}
+	err = proto.AcceptBind(bindAddr, bindPort)
+	if err != nil {
+		return
+	}
+	log.Infof("client: %v, bind: listening on %v", conn.RemoteAddr(), listener.Addr())
 
-	// clean up udp socket
+	// the client sends nothing before the second reply, stop listening once it is gone
+	type watchResult struct {
+		early []byte
+		err   error
+	}
+	watched := make(chan watchResult, 1)
+	go func(listener net.Listener) {
+		buf := make([]byte, 1)
+		n, rerr := proto.Transport.Read(buf)
+		if n == 0 {
+			listener.Close()
+		}
+		watched <- watchResult{buf[:n], rerr}
+	}(listener)
+
+	_ = listener.SetDeadline(time.Now().Add(s.BindTimeout))
+	peerConn, err := acceptBindPeer(listener, addr)
+	listener.Close()
+	listener = nil
+	// interrupt the watcher
+	_ = conn.SetReadDeadline(pastDeadline)
+	watch := <-watched
+	_ = conn.SetReadDeadline(time.Time{})
+	if netErr, ok := watch.err.(net.Error); len(watch.early) == 0 && !(ok && netErr.Timeout()) {
+		if peerConn != nil {
+			peerConn.Close()
+		}
+		err = errors.Wrap(watch.err, "bind: client gone")
+		return
+	}
+	if err != nil {
+		proto.RejectRequest(dialErrorReply(err)) // ignore err
+		err = errors.Wrap(err, "bind: no peer connected")
+		return
+	}
+	sess.Target, sess.Client = peerConn, proto.Transport
+	if len(watch.early) > 0 {
+		sess.Client = struct {
+			io.Reader
+			io.Writer
+		}{io.MultiReader(bytes.NewReader(watch.early), proto.Transport), proto.Transport}
+	}
 	defer func() {
-		// condition c
-		doClose(remoteConn, &clientConnClosed, "remote udp conn")
-		doClose(clientConn, &remoteConnClosed, "client udp conn")
+		closeErr := sess.Target.Close()
+		if closeErr != nil {
+			log.Errorf("close peer conn err: %v", closeErr)
+		}
 	}()
+	log.Infof("client: %v, bind: peer %v connected", conn.RemoteAddr(), peerConn.RemoteAddr())
 
-	// create udp socket
-	clientConn, err = net.ListenUDP("udp", nil) // FIXME: listen on tcp addr ip
+	err = s.Hooks.dial(sess)
 	if err != nil {
-		err = errors.Wrapf(err, "error creating client udp socket")
+		proto.RejectRequest(hookReply(err)) // ignore err
+		err = errors.Wrap(err, "rejected by OnDial")
 		return
 	}
-	remoteConn, err = net.ListenUDP("udp", nil)
+
+	peerAddr, peerPort, err := parseNetAddr(peerConn.RemoteAddr())
+	if err != nil {
+		proto.RejectRequest(ReplyFail) // ignore err
+		return
+	}
+	_, err = proto.AcceptBindPeer(peerAddr, peerPort)
+	if err != nil {
+		return
+	}
+
+	cr := util.BridgeReaderWriter(countingReader{sess.Client, &sess.bytesUp}, sess.Target)
+	cw := util.BridgeReaderWriter(countingReader{sess.Target, &sess.bytesDown}, sess.Client)
+
+	// wait for client or peer
+	merr := util.NewMultipleErrors()
+	select {
+	case rerr := <-cr:
+		merr.Add("ReadClient", rerr)
+		merr.Add("WritePeer", <-cr)
+	case rerr := <-cw:
+		log.Infof("peer gone: %v", peerConn.RemoteAddr())
+		merr.Add("ReadPeer", rerr)
+		merr.Add("WriteClient", <-cw)
+	}
+	err = merr.ToError()
+	return
+}
+
+func (s *Server) cmdUDP(sess *Session) (err error) {
+	conn, proto, l := sess.Conn, sess.Proto, sess.Listener
+	// udp sockets will be close when:
+	// 	a. tcp connnection is finished (success or not)
+	//  b. reading/writing error on udp sockets
+	//  c. other error before starting relay
+	remoteConn, err := s.makeUDPRemote(proto, l, sess.Addr, sess.Port)
 	if err != nil {
 		err = errors.Wrapf(err, "error creating remote udp socket")
 		return
 	}
+	relay, err := s.makeUDPRelay(sess, remoteConn)
+	if err != nil {
+		proto.RejectRequest(ReplyFail) // ignore err
+		remoteConn.Close()
+		return
+	}
 	log.Infof("client: %v, client_udp_listen: %v, remote_udp_listen: %v",
-		conn.RemoteAddr(), clientConn.LocalAddr(), remoteConn.LocalAddr())
+		conn.RemoteAddr(), relay.client.LocalAddr(), remoteConn.LocalAddr())
 
-	bindAddr, bindPort, parseErr := parseNetAddr(clientConn.LocalAddr())
+	// condition c
+	bindAddr, bindPort, parseErr := parseNetAddr(relay.client.LocalAddr())
 	if parseErr != nil { // unlikely to happen
-		err = errors.Wrapf(parseErr, "can not parse LocalAddr: %v", clientConn.LocalAddr())
+		proto.RejectRequest(ReplyFail) // ignore err
+		relay.stop(nil)
+		err = errors.Wrapf(parseErr, "can not parse LocalAddr: %v", relay.client.LocalAddr())
 		return
 	}
 
 	// reply client
 	err = proto.AcceptUdpAssociation(bindAddr, bindPort)
 	if err != nil {
+		relay.stop(nil)
 		return
 	}
 
-	// monitor tcp connection
-	ctrlChannel := make(chan error, 1)
-	go func() {
-		buf := make([]byte, 1)
-		for {
-			n, tcpErr := conn.Read(buf) // TODO: timeout?
-			if n != 0 {
-				log.Warnf("client: %v, data received after udp association cmd", conn.RemoteAddr())
-			}
+	// condition a & b are handled by relay
+	return relay.run()
+}
 
-			if tcpErr != nil {
-				if tcpErr == io.EOF {
-					tcpErr = nil
-				}
-				ctrlChannel <- tcpErr
-				return
-			}
+// makeUDPRelay joins UDPMux or creates the client udp socket of association.
+func (s *Server) makeUDPRelay(sess *Session, remoteConn udpRemote) (*udpRelay, error) {
+	if s.UDPMux != nil {
+		relay := s.newUDPRelay(sess, remoteConn)
+		relay.mux = s.UDPMux
+		relay.setClient(s.UDPMux.conn, s.UDPMux.batch)
+
+		var err error
+		if tcpAddr, ok := sess.Conn.RemoteAddr().(*net.TCPAddr); ok {
+			err = s.UDPMux.add(relay, tcpAddr.IP, sess.Port)
+		} else if sess.Addr.Type != ATypeDomain && !sess.Addr.IP.IsUnspecified() && sess.Port != 0 {
+			// no ip to match, e.g. unix socket
+			err = s.UDPMux.bind(relay, &net.UDPAddr{IP: sess.Addr.IP, Port: int(sess.Port)})
+		} else {
+			err = errors.New("udp mux: client address required for connection without ip")
 		}
-	}()
-
-	// main loop
-	clientChannel := readUDP(clientConn)
-	remoteChannel := readUDP(remoteConn)
-	var clientAddr *net.UDPAddr
-
-	for remoteChannel != nil || clientChannel != nil {
-		select {
-		case err = <-ctrlChannel:
-			if err == nil {
-				log.Debugf("client: %v, udp client leave", conn.RemoteAddr())
-			} else {
-				err = errors.Wrapf(err, "client tcp conn broken")
-			}
-			ctrlChannel = nil
-			// condition a: tcp connection finished, close udp socket
-		case clientEvent := <-clientChannel:
-			if clientEvent.err != nil { // terminate client udp socket
-				if err != nil {
-					err = errors.Wrapf(err, "client udp read error")
-				}
-				clientChannel = nil
-				break
-			}
-
-			if err != nil {
-				break
-			}
-
-			log.Debugf("client: %v, client udp: %v, got data from client", conn.RemoteAddr(), clientEvent.addr)
-
-			// set clientAddr
-			if clientAddr != nil && !UDPAddrEqual(clientAddr, clientEvent.addr) {
-				log.Errorf(
-					"client: %v, client udp source addr changing from %v to %v",
-					conn.RemoteAddr(), *clientAddr, *clientEvent.addr)
-			}
-			clientAddr = clientEvent.addr
-
-			// parse protocol
-			sockAddr, port, data, parseErr := ParseUDPMsg(clientEvent.data)
-			if parseErr != nil {
-				err = errors.Wrapf(parseErr, "ParseUDPMsg error")
-				break
-			}
-
-			// find out destination addr
-			// TODO: create domain to ip mapping
-			var toAddr *net.UDPAddr
-			toAddr, err = socksAddrToUDPAddr(sockAddr, port)
-			if err != nil {
-				err = errors.Wrapf(err, "socksAddrToUDPAddr error")
-				break
-			}
-			log.Debugf("client: %v, remote udp dest: %v", conn.RemoteAddr(), toAddr)
-
-			// fwd data
-			var n int
-			n, err = remoteConn.WriteToUDP(data, toAddr)
-			if err != nil {
-				err = errors.Wrapf(err, "remote udp write error")
-				break
-			}
-			if n != len(data) {
-				log.Warnf("client: %v, udp short write to remote: %d of %d bytes",
-					conn.RemoteAddr(), n, len(data))
-			}
-		case remoteEvent := <-remoteChannel:
-			if remoteEvent.err != nil { // terminate remote udp socket
-				if err != nil {
-					err = errors.Wrapf(err, "remote udp read error")
-				}
-				remoteChannel = nil
-				break
-			}
-
-			if err != nil {
-				break
-			}
+		if err != nil {
+			return nil, err
+		}
+		return relay, nil
+	}
 
-			log.Debugf("client: %v, remote udp: %v, got data from remote", conn.RemoteAddr(), remoteEvent.addr)
-			if clientAddr == nil {
-				log.Warnf("client: %v, got data from remote udp %v, but clientAddr == nil, data: %v",
-					conn.RemoteAddr(), remoteEvent.addr, remoteEvent.data)
-				break
-			}
+	clientConn, err := net.ListenUDP("udp", nil) // FIXME: listen on tcp addr ip
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating client udp socket")
+	}
+	relay := s.newUDPRelay(sess, remoteConn)
+	relay.setClient(clientConn, newUDPBatchConn(clientConn))
+	return relay, nil
+}
 
-			// TODO: map ip to domain if client uses domain instead of ip
-			// FIXME: fix wildcard ip
-			packed := MakeUDPMsg(
-				NewSocksAddrFromIP(remoteEvent.addr.IP), uint16(remoteEvent.addr.Port),
-				remoteEvent.data,
-			)
-
-			// fwd data
-			var n int
-			n, err = clientConn.WriteToUDP(packed, clientAddr)
-			if err != nil {
-				err = errors.Wrapf(err, "client udp write error")
-				break
-			}
-			if n != len(packed) {
-				log.Warnf("client: %v, udp short write to client: %d of %d bytes",
-					conn.RemoteAddr(), n, len(packed))
-			}
-		} // select
+// cmdUDPOverTCP relays udp datagrams framed on the tcp connection.
+func (s *Server) cmdUDPOverTCP(sess *Session) (err error) {
+	conn, proto, l := sess.Conn, sess.Proto, sess.Listener
+	remoteConn, err := s.makeUDPRemote(proto, l, sess.Addr, sess.Port)
+	if err != nil {
+		err = errors.Wrapf(err, "error creating remote udp socket")
+		return
+	}
+	relay := s.newUDPRelay(sess, remoteConn)
+	relay.stream = proto.Transport
+	log.Infof("client: %v, remote_udp_listen: %v", conn.RemoteAddr(), remoteConn.LocalAddr())
 
-		if err != nil || ctrlChannel == nil {
-			// condition a & b: close both udp sockets to finishing clientChannel and remoteChannel
-			doClose(remoteConn, &clientConnClosed, "remote udp conn")
-			doClose(clientConn, &remoteConnClosed, "client udp conn")
-		}
-	} // while udp socket not finished
+	bindAddr, bindPort, parseErr := parseNetAddr(remoteConn.LocalAddr())
+	if parseErr != nil { // unlikely to happen
+		proto.RejectRequest(ReplyFail) // ignore err
+		relay.stop(nil)
+		err = errors.Wrapf(parseErr, "can not parse LocalAddr: %v", remoteConn.LocalAddr())
+		return
+	}
 
-	return
+	err = proto.AcceptUdpAssociation(bindAddr, bindPort)
+	if err != nil {
+		relay.stop(nil)
+		return
+	}
+	return relay.run()
 }
 
 func socksAddrToUDPAddr(sockAddr SocksAddr, port uint16) (*net.UDPAddr, error) {
@@ -403,24 +923,3 @@ func socksAddrToUDPAddr(sockAddr SocksAddr, port uint16) (*net.UDPAddr, error) {
 func UDPAddrEqual(a, b *net.UDPAddr) bool {
 	return bytes.Equal(a.IP, b.IP) && a.Port == b.Port && a.Zone == b.Zone
 }
-
-type UDPReadEvent struct {
-	data []byte
-	addr *net.UDPAddr
-	err  error
-}
-
-func readUDP(conn *net.UDPConn) chan UDPReadEvent {
-	ch := make(chan UDPReadEvent)
-	go func() {
-		for {
-			buf := make([]byte, 64*1024)
-			n, clientAddr, err := conn.ReadFromUDP(buf)
-			ch <- UDPReadEvent{buf[0:n], clientAddr, err}
-			if err != nil {
-				return
-			}
-		}
-	}()
-	return ch
-}
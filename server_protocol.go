@@ -1,15 +1,19 @@
 package socks_go
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/account-login/socks_go/util"
 	"github.com/pkg/errors"
 )
 
+// ServerState is the state of ServerProtocol.
+type ServerState int
+
 // protocol state
 const (
-	PSInit = iota
+	PSInit ServerState = iota
 	PSBad
 	PSClose
 	PSMethodsGot
@@ -19,25 +23,82 @@ const (
 	PSReqUdpGot
 	PSCmdConnect
 	PSCmdUdp
+	PSReqBindGot
+	PSBindWaiting
+	PSCmdBind
+	// request with unsupported command got, can only be rejected
+	PSReqUnsupportedGot
+	PSReqResolveGot
 )
 
+var serverStateNames = [...]string{
+	"PSInit",
+	"PSBad",
+	"PSClose",
+	"PSMethodsGot",
+	"PSAuth",
+	"PSAuthDone",
+	"PSReqConnectGot",
+	"PSReqUdpGot",
+	"PSCmdConnect",
+	"PSCmdUdp",
+	"PSReqBindGot",
+	"PSBindWaiting",
+	"PSCmdBind",
+	"PSReqUnsupportedGot",
+	"PSReqResolveGot",
+}
+
+func (s ServerState) String() string {
+	if s >= 0 && int(s) < len(serverStateNames) {
+		return serverStateNames[s]
+	}
+	return fmt.Sprintf("ServerState(%d)", int(s))
+}
+
+// who the client is, filled in during auth
+type Identity struct {
+	Method byte
+	User   string
+	// credentials of the peer process on unix socket, nil if not available
+	Cred *PeerCred
+}
+
 type ServerProtocol struct {
 	Transport io.ReadWriter
-	State     int
+	State     ServerState
+	Identity  Identity
+
+	// called before accepting a method, the method is rejected on error
+	methodHook func(method byte) error
+	// scratch space for encoding and decoding
+	buf [maxRequestLen]byte
 }
 
 func NewServerProtocol(transport io.ReadWriter) (proto ServerProtocol) {
-	return ServerProtocol{transport, PSInit}
+	return ServerProtocol{Transport: transport, State: PSInit}
 }
 
-func (proto *ServerProtocol) checkState(expect int) {
-	if proto.State != expect {
-		panic("bad state")
+// checkState returns StateError if the current state is not one of expects,
+// the state is not changed in that case.
+func (proto *ServerProtocol) checkState(op string, expects ...ServerState) error {
+	for _, expect := range expects {
+		if proto.State == expect {
+			return nil
+		}
+	}
+
+	err := &StateError{Op: op, State: proto.State}
+	for _, expect := range expects {
+		err.Expects = append(err.Expects, expect)
 	}
+	return err
 }
 
 func (proto *ServerProtocol) GetAuthMethods() (methods []byte, err error) {
-	proto.checkState(PSInit)
+	if err = proto.checkState("GetAuthMethods", PSInit); err != nil {
+		return
+	}
 	// change protocol state on return
 	defer func() {
 		if err == nil {
@@ -48,7 +109,7 @@ func (proto *ServerProtocol) GetAuthMethods() (methods []byte, err error) {
 	}()
 
 	var buf []byte
-	buf, err = util.ReadRequired(proto.Transport, 2)
+	buf, err = util.ReadRequiredBuf(proto.Transport, proto.buf[:], 2)
 	if err != nil {
 		err = errors.Wrap(err, "can not read version and methods num")
 		return
@@ -73,20 +134,33 @@ func (proto *ServerProtocol) GetAuthMethods() (methods []byte, err error) {
 }
 
 func (proto *ServerProtocol) AcceptAuthMethod(method byte) (err error) {
-	proto.checkState(PSMethodsGot)
+	if err = proto.checkState("AcceptAuthMethod", PSMethodsGot); err != nil {
+		return
+	}
 	defer func() {
 		if err == nil {
 			if method == MethodReject {
 				proto.State = PSClose
 			} else {
 				proto.State = PSAuth
+				proto.Identity.Method = method
 			}
 		} else {
 			proto.State = PSBad
 		}
 	}()
 
-	_, err = proto.Transport.Write([]byte{0x05, method})
+	var hookErr error
+	if method != MethodReject && proto.methodHook != nil {
+		if hookErr = proto.methodHook(method); hookErr != nil {
+			method = MethodReject
+		}
+	}
+
+	_, err = proto.Transport.Write(append(proto.buf[:0], 0x05, method))
+	if err == nil {
+		err = hookErr
+	}
 	return
 }
 
@@ -94,34 +168,122 @@ func (proto *ServerProtocol) RejectAuthMethod() (err error) {
 	return proto.AcceptAuthMethod(MethodReject)
 }
 
+// SetTransport replaces the transport during auth sub-negotiation. The rest of
+// the session is carried by the new transport, e.g. an encapsulating stream
+// for per-message protection as in RFC 1961.
+func (proto *ServerProtocol) SetTransport(transport io.ReadWriter) (err error) {
+	if err = proto.checkState("SetTransport", PSAuth); err != nil {
+		return
+	}
+	proto.Transport = transport
+	return
+}
+
+// GetUserPass reads the username/password request of RFC 1929.
+func (proto *ServerProtocol) GetUserPass() (user string, password string, err error) {
+	if err = proto.checkState("GetUserPass", PSAuth); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			proto.State = PSBad
+		}
+	}()
+
+	var buf []byte
+	buf, err = util.ReadRequiredBuf(proto.Transport, proto.buf[:], 2)
+	if err != nil {
+		err = errors.Wrap(err, "GetUserPass: can not read version and username length")
+		return
+	}
+
+	ver := buf[0]
+	if ver != userPassVersion {
+		err = errors.Errorf("GetUserPass: bad version: %#x", ver)
+		return
+	}
+
+	buf, err = util.ReadRequiredBuf(proto.Transport, proto.buf[:], int(buf[1]))
+	if err != nil {
+		err = errors.Wrap(err, "GetUserPass: can not read username")
+		return
+	}
+	user = string(buf)
+
+	buf, err = util.ReadRequiredBuf(proto.Transport, proto.buf[:], 1)
+	if err != nil {
+		err = errors.Wrap(err, "GetUserPass: can not read password length")
+		return
+	}
+	buf, err = util.ReadRequiredBuf(proto.Transport, proto.buf[:], int(buf[0]))
+	if err != nil {
+		err = errors.Wrap(err, "GetUserPass: can not read password")
+		return
+	}
+	password = string(buf)
+	return
+}
+
+// ReplyUserPass sends the status of RFC 1929 sub-negotiation.
+// The connection must be closed if the status is not success.
+func (proto *ServerProtocol) ReplyUserPass(success bool) (err error) {
+	if err = proto.checkState("ReplyUserPass", PSAuth); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			proto.State = PSBad
+		} else if !success {
+			proto.State = PSClose
+		}
+	}()
+
+	status := byte(1)
+	if success {
+		status = 0
+	}
+	_, err = proto.Transport.Write(append(proto.buf[:0], userPassVersion, status))
+	return
+}
+
 func (proto *ServerProtocol) AuthDone() (err error) {
-	proto.checkState(PSAuth)
+	if err = proto.checkState("AuthDone", PSAuth); err != nil {
+		return
+	}
 	proto.State = PSAuthDone
 	return
 }
 
 func (proto *ServerProtocol) GetRequest() (cmd byte, addr SocksAddr, port uint16, err error) {
-	proto.checkState(PSAuthDone)
+	if err = proto.checkState("GetRequest", PSAuthDone); err != nil {
+		return
+	}
 	defer func() {
 		if err == nil {
 			switch cmd {
-			case CmdConnect:
+			case CmdConnect, CmdMux:
 				proto.State = PSReqConnectGot
-			case CmdUDP:
+			case CmdUDP, CmdUDPOverTCP:
 				proto.State = PSReqUdpGot
+			case CmdBind:
+				proto.State = PSReqBindGot
+			case CmdResolve, CmdResolvePTR:
+				proto.State = PSReqResolveGot
 			default:
-				proto.State = PSBad // cmd not supported
+				proto.State = PSReqUnsupportedGot
 			}
 		} else {
 			proto.State = PSBad
 		}
 	}()
 
-	return readRequestOrReply(proto.Transport)
+	return readRequestOrReply(proto.Transport, proto.buf[:])
 }
 
 func (proto *ServerProtocol) AcceptConnection(bindAddr SocksAddr, bindPort uint16) (trans io.ReadWriter, err error) {
-	proto.checkState(PSReqConnectGot)
+	if err = proto.checkState("AcceptConnection", PSReqConnectGot); err != nil {
+		return
+	}
 	defer func() {
 		if err == nil {
 			proto.State = PSCmdConnect
@@ -130,7 +292,7 @@ func (proto *ServerProtocol) AcceptConnection(bindAddr SocksAddr, bindPort uint1
 		}
 	}()
 
-	err = writeResponseOrRequest(proto.Transport, ReplyOK, bindAddr, bindPort)
+	err = writeResponseOrRequest(proto.Transport, proto.buf[:], ReplyOK, bindAddr, bindPort)
 	if err != nil {
 		return
 	}
@@ -138,22 +300,84 @@ func (proto *ServerProtocol) AcceptConnection(bindAddr SocksAddr, bindPort uint1
 	return
 }
 
+// AcceptUdpAssociation replies CmdUDP or CmdUDPOverTCP.
 func (proto *ServerProtocol) AcceptUdpAssociation(bindAddr SocksAddr, bindPort uint16) (err error) {
-	proto.checkState(PSReqUdpGot)
+	if err = proto.checkState("AcceptUdpAssociation", PSReqUdpGot); err != nil {
+		return
+	}
 	defer func() {
-		if err != nil {
+		if err == nil {
 			proto.State = PSCmdUdp
 		} else {
 			proto.State = PSBad
 		}
 	}()
 
-	err = writeResponseOrRequest(proto.Transport, ReplyOK, bindAddr, bindPort)
+	err = writeResponseOrRequest(proto.Transport, proto.buf[:], ReplyOK, bindAddr, bindPort)
+	return
+}
+
+// AcceptResolve replies CmdResolve with ip or CmdResolvePTR with domain,
+// the connection is done after that.
+func (proto *ServerProtocol) AcceptResolve(addr SocksAddr) (err error) {
+	if err = proto.checkState("AcceptResolve", PSReqResolveGot); err != nil {
+		return
+	}
+	defer func() {
+		if err == nil {
+			proto.State = PSClose
+		} else {
+			proto.State = PSBad
+		}
+	}()
+
+	err = writeResponseOrRequest(proto.Transport, proto.buf[:], ReplyOK, addr, 0)
+	return
+}
+
+// AcceptBind sends the first reply of BIND command with the listening address.
+func (proto *ServerProtocol) AcceptBind(bindAddr SocksAddr, bindPort uint16) (err error) {
+	if err = proto.checkState("AcceptBind", PSReqBindGot); err != nil {
+		return
+	}
+	defer func() {
+		if err == nil {
+			proto.State = PSBindWaiting
+		} else {
+			proto.State = PSBad
+		}
+	}()
+
+	err = writeResponseOrRequest(proto.Transport, proto.buf[:], ReplyOK, bindAddr, bindPort)
+	return
+}
+
+// AcceptBindPeer sends the second reply of BIND command with the address of the connecting host.
+func (proto *ServerProtocol) AcceptBindPeer(peerAddr SocksAddr, peerPort uint16) (trans io.ReadWriter, err error) {
+	if err = proto.checkState("AcceptBindPeer", PSBindWaiting); err != nil {
+		return
+	}
+	defer func() {
+		if err == nil {
+			proto.State = PSCmdBind
+		} else {
+			proto.State = PSBad
+		}
+	}()
+
+	err = writeResponseOrRequest(proto.Transport, proto.buf[:], ReplyOK, peerAddr, peerPort)
+	if err != nil {
+		return
+	}
+	trans = proto.Transport
 	return
 }
 
 func (proto *ServerProtocol) RejectRequest(reply byte) (err error) {
-	proto.checkState(PSReqConnectGot)
+	if err = proto.checkState("RejectRequest",
+		PSReqConnectGot, PSReqUdpGot, PSReqBindGot, PSBindWaiting, PSReqUnsupportedGot, PSReqResolveGot); err != nil {
+		return
+	}
 	defer func() {
 		if err == nil {
 			proto.State = PSClose
@@ -162,5 +386,5 @@ func (proto *ServerProtocol) RejectRequest(reply byte) (err error) {
 		}
 	}()
 
-	return writeResponseOrRequest(proto.Transport, reply, NewSocksAddr(), 0)
+	return writeResponseOrRequest(proto.Transport, proto.buf[:], reply, NewSocksAddr(), 0)
 }
@@ -101,3 +101,123 @@ func TestServerProtocol_RejectRequest(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, []byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0x00, 0x00}, tr.output)
 }
+
+func TestServerProtocol_Bind(t *testing.T) {
+	tr := newFakeTransport()
+	proto := NewServerProtocol(&tr)
+
+	tr.Send([]byte{0x05, 0x01, MethodNone})
+	_, err := proto.GetAuthMethods()
+	require.NoError(t, err)
+	require.NoError(t, proto.AcceptAuthMethod(MethodNone))
+	require.NoError(t, proto.AuthDone())
+	tr.output = []byte{}
+
+	// req
+	tr.Send([]byte{0x05, CmdBind, 0x00, 0x01, 0x01, 0x02, 0x03, 0x04, 0x12, 0x34})
+	cmd, _, _, err := proto.GetRequest()
+	require.NoError(t, err)
+	assert.Equal(t, CmdBind, cmd)
+
+	// first reply
+	err = proto.AcceptBind(NewSocksAddrFromIPV4(net.IP{2, 3, 4, 5}), uint16(0x2345))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x05, 0x00, 0x00, 0x01, 2, 3, 4, 5, 0x23, 0x45}, tr.output)
+	tr.output = []byte{}
+
+	// second reply
+	_, err = proto.AcceptBindPeer(NewSocksAddrFromIPV4(net.IP{1, 2, 3, 4}), uint16(0x1234))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x05, 0x00, 0x00, 0x01, 1, 2, 3, 4, 0x12, 0x34}, tr.output)
+	assert.Equal(t, PSCmdBind, proto.State)
+}
+
+func newRequestedServerProtocol(t *testing.T, tr *fakeTransport, cmd byte) ServerProtocol {
+	proto := NewServerProtocol(tr)
+	tr.Send([]byte{0x05, 0x01, MethodNone})
+	_, err := proto.GetAuthMethods()
+	require.NoError(t, err)
+	require.NoError(t, proto.AcceptAuthMethod(MethodNone))
+	require.NoError(t, proto.AuthDone())
+
+	tr.Send([]byte{0x05, cmd, 0x00, 0x01, 0x01, 0x02, 0x03, 0x04, 0x12, 0x34})
+	_, _, _, err = proto.GetRequest()
+	require.NoError(t, err)
+	tr.output = []byte{}
+	return proto
+}
+
+func TestServerProtocol_UdpAssociation(t *testing.T) {
+	for _, cmd := range []byte{CmdUDP, CmdUDPOverTCP} {
+		tr := newFakeTransport()
+		proto := newRequestedServerProtocol(t, &tr, cmd)
+		assert.Equal(t, PSReqUdpGot, proto.State)
+
+		err := proto.AcceptUdpAssociation(NewSocksAddrFromIPV4(net.IP{2, 3, 4, 5}), uint16(0x2345))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x05, 0x00, 0x00, 0x01, 2, 3, 4, 5, 0x23, 0x45}, tr.output)
+		assert.Equal(t, PSCmdUdp, proto.State)
+	}
+}
+
+func TestServerProtocol_Resolve(t *testing.T) {
+	tr := newFakeTransport()
+	proto := newRequestedServerProtocol(t, &tr, CmdResolvePTR)
+	assert.Equal(t, PSReqResolveGot, proto.State)
+
+	err := proto.AcceptResolve(NewSocksAddrFromString("a.com"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x05, 0x00, 0x00, 0x03, 5, 'a', '.', 'c', 'o', 'm', 0, 0}, tr.output)
+	assert.Equal(t, PSClose, proto.State)
+
+	tr = newFakeTransport()
+	proto = newRequestedServerProtocol(t, &tr, CmdConnect)
+	assert.IsType(t, &StateError{}, proto.AcceptResolve(NewSocksAddr()))
+}
+
+func TestServerProtocol_RejectRequestStates(t *testing.T) {
+	for _, cmd := range []byte{CmdUDP, CmdBind, CmdResolve, 0x7f} {
+		tr := newFakeTransport()
+		proto := newRequestedServerProtocol(t, &tr, cmd)
+
+		err := proto.RejectRequest(ReplyNotAllowed)
+		require.NoError(t, err, "cmd %#x", cmd)
+		assert.Equal(t, []byte{0x05, ReplyNotAllowed, 0x00, 0x01, 0, 0, 0, 0, 0x00, 0x00}, tr.output)
+		assert.Equal(t, PSClose, proto.State)
+	}
+
+	// after the first reply of BIND
+	tr := newFakeTransport()
+	proto := newRequestedServerProtocol(t, &tr, CmdBind)
+	require.NoError(t, proto.AcceptBind(NewSocksAddrFromIPV4(net.IP{2, 3, 4, 5}), uint16(0x2345)))
+	require.NoError(t, proto.RejectRequest(ReplyTTLExpired))
+	assert.Equal(t, PSClose, proto.State)
+}
+
+func TestServerProtocol_BadState(t *testing.T) {
+	tr := newFakeTransport()
+	proto := NewServerProtocol(&tr)
+
+	_, _, _, err := proto.GetRequest()
+	require.Error(t, err)
+	stateErr, ok := err.(*StateError)
+	require.True(t, ok)
+	assert.Equal(t, "GetRequest", stateErr.Op)
+	assert.Equal(t, "GetRequest: bad state PSInit, expect PSAuthDone", err.Error())
+	// state is kept
+	assert.Equal(t, PSInit, proto.State)
+	assert.Empty(t, tr.output)
+
+	// the unsupported command can only be rejected
+	proto = newRequestedServerProtocol(t, &tr, 0x7f)
+	assert.Equal(t, PSReqUnsupportedGot, proto.State)
+	_, err = proto.AcceptConnection(NewSocksAddrFromIPV4(net.IP{2, 3, 4, 5}), 0)
+	assert.IsType(t, &StateError{}, err)
+	assert.Equal(t, PSReqUnsupportedGot, proto.State)
+}
+
+func TestServerState_String(t *testing.T) {
+	assert.Equal(t, "PSInit", PSInit.String())
+	assert.Equal(t, "PSCmdUdp", PSCmdUdp.String())
+	assert.Equal(t, "ServerState(100)", ServerState(100).String())
+}
@@ -0,0 +1,580 @@
+package socks_go
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startEchoTarget greets connections with "hello" and closes them,
+// or echoes data back until EOF if echo is set.
+func startEchoTarget(t *testing.T, echo ...bool) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if len(echo) > 0 && echo[0] {
+				go func() {
+					_, _ = io.Copy(conn, conn)
+					conn.Close()
+				}()
+				continue
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+func startUDPEcho(tb testing.TB) *net.UDPConn {
+	udpEcho, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(tb, err)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := udpEcho.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpEcho.WriteTo(buf[:n], addr)
+		}
+	}()
+	return udpEcho
+}
+
+func dialThrough(listener net.Listener, methods []ClientAuthMethod, target net.Addr) (data []byte, err error) {
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	client := NewClientWithAuthMethods(conn, methods, ClientParam{})
+	tcpAddr := target.(*net.TCPAddr)
+	tunnel, err := client.ConnectSockAddr(NewSocksAddrFromIP(tcpAddr.IP), uint16(tcpAddr.Port))
+	if err != nil {
+		return
+	}
+	return ioutil.ReadAll(tunnel)
+}
+
+func TestServer_Listeners(t *testing.T) {
+	target := startEchoTarget(t)
+	defer target.Close()
+
+	registry := NewServerAuthRegistry()
+	require.NoError(t, registry.Register(MethodUserName, ServerUserPassMethod(func(user, password string) bool {
+		return user == "foo" && password == "bar"
+	})))
+
+	public := &Listener{AuthHandler: registry.AuthHandler}
+	// denies everything on loopback listener
+	loopback := &Listener{Rules: RuleSet{{Action: RuleDeny}}}
+	server := &Server{Listeners: []*Listener{public, loopback}}
+
+	publicListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	loopbackListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	done := make(chan error, 2)
+	go func() { done <- server.ServeOn(public, publicListener) }()
+	go func() { done <- server.ServeOn(loopback, loopbackListener) }()
+
+	noAuth := []ClientAuthMethod{{Method: MethodNone, Handler: ClientNoAuthHandler}}
+	userPass := []ClientAuthMethod{{Method: MethodUserName, Handler: ClientUserPassAuth("foo", "bar")}}
+
+	_, err = dialThrough(publicListener, noAuth, target.Addr())
+	assert.IsType(t, &AuthMethodError{}, err)
+
+	data, err := dialThrough(publicListener, userPass, target.Addr())
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	_, err = dialThrough(loopbackListener, noAuth, target.Addr())
+	assert.Equal(t, &ReplyError{Reply: ReplyNotAllowed}, err)
+
+	// stats are updated after client gone
+	assert.Eventually(t, func() bool {
+		return public.Stats() == Stats{Accepted: 2, Failed: 1} &&
+			loopback.Stats() == Stats{Accepted: 1, Denied: 1, Failed: 1} &&
+			server.Stats() == Stats{Accepted: 3, Denied: 1, Failed: 2}
+	}, 3*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, server.Close())
+	assert.NoError(t, <-done)
+	assert.NoError(t, <-done)
+}
+
+func TestServer_InheritStats(t *testing.T) {
+	old := &Server{}
+	defer old.Close()
+	oldDialer := startServer(t, old)
+
+	// a session of the old server, waiting for handshake
+	conn, err := net.Dial("tcp", oldDialer.ProxyAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Eventually(t, func() bool {
+		return old.Stats().Active == 1
+	}, 3*time.Second, 10*time.Millisecond)
+
+	server := &Server{MaxConns: 1}
+	server.InheritStats(old)
+	defer server.Close()
+	dialer := startServer(t, server)
+	_, err = dialer.Dial("tcp", "example.com:80")
+	assert.Error(t, err)
+	assert.Equal(t, Stats{Accepted: 2, Active: 1}, server.Stats())
+
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		return server.Stats().Active == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, server.Stats(), old.Stats())
+}
+
+func TestServer_UnixPeerCred(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on linux")
+	}
+
+	target := startEchoTarget(t)
+	defer target.Close()
+	tcpAddr := target.Addr().(*net.TCPAddr)
+
+	dir, err := ioutil.TempDir("", "socks_go")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socks.sock")
+
+	registry := NewServerAuthRegistry()
+	var gotCred PeerCred
+	require.NoError(t, registry.Register(MethodNone, ServerPeerCredMethod(func(cred PeerCred) bool {
+		gotCred = cred
+		return true
+	})))
+	l := &Listener{
+		Network:     "unix",
+		Addr:        path,
+		Mode:        0600,
+		AuthHandler: registry.AuthHandler,
+		Rules:       RuleSet{{Action: RuleDeny, UIDs: []int{os.Getuid()}, Ports: []PortRange{{Lo: 1, Hi: 1}}}},
+	}
+	server := &Server{Listeners: []*Listener{l}}
+	listener, err := l.Listen()
+	require.NoError(t, err)
+	go server.ServeOn(l, listener)
+	defer server.Close()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	dialer := &Dialer{ProxyNetwork: "unix", ProxyAddr: path, Timeout: 3 * time.Second}
+	conn, err := dialer.DialSocksAddr(NewSocksAddrFromIP(tcpAddr.IP), uint16(tcpAddr.Port))
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(conn)
+	conn.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.Equal(t, PeerCred{PID: os.Getpid(), UID: os.Getuid(), GID: os.Getgid()}, gotCred)
+
+	// denied by uid rule
+	_, err = dialer.DialSocksAddr(NewSocksAddrFromIP(tcpAddr.IP), 1)
+	assert.Equal(t, &ReplyError{Reply: ReplyNotAllowed}, err)
+}
+
+func TestListener_Unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks_go")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socks.sock")
+
+	// left by a crashed server
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l := &Listener{Network: "unix", Addr: path, Mode: 0600}
+	listener, err := l.Listen()
+	require.NoError(t, err)
+	defer listener.Close()
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// in use
+	_, err = l.Listen()
+	assert.Error(t, err)
+
+	// created with mode
+	if runtime.GOOS != "windows" {
+		file := filepath.Join(dir, "file")
+		require.NoError(t, withUmask(0600, func() error {
+			return ioutil.WriteFile(file, nil, 0666)
+		}))
+		info, err = os.Stat(file)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestServer_UnixUpstream(t *testing.T) {
+	target := startEchoTarget(t)
+	defer target.Close()
+	tcpAddr := target.Addr().(*net.TCPAddr)
+
+	dir, err := ioutil.TempDir("", "socks_go")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socks.sock")
+
+	l := &Listener{Network: "unix", Addr: path}
+	upstream := &Server{Listeners: []*Listener{l}}
+	listener, err := l.Listen()
+	require.NoError(t, err)
+	go upstream.ServeOn(l, listener)
+	defer upstream.Close()
+
+	for _, mux := range []bool{false, true} {
+		upstreamDialer := &Dialer{ProxyNetwork: "unix", ProxyAddr: path, Timeout: 3 * time.Second, Mux: mux}
+		server := &Server{Upstream: upstreamDialer}
+		dialer := startServer(t, server)
+
+		// bound address of unix sockets is unspecified
+		conn, err := dialer.DialSocksAddr(NewSocksAddrFromIP(tcpAddr.IP), uint16(tcpAddr.Port))
+		require.NoError(t, err, "mux: %v", mux)
+		data, err := ioutil.ReadAll(conn)
+		conn.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+
+		server.Close()
+		upstreamDialer.Close()
+	}
+}
+
+func TestServer_Bind(t *testing.T) {
+	closed := make(chan *Session, 2)
+	server := &Server{BindTimeout: 3 * time.Second, Hooks: Hooks{
+		OnClose: func(sess *Session) {
+			closed <- sess
+		},
+	}}
+	defer server.Close()
+	dialer := startServer(t, server)
+
+	bind := func() (conn net.Conn, client Client, bindAddr string) {
+		conn, err := net.Dial("tcp", dialer.ProxyAddr)
+		require.NoError(t, err)
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		client = NewClientWithAuthMethods(conn, nil, ClientParam{})
+		addr, port, err := client.Bind(NewSocksAddrFromIP(net.IPv4zero), 0)
+		require.NoError(t, err)
+		bindAddr = net.JoinHostPort(addr.String(), strconv.Itoa(int(port)))
+		return
+	}
+
+	// data sent by client before the peer connected is not lost
+	conn, client, bindAddr := bind()
+	_, err := conn.Write([]byte("early"))
+	require.NoError(t, err)
+	peer, err := net.Dial("tcp", bindAddr)
+	require.NoError(t, err)
+	tunnel, err := client.AcceptBind()
+	require.NoError(t, err)
+	_, err = tunnel.Write([]byte(" data"))
+	require.NoError(t, err)
+	_ = peer.SetDeadline(time.Now().Add(3 * time.Second))
+	got := make([]byte, 10)
+	_, err = io.ReadFull(peer, got)
+	require.NoError(t, err)
+	assert.Equal(t, "early data", string(got))
+	peer.Close()
+	conn.Close()
+	<-closed
+
+	// the listener is closed with the client
+	conn, _, bindAddr = bind()
+	conn.Close()
+	sess := <-closed
+	assert.Contains(t, sess.Err.Error(), "client gone")
+	_, err = net.Dial("tcp", bindAddr)
+	assert.Error(t, err)
+}
+
+func TestServer_LocalAddr(t *testing.T) {
+	a, b, c := net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3")
+	server := &Server{LocalAddrs: []net.IP{a, b}}
+	l := &Listener{}
+	addr := NewSocksAddrFromString("example.com")
+
+	// round robin
+	first := server.localAddr(nil, l, nil, addr, 80)
+	second := server.localAddr(nil, l, nil, addr, 80)
+	assert.ElementsMatch(t, []net.IP{a, b}, []net.IP{first, second})
+	assert.Equal(t, first, server.localAddr(nil, l, nil, addr, 80))
+
+	// overrides server LocalAddrs
+	server.LocalAddrFunc = func(proto *ServerProtocol, addr SocksAddr, port uint16) net.IP {
+		assert.Equal(t, "example.com", addr.Domain)
+		assert.Equal(t, uint16(80), port)
+		return c
+	}
+	assert.Equal(t, c, server.localAddr(nil, l, nil, addr, 80))
+
+	// listener and rule go first
+	l.LocalAddrs = []net.IP{b}
+	assert.Equal(t, b, server.localAddr(nil, l, nil, addr, 80))
+	assert.Equal(t, a, server.localAddr(nil, l, &Rule{LocalAddr: a}, addr, 80))
+}
+
+func TestServer_MakeUDPRemote(t *testing.T) {
+	local := net.ParseIP("127.0.0.1")
+	server := &Server{LocalAddrFunc: func(proto *ServerProtocol, addr SocksAddr, port uint16) net.IP {
+		return local
+	}}
+	l := &Listener{}
+	remote, err := server.makeUDPRemote(nil, l, NewSocksAddrFromIP(net.IPv4zero), 0)
+	require.NoError(t, err)
+	assert.True(t, local.Equal(remote.LocalAddr().(*net.UDPAddr).IP))
+	remote.Close()
+
+	l.BindDevice = "nonexistent0"
+	_, err = server.makeUDPRemote(nil, l, NewSocksAddrFromIP(net.IPv4zero), 0)
+	assert.Error(t, err)
+}
+
+func TestPrependUDPHeader(t *testing.T) {
+	buf := make([]byte, udpBufSize)
+	copy(buf[udpHeadroom:], "ping")
+
+	msg, err := prependUDPHeader(buf, NewSocksAddrFromString("example.com"), 0x1234, 4)
+	require.NoError(t, err)
+	expected, err := MakeUDPMsg(NewSocksAddrFromString("example.com"), 0x1234, []byte("ping"))
+	require.NoError(t, err)
+	assert.Equal(t, expected, msg)
+
+	_, err = prependUDPHeader(buf, SocksAddr{Type: 0x7f}, 0, 4)
+	assert.IsType(t, &AddrError{}, err)
+}
+
+func startServer(tb testing.TB, server *Server) (dialer *Dialer) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	go server.Serve(listener)
+	return &Dialer{ProxyAddr: listener.Addr().String(), Timeout: 3 * time.Second}
+}
+
+func checkUDPEcho(t *testing.T, tunnel *ClientUDPTunnel, echo net.Addr, sizes ...int) {
+	_ = tunnel.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 64*1024)
+	for _, size := range sizes {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		_, err := tunnel.WriteTo(data, echo)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		n, from, err := tunnel.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, data, buf[:n])
+		assert.Equal(t, echo.String(), from.String())
+	}
+}
+
+func TestServer_UDPRelay(t *testing.T) {
+	udpEcho := startUDPEcho(t)
+	defer udpEcho.Close()
+
+	for _, noBatch := range []bool{false, true} {
+		server := &Server{noUDPBatch: noBatch}
+		tunnel, err := startServer(t, server).UDPAssociation()
+		require.NoError(t, err)
+
+		checkUDPEcho(t, tunnel, udpEcho.LocalAddr(), 0, 1, 1000, 60000)
+		tunnel.Close()
+		server.Close()
+	}
+}
+
+func TestServer_UDPRelayUpstream(t *testing.T) {
+	udpEcho := startUDPEcho(t)
+	defer udpEcho.Close()
+
+	upstream := &Server{}
+	defer upstream.Close()
+
+	// remote side is the tunnel to upstream
+	server := &Server{Upstream: startServer(t, upstream)}
+	defer server.Close()
+	tunnel, err := startServer(t, server).UDPAssociation()
+	require.NoError(t, err)
+	defer tunnel.Close()
+	checkUDPEcho(t, tunnel, udpEcho.LocalAddr(), 10, 1000)
+	checkUDPEcho(t, tunnel, udpEcho.LocalAddr(), 100)
+}
+
+func TestServer_UDPRelayWorkers(t *testing.T) {
+	udpEcho := startUDPEcho(t)
+	defer udpEcho.Close()
+
+	// idle associations do not hold workers
+	server := &Server{UDPWorkers: 1}
+	defer server.Close()
+	dialer := startServer(t, server)
+
+	tunnels := make([]*ClientUDPTunnel, 0)
+	defer func() {
+		for _, tunnel := range tunnels {
+			tunnel.Close()
+		}
+	}()
+	for i := 0; i < 16; i++ {
+		tunnel, err := dialer.UDPAssociation()
+		require.NoError(t, err)
+		tunnels = append(tunnels, tunnel)
+	}
+
+	var wg sync.WaitGroup
+	for _, tunnel := range tunnels {
+		wg.Add(1)
+		go func(tunnel *ClientUDPTunnel) {
+			defer wg.Done()
+			checkUDPEcho(t, tunnel, udpEcho.LocalAddr(), 10, 100, 1000)
+		}(tunnel)
+	}
+	wg.Wait()
+}
+
+// blockingResolver waits for release before looking up
+type blockingResolver struct {
+	staticResolver
+	release chan struct{}
+}
+
+func (r blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	<-r.release
+	return r.staticResolver.LookupIPAddr(ctx, host)
+}
+
+func TestServer_UDPRelayResolve(t *testing.T) {
+	udpEcho := startUDPEcho(t)
+	defer udpEcho.Close()
+	echoPort := uint16(udpEcho.LocalAddr().(*net.UDPAddr).Port)
+
+	for _, noBatch := range []bool{false, true} {
+		resolver := blockingResolver{
+			staticResolver{"echo.test": {{IP: net.IPv4(127, 0, 0, 1)}}},
+			make(chan struct{}),
+		}
+		server := &Server{UDPWorkers: 1, noUDPBatch: noBatch, udpResolver: resolver}
+		dialer := startServer(t, server)
+
+		slow, err := dialer.UDPAssociation()
+		require.NoError(t, err)
+		other, err := dialer.UDPAssociation()
+		require.NoError(t, err)
+
+		// dns of an association does not stall the others, nor its ip datagrams
+		for i := 0; i < 4; i++ {
+			_, err = slow.WriteToSocksAddr([]byte("domain"), NewSocksAddrFromString("echo.test"), echoPort)
+			require.NoError(t, err)
+		}
+		checkUDPEcho(t, other, udpEcho.LocalAddr(), 10)
+		checkUDPEcho(t, slow, udpEcho.LocalAddr(), 10)
+
+		close(resolver.release)
+		_ = slow.SetReadDeadline(time.Now().Add(3 * time.Second))
+		buf := make([]byte, 100)
+		n, from, err := slow.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "domain", string(buf[:n]))
+		assert.Equal(t, udpEcho.LocalAddr().String(), from.String())
+
+		slow.Close()
+		other.Close()
+		server.Close()
+	}
+
+	// negative means default
+	server := &Server{UDPWorkers: -1}
+	server.init()
+	assert.Equal(t, 4*runtime.GOMAXPROCS(0), cap(server.udpWorkers.sem))
+}
+
+func benchmarkUDPRelay(b *testing.B, associations int) {
+	udpEcho := startUDPEcho(b)
+	defer udpEcho.Close()
+	server := &Server{}
+	defer server.Close()
+	dialer := startServer(b, server)
+
+	tunnels := make([]*ClientUDPTunnel, 0, associations)
+	defer func() {
+		for _, tunnel := range tunnels {
+			tunnel.Close()
+		}
+	}()
+	for i := 0; i < associations; i++ {
+		tunnel, err := dialer.UDPAssociation()
+		require.NoError(b, err)
+		tunnels = append(tunnels, tunnel)
+	}
+
+	data := make([]byte, 1200)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	for _, tunnel := range tunnels {
+		wg.Add(1)
+		go func(tunnel *ClientUDPTunnel) {
+			defer wg.Done()
+			_ = tunnel.SetReadDeadline(time.Now().Add(10 * time.Second))
+			buf := make([]byte, 64*1024)
+			for i := 0; i < b.N/associations; i++ {
+				if _, err := tunnel.WriteTo(data, udpEcho.LocalAddr()); err != nil {
+					b.Error(err)
+					return
+				}
+				if _, _, err := tunnel.ReadFrom(buf); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(tunnel)
+	}
+	wg.Wait()
+}
+
+func BenchmarkServer_UDPRelay(b *testing.B) {
+	benchmarkUDPRelay(b, 1)
+}
+
+func BenchmarkServer_UDPRelay64(b *testing.B) {
+	benchmarkUDPRelay(b, 64)
+}
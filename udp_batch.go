@@ -0,0 +1,63 @@
+package socks_go
+
+import "net"
+
+// datagrams read or written by one syscall where batching is supported
+const udpBatchSize = 8
+
+// udpMsg is a datagram with its peer address.
+type udpMsg struct {
+	// owned buffer, datagrams are read at udpHeadroom. nil for messages to write.
+	buf  []byte
+	data []byte
+	// source after read, destination before write
+	addr *net.UDPAddr
+}
+
+// udpBatch is the buffers of a batch of datagrams.
+type udpBatch struct {
+	msgs []udpMsg
+	// messages to write, data refers to msgs
+	out []udpMsg
+	// platform specific, e.g. mmsghdr for recvmmsg
+	scratch batchScratch
+}
+
+func newUDPBatch(size int) *udpBatch {
+	b := &udpBatch{msgs: make([]udpMsg, size), out: make([]udpMsg, 0, size)}
+	for i := range b.msgs {
+		b.msgs[i].buf = make([]byte, udpBufSize)
+	}
+	return b
+}
+
+// udpBatchConn reads and writes datagrams in batches.
+type udpBatchConn interface {
+	// waitRead blocks until a datagram can be read
+	waitRead() error
+	// readBatch reads at least one datagram into b.msgs
+	readBatch(b *udpBatch) (n int, err error)
+	// writeBatch writes all msgs, scratch of b is used
+	writeBatch(b *udpBatch, msgs []udpMsg) error
+}
+
+// udpWorkerPool limits the batches being forwarded at a time by all udp associations,
+// which wait for data with their own goroutines. Batch buffers are only taken after
+// data arrived, so idle associations hold no buffers.
+type udpWorkerPool struct {
+	sem chan struct{}
+}
+
+func newUDPWorkerPool(n int) *udpWorkerPool {
+	return &udpWorkerPool{sem: make(chan struct{}, n)}
+}
+
+func (p *udpWorkerPool) get() *udpBatch {
+	p.sem <- struct{}{}
+	return udpBatchPool.Get().(*udpBatch)
+}
+
+func (p *udpWorkerPool) put(b *udpBatch) {
+	udpBatchPool.Put(b)
+	<-p.sem
+}
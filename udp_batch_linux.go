@@ -0,0 +1,243 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package socks_go
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+type batchScratch struct {
+	hdrs  [udpBatchSize]mmsghdr
+	iovs  [udpBatchSize]syscall.Iovec
+	names [udpBatchSize]syscall.RawSockaddrAny
+
+	// state of the syscall callbacks, kept with the batch to avoid
+	// allocating closures, a socket may be read and written concurrently.
+	off, vlen, n int
+	errno        syscall.Errno
+	recvFn       func(fd uintptr) bool
+	sendFn       func(fd uintptr) bool
+}
+
+func (s *batchScratch) init() {
+	if s.recvFn == nil {
+		s.recvFn = s.doRecv
+		s.sendFn = s.doSend
+	}
+}
+
+// mmsgConn batches with recvmmsg and sendmmsg.
+type mmsgConn struct {
+	rc     syscall.RawConn
+	family int
+
+	// only one reader waits at a time
+	peek   mmsghdr
+	peekFn func(fd uintptr) bool
+}
+
+func newUDPBatchConn(conn *net.UDPConn) udpBatchConn {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	c := &mmsgConn{rc: rc}
+	err = rc.Control(func(fd uintptr) {
+		var sa syscall.Sockaddr
+		if sa, err = syscall.Getsockname(int(fd)); err == nil {
+			if _, ok := sa.(*syscall.SockaddrInet6); ok {
+				c.family = syscall.AF_INET6
+			} else {
+				c.family = syscall.AF_INET
+			}
+		}
+	})
+	if err != nil {
+		return nil
+	}
+
+	c.peekFn = c.doPeek
+	return c
+}
+
+func (c *mmsgConn) waitRead() error {
+	return c.rc.Read(c.peekFn)
+}
+
+// doPeek checks for a datagram with an empty buffer
+func (c *mmsgConn) doPeek(fd uintptr) bool {
+	for {
+		_, _, e := syscall.Syscall6(sysRECVMMSG, fd, uintptr(unsafe.Pointer(&c.peek)), 1, syscall.MSG_PEEK, 0, 0)
+		if e == syscall.EINTR {
+			continue
+		}
+		return e != syscall.EAGAIN
+	}
+}
+
+func (c *mmsgConn) readBatch(b *udpBatch) (n int, err error) {
+	s := &b.scratch
+	s.init()
+	for i := range b.msgs {
+		buf := b.msgs[i].buf[udpHeadroom:]
+		s.iovs[i].Base = &buf[0]
+		s.iovs[i].SetLen(len(buf))
+		s.hdrs[i] = mmsghdr{}
+		s.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&s.names[i]))
+		s.hdrs[i].hdr.Namelen = syscall.SizeofSockaddrAny
+		s.hdrs[i].hdr.Iov = &s.iovs[i]
+		s.hdrs[i].hdr.Iovlen = 1
+	}
+
+	s.vlen = len(b.msgs)
+	err = c.rc.Read(s.recvFn)
+	if err == nil && s.errno != 0 {
+		err = os.NewSyscallError("recvmmsg", s.errno)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n = s.n
+	for i := 0; i < n; i++ {
+		m := &b.msgs[i]
+		m.data = m.buf[udpHeadroom : udpHeadroom+int(s.hdrs[i].len)]
+		m.addr = sockaddrToUDPAddr(&s.names[i])
+	}
+	return
+}
+
+func (s *batchScratch) doRecv(fd uintptr) bool {
+	for {
+		r, _, e := syscall.Syscall6(sysRECVMMSG, fd, uintptr(unsafe.Pointer(&s.hdrs[0])), uintptr(s.vlen), 0, 0, 0)
+		switch e {
+		case syscall.EINTR:
+			continue
+		case syscall.EAGAIN:
+			return false
+		}
+		s.n, s.errno = int(r), e
+		return true
+	}
+}
+
+func (c *mmsgConn) writeBatch(b *udpBatch, msgs []udpMsg) (err error) {
+	s := &b.scratch
+	s.init()
+	for i := range msgs {
+		s.hdrs[i] = mmsghdr{}
+		if len(msgs[i].data) > 0 {
+			s.iovs[i].Base = &msgs[i].data[0]
+		} else {
+			s.iovs[i].Base = nil
+		}
+		s.iovs[i].SetLen(len(msgs[i].data))
+		s.hdrs[i].hdr.Iov = &s.iovs[i]
+		s.hdrs[i].hdr.Iovlen = 1
+
+		var namelen uint32
+		namelen, err = c.putSockaddr(&s.names[i], msgs[i].addr)
+		if err != nil {
+			return
+		}
+		s.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&s.names[i]))
+		s.hdrs[i].hdr.Namelen = namelen
+	}
+
+	for sent := 0; sent < len(msgs); sent += s.n {
+		s.off, s.vlen = sent, len(msgs)-sent
+		if err = c.rc.Write(s.sendFn); err != nil {
+			return
+		}
+		if s.errno != 0 {
+			return os.NewSyscallError("sendmmsg", s.errno)
+		}
+	}
+	return
+}
+
+func (s *batchScratch) doSend(fd uintptr) bool {
+	for {
+		r, _, e := syscall.Syscall6(sysSENDMMSG, fd, uintptr(unsafe.Pointer(&s.hdrs[s.off])), uintptr(s.vlen), 0, 0, 0)
+		switch e {
+		case syscall.EINTR:
+			continue
+		case syscall.EAGAIN:
+			return false
+		}
+		s.n, s.errno = int(r), e
+		return true
+	}
+}
+
+// putSockaddr encodes addr for the socket family, ipv4 is mapped on ipv6 sockets.
+func (c *mmsgConn) putSockaddr(raw *syscall.RawSockaddrAny, addr *net.UDPAddr) (namelen uint32, err error) {
+	if ip4 := addr.IP.To4(); ip4 != nil && c.family == syscall.AF_INET {
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(raw))
+		*sa = syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+		putPort(&sa.Port, addr.Port)
+		copy(sa.Addr[:], ip4)
+		return syscall.SizeofSockaddrInet4, nil
+	}
+
+	ip6 := addr.IP.To16()
+	if ip6 == nil || c.family != syscall.AF_INET6 {
+		return 0, &net.AddrError{Err: "address family not supported by socket", Addr: addr.String()}
+	}
+	sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(raw))
+	*sa = syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	putPort(&sa.Port, addr.Port)
+	copy(sa.Addr[:], ip6)
+	if addr.Zone != "" {
+		sa.Scope_id = zoneToIndex(addr.Zone)
+	}
+	return syscall.SizeofSockaddrInet6, nil
+}
+
+func sockaddrToUDPAddr(raw *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch raw.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(raw))
+		return &net.UDPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]), Port: getPort(&sa.Port)}
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(raw))
+		addr := &net.UDPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: getPort(&sa.Port)}
+		if sa.Scope_id != 0 {
+			addr.Zone = strconv.Itoa(int(sa.Scope_id))
+		}
+		return addr
+	default:
+		return nil
+	}
+}
+
+// ports are in network byte order
+func putPort(p *uint16, port int) {
+	b := (*[2]byte)(unsafe.Pointer(p))
+	b[0], b[1] = byte(port>>8), byte(port)
+}
+
+func getPort(p *uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(p))
+	return int(b[0])<<8 | int(b[1])
+}
+
+func zoneToIndex(zone string) uint32 {
+	if ifi, err := net.InterfaceByName(zone); err == nil {
+		return uint32(ifi.Index)
+	}
+	index, _ := strconv.Atoi(zone)
+	return uint32(index)
+}
@@ -0,0 +1,62 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package socks_go
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMMsgConn(t *testing.T) {
+	// dual stack socket
+	conn, err := net.ListenUDP("udp", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	bc := newUDPBatchConn(conn)
+	require.NotNil(t, bc)
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer peer.Close()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	for _, data := range []string{"a", "", "ccc"} {
+		_, err = peer.WriteTo([]byte(data), to)
+		require.NoError(t, err)
+	}
+
+	b := newUDPBatch(udpBatchSize)
+	require.NoError(t, bc.waitRead())
+	n := 0
+	for n < 3 {
+		got, err := bc.readBatch(b)
+		require.NoError(t, err)
+		for _, m := range b.msgs[:got] {
+			assert.Equal(t, []string{"a", "", "ccc"}[n], string(m.data))
+			assert.Equal(t, peer.LocalAddr().String(), m.addr.String())
+			n++
+		}
+	}
+
+	// ipv4 destination on ipv6 socket
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1).To4(), Port: peer.LocalAddr().(*net.UDPAddr).Port}
+	b.out = append(b.out[:0], udpMsg{data: []byte("x"), addr: dst}, udpMsg{data: []byte("yy"), addr: dst})
+	require.NoError(t, bc.writeBatch(b, b.out))
+
+	_ = peer.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 16)
+	for _, expected := range []string{"x", "yy"} {
+		n, _, err := peer.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(buf[:n]))
+	}
+
+	// read fails after close
+	conn.Close()
+	assert.Error(t, bc.waitRead())
+}
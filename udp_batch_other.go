@@ -0,0 +1,58 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package socks_go
+
+import (
+	"net"
+	"syscall"
+)
+
+type batchScratch struct{}
+
+// singleConn reads and writes datagrams one by one,
+// waiting for data without buffers like mmsgConn.
+type singleConn struct {
+	conn *net.UDPConn
+	rc   syscall.RawConn
+
+	// only one reader waits at a time
+	peeked  bool
+	peekBuf [1]byte
+	peekFn  func(fd uintptr) bool
+}
+
+func newUDPBatchConn(conn *net.UDPConn) udpBatchConn {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	c := &singleConn{conn: conn, rc: rc}
+	c.peekFn = c.doPeek
+	return c
+}
+
+func (c *singleConn) waitRead() error {
+	c.peeked = false
+	return c.rc.Read(c.peekFn)
+}
+
+func (c *singleConn) readBatch(b *udpBatch) (n int, err error) {
+	m := &b.msgs[0]
+	n, addr, err := c.conn.ReadFromUDP(m.buf[udpHeadroom:])
+	if err != nil {
+		return 0, err
+	}
+	m.data = m.buf[udpHeadroom : udpHeadroom+n]
+	m.addr = addr
+	return 1, nil
+}
+
+func (c *singleConn) writeBatch(b *udpBatch, msgs []udpMsg) error {
+	for i := range msgs {
+		if _, err := c.conn.WriteToUDP(msgs[i].data, msgs[i].addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
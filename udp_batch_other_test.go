@@ -0,0 +1,65 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package socks_go
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSingleConn(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+	bc := newUDPBatchConn(conn)
+	require.NotNil(t, bc)
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer peer.Close()
+
+	// waits without reading
+	waited := make(chan error, 1)
+	go func() { waited <- bc.waitRead() }()
+	select {
+	case err = <-waited:
+		t.Fatalf("waitRead returned before data: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	for _, data := range []string{"a", "", "ccc"} {
+		_, err = peer.WriteTo([]byte(data), conn.LocalAddr())
+		require.NoError(t, err)
+	}
+	require.NoError(t, <-waited)
+
+	b := newUDPBatch(udpBatchSize)
+	for _, expected := range []string{"a", "", "ccc"} {
+		require.NoError(t, bc.waitRead())
+		n, err := bc.readBatch(b)
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+		assert.Equal(t, expected, string(b.msgs[0].data))
+		assert.Equal(t, peer.LocalAddr().String(), b.msgs[0].addr.String())
+	}
+
+	dst := peer.LocalAddr().(*net.UDPAddr)
+	b.out = append(b.out[:0], udpMsg{data: []byte("x"), addr: dst}, udpMsg{data: []byte("yy"), addr: dst})
+	require.NoError(t, bc.writeBatch(b, b.out))
+
+	_ = peer.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 16)
+	for _, expected := range []string{"x", "yy"} {
+		n, _, err := peer.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(buf[:n]))
+	}
+
+	// read fails after close
+	conn.Close()
+	assert.Error(t, bc.waitRead())
+}
@@ -0,0 +1,248 @@
+package socks_go
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// UDPMux is a client-facing udp socket shared by udp associations,
+// so that only one well-known port has to be opened in firewalls.
+//
+// Datagrams are demultiplexed by client source address. An association is bound
+// to the first datagram from the ip of its tcp connection, preferring the port
+// given in the request. Clients behind the same ip should send their ports,
+// otherwise concurrent associations may be bound in any order. For tcp connections
+// without ip, e.g. unix socket, the request must give the exact client address,
+// which must not be used by any association, pending or bound, so one client can
+// not take datagrams of another.
+//
+// Datagrams are queued to the association, which forwards them by its own goroutine.
+//
+// A mux may be shared by servers, e.g. across config reloads.
+type UDPMux struct {
+	conn    *net.UDPConn
+	batch   udpBatchConn
+	workers *udpWorkerPool
+
+	mu     sync.Mutex
+	relays map[udpAddrKey]*udpRelay
+	// associations waiting for the first datagram, by ip of tcp connection
+	pending map[udpIPKey][]*udpRelay
+	closed  bool
+}
+
+const udpMuxReadBuffer = 4 << 20
+
+// datagrams queued for an association, further ones are dropped
+const udpMuxQueueLen = 32
+
+type udpIPKey [net.IPv6len]byte
+
+type udpAddrKey struct {
+	ip   udpIPKey
+	port int
+}
+
+func makeUDPIPKey(ip net.IP) (key udpIPKey) {
+	copy(key[:], ip.To16())
+	return
+}
+
+func makeUDPAddrKey(addr *net.UDPAddr) udpAddrKey {
+	return udpAddrKey{makeUDPIPKey(addr.IP), addr.Port}
+}
+
+// ListenUDPMux listens on the udp addr and starts demultiplexing.
+func ListenUDPMux(addr string) (*UDPMux, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad udp addr %q", addr)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	// bursts of all associations are queued on one socket, may be capped by the system
+	if bufErr := conn.SetReadBuffer(udpMuxReadBuffer); bufErr != nil {
+		log.Warnf("udp mux %v: can not set read buffer: %v", conn.LocalAddr(), bufErr)
+	}
+
+	m := &UDPMux{
+		conn:    conn,
+		batch:   newUDPBatchConn(conn),
+		workers: newUDPWorkerPool(1),
+		relays:  make(map[udpAddrKey]*udpRelay),
+		pending: make(map[udpIPKey][]*udpRelay),
+	}
+	go m.serve()
+	return m, nil
+}
+
+func (m *UDPMux) LocalAddr() net.Addr {
+	return m.conn.LocalAddr()
+}
+
+// Close stops the mux, associations on it are stopped.
+func (m *UDPMux) Close() error {
+	return m.conn.Close()
+}
+
+func (m *UDPMux) serve() {
+	err := pumpUDP("mux", m.conn, m.batch, m.workers, m.dispatch)
+	log.Infof("udp mux %v stopped: %v", m.conn.LocalAddr(), err)
+
+	m.mu.Lock()
+	m.closed = true
+	relays := make([]*udpRelay, 0, len(m.relays))
+	for _, r := range m.relays {
+		relays = append(relays, r)
+	}
+	for _, list := range m.pending {
+		relays = append(relays, list...)
+	}
+	m.mu.Unlock()
+
+	for _, r := range relays {
+		r.stop(errors.Wrap(err, "udp mux stopped"))
+	}
+}
+
+// add registers the association, ctrlIP is the ip of its tcp connection,
+// port is the client port from request, zero if unknown.
+func (m *UDPMux) add(r *udpRelay, ctrlIP net.IP, port uint16) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return errors.New("udp mux closed")
+	}
+	ipKey := makeUDPIPKey(ctrlIP)
+	if port != 0 && m.relays[udpAddrKey{ipKey, int(port)}] != nil {
+		return errors.Errorf("udp mux: client %v bound to another association", &net.UDPAddr{IP: ctrlIP, Port: int(port)})
+	}
+	r.muxQueue = make(chan udpMsg, udpMuxQueueLen)
+	r.muxIP, r.muxPort = ipKey, int(port)
+	m.pending[r.muxIP] = append(m.pending[r.muxIP], r)
+	return nil
+}
+
+// bind registers the association for datagrams from the exact client addr.
+func (m *UDPMux) bind(r *udpRelay, addr *net.UDPAddr) error {
+	key := makeUDPAddrKey(addr)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return errors.New("udp mux closed")
+	}
+	if m.relays[key] != nil {
+		return errors.Errorf("udp mux: client %v bound to another association", addr)
+	}
+	// a pending association of the ip may be bound to any port
+	if len(m.pending[key.ip]) > 0 {
+		return errors.Errorf("udp mux: client %v may be used by pending association", addr)
+	}
+	r.muxQueue = make(chan udpMsg, udpMuxQueueLen)
+	r.muxBound, r.muxKey = true, key
+	m.relays[key] = r
+	return nil
+}
+
+func (m *UDPMux) remove(r *udpRelay) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r.muxBound {
+		if m.relays[r.muxKey] == r {
+			delete(m.relays, r.muxKey)
+		}
+		return
+	}
+
+	list := m.pending[r.muxIP]
+	for i := range list {
+		if list[i] == r {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(m.pending, r.muxIP)
+	} else {
+		m.pending[r.muxIP] = list
+	}
+}
+
+// lookup returns the association of the client, binds a pending one for unknown source.
+func (m *UDPMux) lookup(addr *net.UDPAddr) *udpRelay {
+	key := makeUDPAddrKey(addr)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r := m.relays[key]; r != nil {
+		return r
+	}
+
+	ipKey := key.ip
+	idx := pickPending(m.pending[ipKey], addr.Port)
+	if idx < 0 {
+		return nil
+	}
+
+	list := m.pending[ipKey]
+	r := list[idx]
+	if list = append(list[:idx], list[idx+1:]...); len(list) == 0 {
+		delete(m.pending, ipKey)
+	} else {
+		m.pending[ipKey] = list
+	}
+
+	r.muxBound, r.muxKey = true, key
+	m.relays[key] = r
+	log.Infof("client: %v, udp association bound to %v", r.sess.Conn.RemoteAddr(), addr)
+	return r
+}
+
+// pickPending prefers the association that requested the port, then the one without port,
+// then the oldest one, in case the port is translated by NAT.
+func pickPending(list []*udpRelay, port int) int {
+	if len(list) == 0 {
+		return -1
+	}
+	for i, r := range list {
+		if r.muxPort == port {
+			return i
+		}
+	}
+	for i, r := range list {
+		if r.muxPort == 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// dispatch queues datagrams to their associations, never blocks on any of them.
+func (m *UDPMux) dispatch(b *udpBatch, msgs []udpMsg) error {
+	for i := range msgs {
+		msg := &msgs[i]
+		if msg.addr == nil {
+			continue
+		}
+
+		r := m.lookup(msg.addr)
+		if r == nil {
+			log.Debugf("udp mux: drop datagram from unknown client %v", msg.addr)
+			continue
+		}
+		if !r.queueFromMux(msg) {
+			log.Debugf("client: %v, udp mux: queue full, drop datagram from %v", r.sess.Conn.RemoteAddr(), msg.addr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package socks_go
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPMux_Lookup(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	newRelay := func() *udpRelay { return &udpRelay{sess: &Session{Conn: c1}} }
+
+	m := &UDPMux{relays: make(map[udpAddrKey]*udpRelay), pending: make(map[udpIPKey][]*udpRelay)}
+	ipA, ipB := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	r1, r2, r3 := newRelay(), newRelay(), newRelay()
+	require.NoError(t, m.add(r1, ipA, 0))
+	require.NoError(t, m.add(r2, ipA, 2000))
+	require.NoError(t, m.bind(r3, &net.UDPAddr{IP: ipB, Port: 1}))
+	// addresses in use can not be claimed
+	assert.Error(t, m.bind(newRelay(), &net.UDPAddr{IP: ipB, Port: 1}))
+	assert.Error(t, m.bind(newRelay(), &net.UDPAddr{IP: ipA, Port: 4000}))
+	assert.Error(t, m.add(newRelay(), ipB, 1))
+
+	// requested port first
+	assert.Equal(t, r2, m.lookup(&net.UDPAddr{IP: ipA, Port: 2000}))
+	assert.Equal(t, r2, m.lookup(&net.UDPAddr{IP: ipA, Port: 2000}))
+	assert.Equal(t, r1, m.lookup(&net.UDPAddr{IP: ipA.To16(), Port: 3000}))
+	// exact addr only
+	assert.Equal(t, r3, m.lookup(&net.UDPAddr{IP: ipB, Port: 1}))
+	assert.Nil(t, m.lookup(&net.UDPAddr{IP: ipB, Port: 2}))
+	assert.Empty(t, m.pending)
+
+	m.remove(r1)
+	assert.Nil(t, m.lookup(&net.UDPAddr{IP: ipA, Port: 3000}))
+	assert.Equal(t, r2, m.lookup(&net.UDPAddr{IP: ipA, Port: 2000}))
+
+	// pending ones are removed too
+	r4 := newRelay()
+	require.NoError(t, m.add(r4, ipB, 0))
+	m.remove(r4)
+	assert.Empty(t, m.pending)
+	assert.Nil(t, m.lookup(&net.UDPAddr{IP: ipB, Port: 3}))
+}
+
+func TestUDPMux_Dispatch(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	m := &UDPMux{relays: make(map[udpAddrKey]*udpRelay), pending: make(map[udpIPKey][]*udpRelay)}
+	stalled, other := &udpRelay{sess: &Session{Conn: c1}}, &udpRelay{sess: &Session{Conn: c1}}
+	addrA, addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2}
+	require.NoError(t, m.bind(stalled, addrA))
+	require.NoError(t, m.bind(other, addrB))
+
+	// a stalled association drops datagrams instead of blocking the others
+	b := newUDPBatch(udpBatchSize)
+	for i := 0; i < 2*udpMuxQueueLen; i += len(b.msgs) {
+		for j := range b.msgs {
+			b.msgs[j].data, b.msgs[j].addr = []byte{byte(i + j)}, addrA
+		}
+		b.msgs[len(b.msgs)-1].addr = addrB
+		require.NoError(t, m.dispatch(b, b.msgs))
+	}
+	assert.Len(t, stalled.muxQueue, udpMuxQueueLen)
+	assert.Len(t, other.muxQueue, 2*udpMuxQueueLen/len(b.msgs))
+
+	// copied out of the batch
+	got := <-stalled.muxQueue
+	assert.Equal(t, []byte{0}, got.data)
+	assert.Equal(t, 1, cap(got.data))
+	assert.Equal(t, addrA, got.addr)
+}
+
+func TestPickPending(t *testing.T) {
+	a, b, c := &udpRelay{muxPort: 1000}, &udpRelay{}, &udpRelay{muxPort: 2000}
+	assert.Equal(t, -1, pickPending(nil, 1000))
+	assert.Equal(t, 2, pickPending([]*udpRelay{a, b, c}, 2000))
+	assert.Equal(t, 1, pickPending([]*udpRelay{a, b, c}, 3000))
+	// port translated by NAT
+	assert.Equal(t, 0, pickPending([]*udpRelay{a, c}, 3000))
+}
+
+func TestServer_UDPMux(t *testing.T) {
+	udpEcho := startUDPEcho(t)
+	defer udpEcho.Close()
+
+	for _, noBatch := range []bool{false, true} {
+		mux, err := ListenUDPMux("127.0.0.1:0")
+		require.NoError(t, err)
+		server := &Server{UDPMux: mux, noUDPBatch: noBatch}
+		dialer := startServer(t, server)
+
+		tunnels := make([]*ClientUDPTunnel, 0)
+		for i := 0; i < 8; i++ {
+			tunnel, err := dialer.UDPAssociation()
+			require.NoError(t, err)
+			assert.Equal(t, mux.LocalAddr().(*net.UDPAddr).Port, int(tunnel.BindPort))
+			tunnels = append(tunnels, tunnel)
+		}
+
+		var wg sync.WaitGroup
+		for _, tunnel := range tunnels {
+			wg.Add(1)
+			go func(tunnel *ClientUDPTunnel) {
+				defer wg.Done()
+				checkUDPEcho(t, tunnel, udpEcho.LocalAddr(), 0, 10, 1000)
+			}(tunnel)
+		}
+		wg.Wait()
+		checkUDPEcho(t, tunnels[0], udpEcho.LocalAddr(), 60000)
+
+		// the others are not affected
+		tunnels[0].Close()
+		checkUDPEcho(t, tunnels[1], udpEcho.LocalAddr(), 100)
+
+		for _, tunnel := range tunnels[1:] {
+			tunnel.Close()
+		}
+		assert.Eventually(t, func() bool {
+			mux.mu.Lock()
+			defer mux.mu.Unlock()
+			return len(mux.relays) == 0 && len(mux.pending) == 0
+		}, 3*time.Second, 10*time.Millisecond)
+
+		server.Close()
+		mux.Close()
+	}
+}
+
+func TestServer_UDPMuxUnix(t *testing.T) {
+	udpEcho := startUDPEcho(t)
+	defer udpEcho.Close()
+
+	dir, err := ioutil.TempDir("", "socks_go")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socks.sock")
+
+	mux, err := ListenUDPMux("127.0.0.1:0")
+	require.NoError(t, err)
+	defer mux.Close()
+	l := &Listener{Network: "unix", Addr: path}
+	server := &Server{Listeners: []*Listener{l}, UDPMux: mux}
+	listener, err := l.Listen()
+	require.NoError(t, err)
+	go server.ServeOn(l, listener)
+	defer server.Close()
+
+	// the exact client address is sent
+	dialer := &Dialer{ProxyNetwork: "unix", ProxyAddr: path, Timeout: 3 * time.Second}
+	tunnel, err := dialer.UDPAssociation()
+	require.NoError(t, err)
+	defer tunnel.Close()
+	checkUDPEcho(t, tunnel, udpEcho.LocalAddr(), 10, 1000)
+
+	// no address to match
+	_, err = dialer.handshake(func(conn net.Conn, client *Client) (err error) {
+		if err = client.protocol.SendCommand(CmdUDP, NewSocksAddr(), 1234); err != nil {
+			return
+		}
+		reply, _, _, err := client.protocol.ReceiveReply()
+		if err == nil && reply != ReplyOK {
+			err = &ReplyError{reply}
+		}
+		return
+	})
+	assert.Equal(t, &ReplyError{Reply: ReplyFail}, err)
+}
+
+func TestServer_UDPMuxClose(t *testing.T) {
+	udpEcho := startUDPEcho(t)
+	defer udpEcho.Close()
+
+	mux, err := ListenUDPMux("127.0.0.1:0")
+	require.NoError(t, err)
+	server := &Server{UDPMux: mux}
+	defer server.Close()
+	dialer := startServer(t, server)
+
+	tunnel, err := dialer.UDPAssociation()
+	require.NoError(t, err)
+	defer tunnel.Close()
+	checkUDPEcho(t, tunnel, udpEcho.LocalAddr(), 10)
+
+	// associations are stopped with mux
+	mux.Close()
+	assert.Eventually(t, func() bool {
+		_, err := tunnel.WriteTo([]byte("x"), udpEcho.LocalAddr())
+		return err != nil
+	}, 3*time.Second, 10*time.Millisecond)
+
+	_, err = dialer.UDPAssociation()
+	assert.Error(t, err)
+}
+
+func TestServer_UDPPortRange(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer target.Close()
+
+	// find a free port
+	probe, err := net.ListenUDP("udp", nil)
+	require.NoError(t, err)
+	port := uint16(probe.LocalAddr().(*net.UDPAddr).Port)
+	probe.Close()
+
+	server := &Server{UDPPortRange: PortRange{port, port}}
+	defer server.Close()
+	dialer := startServer(t, server)
+
+	tunnel, err := dialer.UDPAssociation()
+	require.NoError(t, err)
+	defer tunnel.Close()
+	_, err = tunnel.WriteTo([]byte("hello"), target.LocalAddr())
+	require.NoError(t, err)
+
+	_ = target.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, from, err := target.ReadFrom(make([]byte, 100))
+	require.NoError(t, err)
+	assert.Equal(t, int(port), from.(*net.UDPAddr).Port)
+
+	// no port left
+	_, err = dialer.UDPAssociation()
+	assert.Error(t, err)
+	_, err = net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+	assert.True(t, isAddrInUse(err), "%v", err)
+}
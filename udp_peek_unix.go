@@ -0,0 +1,18 @@
+//go:build !windows && (!linux || !(amd64 || arm64))
+// +build !windows
+// +build !linux !amd64,!arm64
+
+package socks_go
+
+import "syscall"
+
+// doPeek checks for a datagram without taking it
+func (c *singleConn) doPeek(fd uintptr) bool {
+	for {
+		_, _, err := syscall.Recvfrom(int(fd), c.peekBuf[:], syscall.MSG_PEEK)
+		if err == syscall.EINTR {
+			continue
+		}
+		return err != syscall.EAGAIN
+	}
+}
@@ -0,0 +1,10 @@
+package socks_go
+
+// doPeek lets RawConn.Read wait for a datagram with a zero-byte read.
+func (c *singleConn) doPeek(fd uintptr) bool {
+	if c.peeked {
+		return true
+	}
+	c.peeked = true
+	return false
+}
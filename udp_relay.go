@@ -0,0 +1,500 @@
+package socks_go
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// udpRelay forwards datagrams of an udp association, each direction is
+// forwarded by its own goroutine from the source socket to the destination socket.
+// With UDPMux, client datagrams are read by the goroutine of mux and queued to the association.
+// With udp over tcp, client datagrams are framed on the tcp connection as stream.
+type udpRelay struct {
+	s    *Server
+	sess *Session
+
+	// shared by associations if mux is not nil
+	client *net.UDPConn
+	mux    *UDPMux
+	stream io.ReadWriter
+	remote udpRemote
+	// nil if batching is not supported
+	clientBatch udpBatchConn
+	remoteBatch udpBatchConn
+
+	mu sync.Mutex
+	// source of client datagrams, replies are sent to it
+	clientAddr *net.UDPAddr
+	// rewritten ip destinations to the original ones, for the source of replies
+	rewritten map[string]udpTarget
+	// domains of direct datagrams, resolved by resolveLoop
+	resolved     map[string]udpResolved
+	resolveQueue chan udpResolveReq
+
+	stopOnce sync.Once
+	err      error
+	done     chan struct{}
+
+	// copies of client datagrams read by mux
+	muxQueue chan udpMsg
+	// guarded by mu of mux
+	muxIP    udpIPKey
+	muxPort  int
+	muxBound bool
+	muxKey   udpAddrKey
+}
+
+// newUDPRelay makes a relay without client side, which is set by caller.
+func (s *Server) newUDPRelay(sess *Session, remote udpRemote) *udpRelay {
+	r := &udpRelay{
+		s: s, sess: sess, remote: remote,
+		rewritten: make(map[string]udpTarget),
+		done:      make(chan struct{}),
+	}
+	if direct, ok := remote.(directUDPRemote); ok && !s.noUDPBatch {
+		r.remoteBatch = newUDPBatchConn(direct.UDPConn)
+	}
+	return r
+}
+
+func (r *udpRelay) setClient(client *net.UDPConn, batch udpBatchConn) {
+	r.client = client
+	if !r.s.noUDPBatch {
+		r.clientBatch = batch
+	}
+}
+
+// run forwards datagrams until the tcp connection finished or any error,
+// both udp sockets are closed on return.
+func (r *udpRelay) run() error {
+	conn := r.sess.Conn
+
+	var wg sync.WaitGroup
+	if r.stream != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.stop(r.pumpStream())
+		}()
+	} else if r.mux != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.stop(r.pumpMux())
+		}()
+	} else {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.stop(pumpUDP("client", r.client, r.clientBatch, r.s.udpWorkers, r.fromClient))
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.stop(pumpUDP("remote", r.remote, r.remoteBatch, r.s.udpWorkers, r.fromRemote))
+	}()
+
+	if r.stream != nil {
+		wg.Wait()
+		return r.err
+	}
+
+	// monitor tcp connection
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			n, tcpErr := r.sess.Proto.Transport.Read(buf) // TODO: timeout?
+			if n != 0 {
+				log.Warnf("client: %v, data received after udp association cmd", conn.RemoteAddr())
+			}
+
+			if tcpErr == io.EOF {
+				log.Debugf("client: %v, udp client leave", conn.RemoteAddr())
+				r.stop(nil)
+				return
+			} else if tcpErr != nil {
+				r.stop(errors.Wrapf(tcpErr, "client tcp conn broken"))
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	return r.err
+}
+
+// stop closes the udp sockets or leaves the mux, only the first err is kept.
+func (r *udpRelay) stop(err error) {
+	r.stopOnce.Do(func() {
+		r.err = err
+		close(r.done)
+		if r.stream != nil {
+			// unblock reading of stream, the tcp connection is closed by server
+			_ = r.sess.Conn.SetReadDeadline(time.Now())
+		} else if r.mux != nil {
+			r.mux.remove(r)
+		} else if closeErr := r.client.Close(); closeErr != nil {
+			log.Errorf("close client udp conn err: %v", closeErr)
+		}
+		if closeErr := r.remote.Close(); closeErr != nil {
+			log.Errorf("close remote udp conn err: %v", closeErr)
+		}
+	})
+}
+
+// pumpUDP reads datagrams from src and forwards them until error.
+func pumpUDP(
+	name string, src net.PacketConn, batchSrc udpBatchConn, workers *udpWorkerPool,
+	forward func(b *udpBatch, msgs []udpMsg) error) error {
+
+	for {
+		var b *udpBatch
+		var n int
+		var err error
+		if batchSrc != nil {
+			// no buffers held while waiting
+			if err = batchSrc.waitRead(); err != nil {
+				return errors.Wrapf(err, "%s udp read error", name)
+			}
+			b = workers.get()
+			n, err = batchSrc.readBatch(b)
+		} else {
+			if waiter, ok := src.(interface{ waitRead() error }); ok {
+				if err = waiter.waitRead(); err != nil {
+					return errors.Wrapf(err, "%s udp read error", name)
+				}
+			}
+			b = udpSinglePool.Get().(*udpBatch)
+			n, err = readSingle(src, b)
+		}
+
+		if err != nil {
+			err = errors.Wrapf(err, "%s udp read error", name)
+		} else {
+			err = forward(b, b.msgs[:n])
+		}
+
+		if batchSrc != nil {
+			workers.put(b)
+		} else {
+			udpSinglePool.Put(b)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// pumpStream reads datagrams of udp over tcp and forwards them until error or EOF.
+func (r *udpRelay) pumpStream() error {
+	reader := bufio.NewReader(r.stream)
+	for {
+		b := udpSinglePool.Get().(*udpBatch)
+		m := &b.msgs[0]
+		msg, err := readUDPFrame(reader, m.buf[udpHeadroom:])
+		if err != nil {
+			udpSinglePool.Put(b)
+			if err == io.EOF {
+				log.Debugf("client: %v, udp over tcp client leave", r.sess.Conn.RemoteAddr())
+				return nil
+			}
+			return errors.Wrapf(err, "client tcp conn broken")
+		}
+
+		m.data = msg
+		err = r.fromClient(b, b.msgs[:1])
+		udpSinglePool.Put(b)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// pumpMux forwards client datagrams queued by mux until stopped,
+// so slow lookups or writes of an association do not stall the others on mux.
+func (r *udpRelay) pumpMux() error {
+	for {
+		select {
+		case msg := <-r.muxQueue:
+			b := udpSinglePool.Get().(*udpBatch)
+			b.msgs[0].data, b.msgs[0].addr = msg.data, msg.addr
+			err := r.fromClient(b, b.msgs[:1])
+			b.msgs[0].data, b.msgs[0].addr = nil, nil
+			udpSinglePool.Put(b)
+			if err != nil {
+				return err
+			}
+		case <-r.done:
+			return nil
+		}
+	}
+}
+
+// queueFromMux copies the datagram for pumpMux, dropped if the queue is full.
+// The copy is sized to the datagram, a full queue holds no more than the data queued.
+func (r *udpRelay) queueFromMux(msg *udpMsg) bool {
+	data := make([]byte, len(msg.data))
+	copy(data, msg.data)
+	select {
+	case r.muxQueue <- udpMsg{data: data, addr: msg.addr}:
+		return true
+	default:
+		return false
+	}
+}
+
+func readSingle(conn net.PacketConn, b *udpBatch) (n int, err error) {
+	m := &b.msgs[0]
+	n, addr, err := conn.ReadFrom(m.buf[udpHeadroom:])
+	if err != nil {
+		return 0, err
+	}
+	m.data = m.buf[udpHeadroom : udpHeadroom+n]
+	m.addr, _ = addr.(*net.UDPAddr)
+	return 1, nil
+}
+
+func (r *udpRelay) fromClient(b *udpBatch, msgs []udpMsg) (err error) {
+	conn := r.sess.Conn
+
+	b.out = b.out[:0]
+	for i := range msgs {
+		m := &msgs[i]
+		if r.stream == nil {
+			if m.addr == nil {
+				continue
+			}
+			log.Debugf("client: %v, client udp: %v, got data from client", conn.RemoteAddr(), m.addr)
+			r.setClientAddr(m.addr)
+		}
+
+		// parse protocol
+		sockAddr, port, data, parseErr := ParseUDPMsg(m.data)
+		if parseErr != nil {
+			log.Warnf("client: %v, drop bad udp datagram: %v", conn.RemoteAddr(), parseErr)
+			continue
+		}
+		// detach from the batch, the addr may outlive it in rewritten and logs
+		if sockAddr.IP != nil {
+			sockAddr.IP = append(net.IP(nil), sockAddr.IP...)
+		}
+
+		sockAddr, port, origin := r.rewrite(sockAddr, port)
+
+		// direct datagrams are sent to the address checked by rules,
+		// domains through upstream are left to upstream
+		var toAddr *net.UDPAddr
+		if _, direct := r.remote.(directUDPRemote); direct {
+			if sockAddr.Type != ATypeDomain {
+				toAddr, _ = socksAddrToUDPAddr(sockAddr, port)
+			} else if ip := r.cachedIP(sockAddr.Domain); ip != nil {
+				toAddr = &net.UDPAddr{IP: ip, Port: int(port)}
+			} else {
+				// not resolved while holding a worker
+				r.queueResolve(data, sockAddr, port, origin)
+				continue
+			}
+		}
+		if !r.allowed(sockAddr, port, toAddr, len(data)) {
+			continue
+		}
+		if origin != nil && toAddr != nil {
+			r.remember(toAddr, *origin)
+		}
+
+		if r.remoteBatch == nil {
+			var n int
+			if toAddr != nil {
+				n, err = r.remote.WriteTo(data, toAddr)
+			} else {
+				n, err = r.remote.WriteToSocksAddr(data, sockAddr, port)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "remote udp write error")
+			}
+			if n != len(data) {
+				log.Warnf("client: %v, udp short write to remote: %d of %d bytes",
+					conn.RemoteAddr(), n, len(data))
+			}
+			continue
+		}
+
+		b.out = append(b.out, udpMsg{data: data, addr: toAddr})
+	}
+
+	if len(b.out) > 0 {
+		if err = r.remoteBatch.writeBatch(b, b.out); err != nil {
+			return errors.Wrapf(err, "remote udp write error")
+		}
+	}
+	return
+}
+
+// allowed checks the datagram by rules, toAddr is the resolved destination if direct.
+// Allowed datagrams are counted.
+func (r *udpRelay) allowed(addr SocksAddr, port uint16, toAddr *net.UDPAddr, size int) bool {
+	conn, proto, l := r.sess.Conn, r.sess.Proto, r.sess.Listener
+
+	var toIP net.IP
+	if toAddr != nil {
+		toIP = toAddr.IP
+	}
+	if allowed, _ := r.s.rules(l).AllowedIP(proto.Identity, CmdUDP, addr, port, toIP); !allowed {
+		log.Warnf("client: %v, udp datagram to %v:%d denied by rule", conn.RemoteAddr(), addr, port)
+		return false
+	}
+
+	log.Debugf("client: %v, remote udp dest: %v:%d", conn.RemoteAddr(), addr, port)
+	atomic.AddInt64(&r.sess.bytesUp, int64(size))
+	return true
+}
+
+func (r *udpRelay) fromRemote(b *udpBatch, msgs []udpMsg) (err error) {
+	conn := r.sess.Conn
+
+	r.mu.Lock()
+	clientAddr := r.clientAddr
+	r.mu.Unlock()
+	if clientAddr == nil && r.stream == nil {
+		log.Warnf("client: %v, got %d datagrams from remote udp, but clientAddr == nil",
+			conn.RemoteAddr(), len(msgs))
+		return
+	}
+
+	b.out = b.out[:0]
+	for i := range msgs {
+		m := &msgs[i]
+		if m.addr == nil {
+			continue
+		}
+		log.Debugf("client: %v, remote udp: %v, got data from remote", conn.RemoteAddr(), m.addr)
+		atomic.AddInt64(&r.sess.bytesDown, int64(len(m.data)))
+
+		from := r.origin(m.addr)
+		packed, packErr := prependUDPHeader(m.buf, from.addr, from.port, len(m.data))
+		if packErr != nil {
+			log.Warnf("client: %v, drop udp packet from remote: %v", conn.RemoteAddr(), packErr)
+			continue
+		}
+
+		if r.stream != nil {
+			// the length goes before the header
+			frame := m.buf[udpHeadroom+len(m.data)-len(packed)-udpFrameHeaderLen : udpHeadroom+len(m.data)]
+			if packErr = putUDPFrameHeader(frame); packErr != nil {
+				log.Warnf("client: %v, drop udp packet from remote: %v", conn.RemoteAddr(), packErr)
+				continue
+			}
+			if _, err = r.stream.Write(frame); err != nil {
+				return errors.Wrapf(err, "client tcp write error")
+			}
+			continue
+		}
+
+		if r.clientBatch == nil {
+			var n int
+			n, err = r.client.WriteToUDP(packed, clientAddr)
+			if err != nil {
+				return errors.Wrapf(err, "client udp write error")
+			}
+			if n != len(packed) {
+				log.Warnf("client: %v, udp short write to client: %d of %d bytes",
+					conn.RemoteAddr(), n, len(packed))
+			}
+			continue
+		}
+		b.out = append(b.out, udpMsg{data: packed, addr: clientAddr})
+	}
+
+	if len(b.out) > 0 {
+		if err = r.clientBatch.writeBatch(b, b.out); err != nil {
+			return errors.Wrapf(err, "client udp write error")
+		}
+	}
+	return
+}
+
+func (r *udpRelay) setClientAddr(addr *net.UDPAddr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.clientAddr != nil && !UDPAddrEqual(r.clientAddr, addr) {
+		log.Errorf(
+			"client: %v, client udp source addr changing from %v to %v",
+			r.sess.Conn.RemoteAddr(), r.clientAddr, addr)
+	}
+	r.clientAddr = addr
+}
+
+// rewrite applies Server.Rewrites. The original destination of rewriting to an ip is
+// recorded for replies, for rewriting to a domain it is returned as origin and
+// recorded by remember once the domain is resolved.
+func (r *udpRelay) rewrite(addr SocksAddr, port uint16) (newAddr SocksAddr, newPort uint16, origin *udpTarget) {
+	newAddr, newPort, ok := r.s.Rewrites.Rewrite(addr, port)
+	if !ok {
+		return addr, port, nil
+	}
+
+	log.Debugf("client: %v, udp rewrite %v:%d to %v:%d", r.sess.Conn.RemoteAddr(), addr, port, newAddr, newPort)
+	if newAddr.Type == ATypeDomain {
+		return newAddr, newPort, &udpTarget{addr, port}
+	}
+	r.remember(&net.UDPAddr{IP: newAddr.IP, Port: int(newPort)}, udpTarget{addr, port})
+	return
+}
+
+// remember maps the rewritten destination to the original one.
+func (r *udpRelay) remember(to *net.UDPAddr, origin udpTarget) {
+	key := to.String()
+	r.mu.Lock()
+	if _, exists := r.rewritten[key]; !exists && len(r.rewritten) >= maxUDPRewrites {
+		r.rewritten = make(map[string]udpTarget)
+	}
+	r.rewritten[key] = origin
+	r.mu.Unlock()
+}
+
+// origin returns the destination of client before rewriting for the source of a reply.
+func (r *udpRelay) origin(addr *net.UDPAddr) udpTarget {
+	// TODO: map ip to domain if client uses domain instead of ip
+	// FIXME: fix wildcard ip
+	from := udpTarget{NewSocksAddrFromIP(addr.IP), uint16(addr.Port)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.rewritten) > 0 {
+		if orig, ok := r.rewritten[addr.String()]; ok {
+			from = orig
+		}
+	}
+	return from
+}
+
+// limits memory of mapping rewritten udp destinations
+const maxUDPRewrites = 1024
+
+type udpTarget struct {
+	addr SocksAddr
+	port uint16
+}
+
+// prependUDPHeader writes the header into the headroom of buf,
+// returns the datagram with the payload of dataLen bytes at udpHeadroom.
+func prependUDPHeader(buf []byte, addr SocksAddr, port uint16, dataLen int) (msg []byte, err error) {
+	headerLen := udpHeaderLen(addr)
+	if headerLen == 0 {
+		_, err = AppendSocksAddr(nil, addr)
+		return
+	}
+
+	msg = buf[udpHeadroom-headerLen : udpHeadroom+dataLen]
+	_, err = appendUDPHeader(msg[:0], addr, port)
+	return
+}
@@ -0,0 +1,129 @@
+package socks_go
+
+import (
+	"context"
+	"net"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+// Domains of direct udp datagrams are resolved by a goroutine of each association,
+// the pump holding a worker never waits for dns. Results are cached, so only the
+// first datagrams to a domain take the slow path.
+
+const (
+	udpResolveTTL = 30 * time.Second
+	// datagrams waiting for dns, further ones are dropped
+	udpResolveQueueLen = 32
+	// cached domains of an association, the cache is cleared when full
+	udpResolveCacheSize = 256
+)
+
+type udpResolved struct {
+	ip      net.IP
+	expires time.Time
+}
+
+type udpResolveReq struct {
+	data []byte
+	addr SocksAddr
+	port uint16
+	// destination before rewriting, nil if not rewritten
+	origin *udpTarget
+}
+
+// cachedIP returns the resolved ip of domain, nil if not cached or expired.
+func (r *udpRelay) cachedIP(domain string) net.IP {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.resolved[domain]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry.ip
+}
+
+// queueResolve queues a copy of the datagram for resolveLoop, which is started on demand.
+func (r *udpRelay) queueResolve(data []byte, addr SocksAddr, port uint16, origin *udpTarget) {
+	r.mu.Lock()
+	if r.resolveQueue == nil {
+		r.resolveQueue = make(chan udpResolveReq, udpResolveQueueLen)
+		go r.resolveLoop(r.resolveQueue)
+	}
+	queue := r.resolveQueue
+	r.mu.Unlock()
+
+	req := udpResolveReq{data: make([]byte, len(data)), addr: addr, port: port, origin: origin}
+	copy(req.data, data)
+	select {
+	case queue <- req:
+	default:
+		log.Warnf("client: %v, udp resolve queue full, drop datagram to %v:%d", r.sess.Conn.RemoteAddr(), addr, port)
+	}
+}
+
+// resolveLoop resolves and sends queued datagrams until the relay stopped.
+func (r *udpRelay) resolveLoop(queue chan udpResolveReq) {
+	conn := r.sess.Conn
+	for {
+		var req udpResolveReq
+		select {
+		case req = <-queue:
+		case <-r.done:
+			return
+		}
+
+		ip := r.cachedIP(req.addr.Domain)
+		if ip == nil {
+			var err error
+			if ip, err = r.lookup(req.addr.Domain); err != nil {
+				log.Warnf("client: %v, drop udp datagram to %v:%d: %v", conn.RemoteAddr(), req.addr, req.port, err)
+				continue
+			}
+		}
+
+		toAddr := &net.UDPAddr{IP: ip, Port: int(req.port)}
+		if !r.allowed(req.addr, req.port, toAddr, len(req.data)) {
+			continue
+		}
+		if req.origin != nil {
+			r.remember(toAddr, *req.origin)
+		}
+		if _, err := r.remote.WriteTo(req.data, toAddr); err != nil {
+			r.stop(errors.Wrapf(err, "remote udp write error"))
+			return
+		}
+	}
+}
+
+// lookup resolves domain and caches the result.
+func (r *udpRelay) lookup(domain string) (ip net.IP, err error) {
+	// ipv4 first like net.ResolveIPAddr, unless restricted by DialMode
+	mode := r.s.DialMode
+	if mode == DialDualStack {
+		mode = DialPreferIPv4
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.s.ConnectTimeout)
+	defer cancel()
+	var resolver Resolver = net.DefaultResolver
+	if r.s.udpResolver != nil {
+		resolver = r.s.udpResolver
+	}
+	if ip, err = lookupIP(ctx, resolver, domain, mode); err != nil {
+		return
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	r.mu.Lock()
+	if r.resolved == nil || len(r.resolved) >= udpResolveCacheSize {
+		r.resolved = make(map[string]udpResolved)
+	}
+	r.resolved[domain] = udpResolved{ip: ip, expires: time.Now().Add(udpResolveTTL)}
+	r.mu.Unlock()
+	return
+}
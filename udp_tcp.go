@@ -0,0 +1,178 @@
+package socks_go
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Udp over tcp is for networks blocking udp to the proxy server.
+// After CmdUDPOverTCP is accepted, both sides send udp datagrams of RFC 1928
+// (RSV FRAG ATYP DST.ADDR DST.PORT DATA) on the tcp connection,
+// each prefixed with its length in 2 bytes big endian.
+// Address and port of the request are ignored, the reply carries the
+// outbound udp address of server.
+
+const udpFrameHeaderLen = 2
+
+const maxUDPFrameLen = 0xffff
+
+// readUDPFrame reads a datagram into buf, io.EOF is returned only between frames.
+func readUDPFrame(reader *bufio.Reader, buf []byte) (msg []byte, err error) {
+	hi, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+	lo, err := reader.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	n := int(hi)<<8 | int(lo)
+	if n > len(buf) {
+		err = errors.Errorf("udp frame too large: %d bytes", n)
+		return
+	}
+	if _, err = io.ReadFull(reader, buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	return buf[:n], nil
+}
+
+// putUDPFrameHeader puts the length of datagram at the beginning of frame.
+func putUDPFrameHeader(frame []byte) error {
+	msgLen := len(frame) - udpFrameHeaderLen
+	if msgLen > maxUDPFrameLen {
+		return errors.Errorf("udp datagram too large for udp over tcp: %d bytes", msgLen)
+	}
+	frame[0], frame[1] = byte(msgLen>>8), byte(msgLen)
+	return nil
+}
+
+// udpStream carries datagrams of ClientUDPTunnel on the control connection.
+type udpStream struct {
+	trans io.ReadWriter
+	// for deadlines and address, nil if the connection is not net.Conn
+	conn net.Conn
+	// the connection, closed when a frame is broken, nil if not io.Closer
+	closer io.Closer
+
+	readMu sync.Mutex
+	reader *bufio.Reader
+	// set if a read failed in the middle of a frame, the stream is out of sync
+	broken  error
+	writeMu sync.Mutex
+}
+
+// UDPOverTCP creates an udp tunnel carried by the tcp connection with CmdUDPOverTCP,
+// the server must support this private command.
+func (c *Client) UDPOverTCP() (tunnel ClientUDPTunnel, err error) {
+	err = c.doAuth()
+	if err != nil {
+		return
+	}
+
+	err = c.protocol.SendCommand(CmdUDPOverTCP, NewSocksAddr(), 0)
+	if err != nil {
+		return
+	}
+
+	var reply byte
+	reply, tunnel.BindAddr, tunnel.BindPort, err = c.protocol.ReceiveReply()
+	if err != nil {
+		return
+	}
+	if reply != ReplyOK {
+		err = &ReplyError{reply}
+		return
+	}
+
+	trans, err := c.protocol.GetConnection()
+	if err != nil {
+		return
+	}
+	tunnel.stream = &udpStream{trans: trans, reader: bufio.NewReader(trans)}
+	tunnel.stream.conn, _ = c.conn.(net.Conn)
+	tunnel.stream.closer, _ = c.conn.(io.Closer)
+	// the stream lives on the connection, Dialer replaces it with its own
+	tunnel.ctrl = tunnel.stream.closer
+	return
+}
+
+func (s *udpStream) readFrom(b []byte) (n int, addr net.Addr, err error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+
+	if s.broken != nil {
+		err = s.broken
+		return
+	}
+	// errors before a frame, such as deadlines, leave the stream usable
+	if _, err = s.reader.Peek(1); err != nil {
+		return
+	}
+
+	buf := getUDPBuf()
+	defer putUDPBuf(buf)
+	msg, err := readUDPFrame(s.reader, *buf)
+	if err != nil {
+		// the length prefix is consumed, the rest can not be framed
+		s.broken = errors.Wrap(err, "udp over tcp stream broken")
+		err = s.broken
+		if s.closer != nil {
+			s.closer.Close()
+		}
+		return
+	}
+
+	sockAddr, port, data, err := ParseUDPMsg(msg)
+	if err != nil {
+		return
+	}
+	addr = &net.UDPAddr{IP: append(net.IP(nil), sockAddr.IP...), Port: int(port)}
+	n = copy(b, data)
+	return
+}
+
+func (s *udpStream) writeTo(b []byte, addr SocksAddr, port uint16) (n int, err error) {
+	buf := getUDPBuf()
+	defer putUDPBuf(buf)
+	frame, err := AppendUDPMsg((*buf)[:udpFrameHeaderLen], addr, port, b)
+	if err != nil {
+		return
+	}
+	if err = putUDPFrameHeader(frame); err != nil {
+		return
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if _, err = s.trans.Write(frame); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (s *udpStream) localAddr() net.Addr {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+func (s *udpStream) setDeadline(t time.Time, set func(conn net.Conn, t time.Time) error) error {
+	if s.conn == nil {
+		return errors.New("deadline not supported by the control connection")
+	}
+	return set(s.conn, t)
+}
@@ -0,0 +1,139 @@
+package socks_go
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadUDPFrame(t *testing.T) {
+	data := []byte{0, 3, 'a', 'b', 'c', 0, 0, 0, 2, 'x'}
+	reader := bufio.NewReader(bytes.NewReader(data))
+	buf := make([]byte, 16)
+
+	msg, err := readUDPFrame(reader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(msg))
+	msg, err = readUDPFrame(reader, buf)
+	require.NoError(t, err)
+	assert.Empty(t, msg)
+	_, err = readUDPFrame(reader, buf)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	_, err = readUDPFrame(bufio.NewReader(bytes.NewReader(nil)), buf)
+	assert.Equal(t, io.EOF, err)
+	_, err = readUDPFrame(bufio.NewReader(bytes.NewReader([]byte{0})), buf)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = readUDPFrame(bufio.NewReader(bytes.NewReader([]byte{0, 17})), buf)
+	assert.Error(t, err)
+}
+
+func TestPutUDPFrameHeader(t *testing.T) {
+	frame := make([]byte, udpFrameHeaderLen+0x1234)
+	require.NoError(t, putUDPFrameHeader(frame))
+	assert.Equal(t, []byte{0x12, 0x34}, frame[:2])
+
+	frame = make([]byte, udpFrameHeaderLen+maxUDPFrameLen+1)
+	assert.Error(t, putUDPFrameHeader(frame))
+}
+
+func TestServer_UDPOverTCP(t *testing.T) {
+	udpEcho := startUDPEcho(t)
+	defer udpEcho.Close()
+
+	for _, noBatch := range []bool{false, true} {
+		server := &Server{noUDPBatch: noBatch}
+		dialer := startServer(t, server)
+		dialer.Param.UDPOverTCP = true
+
+		tunnel, err := dialer.UDPAssociation()
+		require.NoError(t, err)
+		assert.IsType(t, &net.TCPAddr{}, tunnel.LocalAddr())
+		checkUDPEcho(t, tunnel, udpEcho.LocalAddr(), 0, 1, 1000, 60000)
+
+		// deadline of tcp connection
+		require.NoError(t, tunnel.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+		_, _, err = tunnel.ReadFrom(make([]byte, 100))
+		netErr, ok := err.(net.Error)
+		assert.True(t, ok && netErr.Timeout(), "%v", err)
+
+		tunnel.Close()
+		server.Close()
+	}
+}
+
+func TestServer_UDPOverTCPUpstream(t *testing.T) {
+	udpEcho := startUDPEcho(t)
+	defer udpEcho.Close()
+
+	upstream := &Server{}
+	defer upstream.Close()
+	upstreamDialer := startServer(t, upstream)
+	upstreamDialer.Param.UDPOverTCP = true
+
+	// udp association relayed over tcp to upstream
+	server := &Server{Upstream: upstreamDialer}
+	defer server.Close()
+	tunnel, err := startServer(t, server).UDPAssociation()
+	require.NoError(t, err)
+	defer tunnel.Close()
+	checkUDPEcho(t, tunnel, udpEcho.LocalAddr(), 10, 1000)
+}
+
+func TestUDPStream_BrokenFrame(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	stream := &udpStream{trans: conn, conn: conn, closer: conn, reader: bufio.NewReader(conn)}
+	buf := make([]byte, 100)
+
+	frame, err := AppendUDPMsg(make([]byte, udpFrameHeaderLen), NewSocksAddrFromIPV4(net.IPv4(1, 2, 3, 4)), 53, []byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, putUDPFrameHeader(frame))
+
+	// deadline between frames
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, _, err = stream.readFrom(buf)
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "%v", err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+	go peer.Write(frame)
+	n, addr, err := stream.readFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(buf[:n]))
+	assert.Equal(t, "1.2.3.4:53", addr.String())
+
+	// deadline in the middle of a frame
+	go peer.Write(frame[:4])
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, _, brokenErr := stream.readFrom(buf)
+	assert.Error(t, brokenErr)
+	_, err = peer.Write(frame)
+	assert.Error(t, err, "not closed")
+
+	_, _, err = stream.readFrom(buf)
+	assert.Equal(t, brokenErr, err)
+}
+
+func TestClient_UDPOverTCPClose(t *testing.T) {
+	server := &Server{}
+	defer server.Close()
+	conn, err := net.Dial("tcp", startServer(t, server).ProxyAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client := NewClient(conn, nil)
+	tunnel, err := client.UDPOverTCP()
+	require.NoError(t, err)
+	require.NoError(t, tunnel.Close())
+
+	// the stream is closed along with tunnel
+	_, err = conn.Write([]byte{0})
+	assert.Error(t, err)
+}
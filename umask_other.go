@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package socks_go
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+var umaskMu sync.Mutex
+
+// withUmask calls fn with permissions outside of mode masked, so files created by fn
+// are never more permissive than mode, zero mode means no change. Umask is per process,
+// files created by other goroutines meanwhile may get fewer permissions, never more.
+func withUmask(mode os.FileMode, fn func() error) error {
+	if mode == 0 {
+		return fn()
+	}
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+
+	old := syscall.Umask(int(^mode.Perm() & os.ModePerm))
+	defer syscall.Umask(old)
+	return fn()
+}
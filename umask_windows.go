@@ -0,0 +1,8 @@
+package socks_go
+
+import "os"
+
+// withUmask calls fn, there is no umask on windows.
+func withUmask(mode os.FileMode, fn func() error) error {
+	return fn()
+}
@@ -3,7 +3,15 @@ package util
 import "io"
 
 func ReadRequired(reader io.Reader, n int) (data []byte, err error) {
-	data = make([]byte, n)
+	return ReadRequiredBuf(reader, nil, n)
+}
+
+// ReadRequiredBuf is like ReadRequired but reads into buf if it is large enough.
+func ReadRequiredBuf(reader io.Reader, buf []byte, n int) (data []byte, err error) {
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	data = buf[:n]
 	_, err = io.ReadFull(reader, data)
 	return
 }